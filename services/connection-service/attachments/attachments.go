@@ -0,0 +1,393 @@
+package attachments
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"online-chat-go/auth"
+	"online-chat-go/chat"
+	"online-chat-go/config"
+	"online-chat-go/db/repository"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DownloadPath = "/attachments/download"
+
+	VariantOriginal  = "original"
+	VariantThumbnail = "thumbnail"
+
+	maxFilenameLength = 255
+	maxQueryIds       = 100
+	sniffLength       = 512
+	purgeBatchSize    = 100
+	thumbnailWorkers  = 2
+	thumbnailBacklog  = 100
+	defaultFilename   = "attachment"
+)
+
+var (
+	ErrEmptyAttachment  = errors.New("Attachment should not be empty")
+	ErrTooLarge         = errors.New("Attachment is too large")
+	ErrInvalidFilename  = errors.New("Filename should be at most 255 bytes long")
+	ErrInvalidQuery     = errors.New("Query should contain from 1 to 100 valid attachment ids")
+	ErrInvalidSignature = errors.New("Download url is invalid or expired")
+)
+
+// Attachment describes uploaded file, urls are signed and could be used without authentication until UrlsExpireAt
+type Attachment struct {
+	Id             string    `json:"id"`
+	ConversationId string    `json:"conversation_id"`
+	UploaderId     string    `json:"uploader_id"`
+	MessageId      *string   `json:"message_id,omitempty"`
+	Filename       string    `json:"filename"`
+	ContentType    string    `json:"content_type"`
+	Size           int64     `json:"size"`
+	Width          *int      `json:"width,omitempty"`
+	Height         *int      `json:"height,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	Url            string    `json:"url"`
+	ThumbnailUrl   string    `json:"thumbnail_url,omitempty"`
+	UrlsExpireAt   time.Time `json:"urls_expire_at"`
+}
+
+// Attachments stores files uploaded to conversations, which messages refer to by id. Content type is sniffed from
+// contents rather than trusted to client, images get thumbnails generated in background by a few workers, so
+// thumbnail url is only returned once it is ready. Attachments which were never sent or whose message was deleted
+// are purged along with their blobs
+type Attachments struct {
+	conversations *chat.ConversationService
+	attachments   repository.AttachmentRepository
+	store         BlobStore
+	maxSize       int64
+	thumbnailSize int
+	secret        []byte
+	urlTtl        time.Duration
+	orphanTtl     time.Duration
+	thumbnails    chan string // ids of attachments waiting for thumbnail
+}
+
+func NewAttachments(
+	conversations *chat.ConversationService,
+	attachments repository.AttachmentRepository,
+	store BlobStore,
+	cfg *config.AttachmentsConfig,
+) *Attachments {
+	return &Attachments{
+		conversations: conversations,
+		attachments:   attachments,
+		store:         store,
+		maxSize:       cfg.MaxSize,
+		thumbnailSize: cfg.ThumbnailSize,
+		secret:        []byte(cfg.Secret),
+		urlTtl:        cfg.UrlTtl,
+		orphanTtl:     cfg.OrphanTtl,
+		thumbnails:    make(chan string, thumbnailBacklog),
+	}
+}
+
+// MaxSize is the limit of attachment size in bytes
+func (a *Attachments) MaxSize() int64 {
+	return a.maxSize
+}
+
+// Upload stores body as attachment of conversation, it could be sent only by uploader within orphan ttl
+func (a *Attachments) Upload(ctx context.Context, principal *auth.Principal, conversationId string, filename string, body io.Reader) (*Attachment, error) {
+	filename, err := sanitizeFilename(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err = a.conversations.CheckMember(ctx, principal.Id, conversationId); err != nil {
+		return nil, err
+	}
+
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(body, head)
+	if err == io.EOF {
+		return nil, ErrEmptyAttachment
+	} else if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	head = head[:n]
+
+	attachment := &repository.DbAttachment{
+		Id:             uuid.NewString(),
+		ConversationId: conversationId,
+		UploaderId:     principal.Id,
+		Filename:       filename,
+		ContentType:    http.DetectContentType(head),
+	}
+	contents := &sizeLimitedReader{reader: io.MultiReader(bytes.NewReader(head), body), remaining: a.maxSize}
+	if attachment.Size, err = a.store.Put(ctx, attachment.Id, attachment.ContentType, contents); err != nil {
+		return nil, err
+	}
+
+	thumbnail := thumbnailSources[attachment.ContentType] && a.readImageSize(ctx, attachment)
+
+	if err = a.attachments.Insert(ctx, attachment); err != nil {
+		a.deleteBlobs(ctx, attachment.Id)
+		return nil, err
+	}
+	if thumbnail {
+		select {
+		case a.thumbnails <- attachment.Id:
+		default:
+			log.Printf("Error scheduling thumbnail of attachment: %s, err: too many pending thumbnails\n", attachment.Id)
+		}
+	}
+	return a.toAttachment(attachment), nil
+}
+
+// Resolve returns attachments of conversation with fresh download urls, attachments which were not sent yet
+// are only visible to uploader
+func (a *Attachments) Resolve(ctx context.Context, principal *auth.Principal, conversationId string, ids []string) ([]Attachment, error) {
+	if len(ids) == 0 || len(ids) > maxQueryIds {
+		return nil, ErrInvalidQuery
+	}
+	for _, id := range ids {
+		if _, err := uuid.Parse(id); err != nil {
+			return nil, ErrInvalidQuery
+		}
+	}
+	if err := a.conversations.CheckMember(ctx, principal.Id, conversationId); err != nil {
+		return nil, err
+	}
+
+	attachments, err := a.attachments.ListVisible(ctx, principal.Id, conversationId, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]Attachment, 0, len(attachments))
+	for i := range attachments {
+		result = append(result, *a.toAttachment(&attachments[i]))
+	}
+	return result, nil
+}
+
+// Open checks signature of download url and opens requested variant of attachment, caller should close it
+func (a *Attachments) Open(ctx context.Context, id string, variant string, expires string, signature string) (*repository.DbAttachment, io.ReadCloser, error) {
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > expiresAt {
+		return nil, nil, ErrInvalidSignature
+	}
+	if variant != VariantOriginal && variant != VariantThumbnail {
+		return nil, nil, ErrInvalidSignature
+	}
+	expected := a.sign(id, variant, expiresAt)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return nil, nil, ErrInvalidSignature
+	}
+
+	attachment, err := a.attachments.Get(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	} else if variant == VariantThumbnail && !attachment.HasThumbnail {
+		return nil, nil, repository.ErrAttachmentNotFound
+	}
+
+	blob, err := a.store.Get(ctx, blobKey(id, variant))
+	if errors.Is(err, ErrBlobNotFound) {
+		return nil, nil, repository.ErrAttachmentNotFound
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return attachment, blob, nil
+}
+
+// Start generates thumbnails and periodically purges attachments which were never sent or whose message was deleted
+// until context is cancelled
+func (a *Attachments) Start(ctx context.Context) {
+	for i := 0; i < thumbnailWorkers; i++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case id := <-a.thumbnails:
+					a.storeThumbnail(ctx, id)
+				}
+			}
+		}()
+	}
+
+	go func() {
+		ticker := time.NewTicker(a.orphanTtl)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case <-ticker.C:
+				if err := a.purge(ctx); err != nil {
+					log.Println("Error purging attachments: ", err)
+				}
+			}
+		}
+	}()
+}
+
+func (a *Attachments) purge(ctx context.Context) error {
+	uploadedBefore := time.Now().Add(-a.orphanTtl)
+	for {
+		ids, err := a.attachments.ListPurgeable(ctx, uploadedBefore, purgeBatchSize)
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+
+		removed, err := a.attachments.Remove(ctx, ids, uploadedBefore)
+		if err != nil {
+			return err
+		}
+		for _, id := range removed {
+			a.deleteBlobs(ctx, id)
+		}
+		if len(ids) < purgeBatchSize {
+			return nil
+		}
+	}
+}
+
+// storeThumbnail is best effort, attachment stays without thumbnail if image could not be decoded
+func (a *Attachments) storeThumbnail(ctx context.Context, id string) {
+	src, err := a.store.Get(ctx, id)
+	if err != nil {
+		log.Printf("Error opening attachment: %s, err: %s\n", id, err)
+		return
+	}
+	defer src.Close()
+
+	var thumbnail bytes.Buffer
+	if err = writeThumbnail(&thumbnail, src, a.thumbnailSize); err != nil {
+		log.Printf("Error generating thumbnail of attachment: %s, err: %s\n", id, err)
+		return
+	}
+	if _, err = a.store.Put(ctx, blobKey(id, VariantThumbnail), ThumbnailContentType, &thumbnail); err != nil {
+		log.Printf("Error storing thumbnail of attachment: %s, err: %s\n", id, err)
+		return
+	}
+
+	// attachment could be purged meanwhile, its thumbnail would then stay behind
+	stored, err := a.attachments.SetThumbnail(ctx, id)
+	if err != nil {
+		log.Printf("Error storing thumbnail of attachment: %s, err: %s\n", id, err)
+	} else if !stored {
+		if err = a.store.Delete(ctx, blobKey(id, VariantThumbnail)); err != nil {
+			log.Printf("Error deleting blob of attachment: %s, err: %s\n", id, err)
+		}
+	}
+}
+
+// readImageSize sets dimensions of image attachment, it tells whether thumbnail could be generated for it
+func (a *Attachments) readImageSize(ctx context.Context, attachment *repository.DbAttachment) bool {
+	src, err := a.store.Get(ctx, attachment.Id)
+	if err != nil {
+		log.Printf("Error opening attachment: %s, err: %s\n", attachment.Id, err)
+		return false
+	}
+	defer src.Close()
+
+	width, height, err := imageSize(src)
+	if err != nil {
+		log.Printf("Error reading image size of attachment: %s, err: %s\n", attachment.Id, err)
+		return false
+	}
+	attachment.Width, attachment.Height = &width, &height
+	return width*height <= maxImagePixels
+}
+
+func (a *Attachments) deleteBlobs(ctx context.Context, id string) {
+	for _, variant := range []string{VariantOriginal, VariantThumbnail} {
+		if err := a.store.Delete(ctx, blobKey(id, variant)); err != nil {
+			log.Printf("Error deleting blob of attachment: %s, err: %s\n", id, err)
+		}
+	}
+}
+
+func (a *Attachments) toAttachment(attachment *repository.DbAttachment) *Attachment {
+	expiresAt := time.Now().Add(a.urlTtl).UTC().Truncate(time.Second)
+	result := &Attachment{
+		Id:             attachment.Id,
+		ConversationId: attachment.ConversationId,
+		UploaderId:     attachment.UploaderId,
+		MessageId:      attachment.MessageId,
+		Filename:       attachment.Filename,
+		ContentType:    attachment.ContentType,
+		Size:           attachment.Size,
+		Width:          attachment.Width,
+		Height:         attachment.Height,
+		CreatedAt:      attachment.CreatedAt.UTC(),
+		Url:            a.downloadUrl(attachment.Id, VariantOriginal, expiresAt),
+		UrlsExpireAt:   expiresAt,
+	}
+	if attachment.HasThumbnail {
+		result.ThumbnailUrl = a.downloadUrl(attachment.Id, VariantThumbnail, expiresAt)
+	}
+	return result
+}
+
+func (a *Attachments) downloadUrl(id string, variant string, expiresAt time.Time) string {
+	params := url.Values{}
+	params.Set("id", id)
+	params.Set("variant", variant)
+	params.Set("expires", strconv.FormatInt(expiresAt.Unix(), 10))
+	params.Set("signature", a.sign(id, variant, expiresAt.Unix()))
+	return DownloadPath + "?" + params.Encode()
+}
+
+func (a *Attachments) sign(id string, variant string, expiresAt int64) string {
+	mac := hmac.New(sha256.New, a.secret)
+	_, _ = fmt.Fprintf(mac, "%s:%s:%d", id, variant, expiresAt)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func blobKey(id string, variant string) string {
+	if variant == VariantThumbnail {
+		return id + "." + VariantThumbnail
+	}
+	return id
+}
+
+// sanitizeFilename drops directories client may have sent along with filename
+func sanitizeFilename(filename string) (string, error) {
+	filename = path.Base(strings.ReplaceAll(strings.TrimSpace(filename), "\\", "/"))
+	if filename == "." || filename == "/" {
+		filename = defaultFilename
+	}
+	if len(filename) > maxFilenameLength {
+		return "", ErrInvalidFilename
+	}
+	return filename, nil
+}
+
+// sizeLimitedReader fails with ErrTooLarge once more than remaining bytes are read
+type sizeLimitedReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func (r *sizeLimitedReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > r.remaining+1 {
+		p = p[:r.remaining+1]
+	}
+	n, err := r.reader.Read(p)
+	r.remaining -= int64(n)
+	if r.remaining < 0 {
+		return n, ErrTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,179 @@
+package attachments
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"online-chat-go/auth"
+	"online-chat-go/chat"
+	"online-chat-go/db/repository"
+	"online-chat-go/util"
+	"online-chat-go/websocket"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	TypeAttachments = "attachments"
+
+	fileFormField = "file"
+	// multipart boundaries and headers are not counted towards attachment size
+	multipartOverhead = 64 * 1024
+)
+
+var errMalformedUpload = errors.New("Request should be multipart form with file field")
+
+type ResolvePayload struct {
+	Ids []string `json:"ids"`
+}
+
+type AttachmentsPayload struct {
+	Attachments []Attachment `json:"attachments"`
+}
+
+// NewAttachmentsHandler serves POST (upload multipart file field) and GET (resolve attachments by id parameters)
+// on /attachments, conversation_id query parameter is required by both
+func NewAttachmentsHandler(attachments *Attachments) func(http.ResponseWriter, *http.Request, *auth.Principal) {
+	return func(writer http.ResponseWriter, request *http.Request, principal *auth.Principal) {
+		params := request.URL.Query()
+		switch request.Method {
+		case http.MethodGet:
+			resolved, err := attachments.Resolve(request.Context(), principal, params.Get("conversation_id"), params["id"])
+			if err != nil {
+				WriteServiceError(writer, err)
+				return
+			}
+			util.WriteJson(writer, http.StatusOK, AttachmentsPayload{Attachments: resolved})
+
+		case http.MethodPost:
+			request.Body = http.MaxBytesReader(writer, request.Body, attachments.MaxSize()+multipartOverhead)
+			file, filename, err := readFilePart(request)
+			if err != nil {
+				WriteServiceError(writer, err)
+				return
+			}
+
+			attachment, err := attachments.Upload(request.Context(), principal, params.Get("conversation_id"), filename, file)
+			if err != nil {
+				WriteServiceError(writer, err)
+				return
+			}
+			util.WriteJson(writer, http.StatusCreated, attachment)
+
+		default:
+			writer.Header().Set("Allow", "GET, POST")
+			util.WriteError(writer, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	}
+}
+
+// NewDownloadHandler serves GET on /attachments/download, request is authorized by signature of url
+// rather than by principal, so urls could be used directly by browsers and image loaders
+func NewDownloadHandler(attachments *Attachments) func(http.ResponseWriter, *http.Request) {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if !util.RequireMethod(writer, request, http.MethodGet) {
+			return
+		}
+
+		params := request.URL.Query()
+		expires := params.Get("expires")
+		attachment, blob, err := attachments.Open(request.Context(), params.Get("id"), params.Get("variant"), expires, params.Get("signature"))
+		if err != nil {
+			WriteServiceError(writer, err)
+			return
+		}
+		defer blob.Close()
+
+		header := writer.Header()
+		contentType := attachment.ContentType
+		if params.Get("variant") == VariantThumbnail {
+			contentType = ThumbnailContentType
+		} else {
+			header.Set("Content-Length", strconv.FormatInt(attachment.Size, 10))
+		}
+		disposition := "attachment"
+		if strings.HasPrefix(contentType, "image/") {
+			disposition = "inline"
+		}
+		header.Set("Content-Type", contentType)
+		header.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Filename}))
+		header.Set("X-Content-Type-Options", "nosniff")
+		header.Set("Content-Security-Policy", "sandbox")
+		if expiresAt, err := strconv.ParseInt(expires, 10, 64); err == nil {
+			header.Set("Cache-Control", "private, max-age="+strconv.FormatInt(expiresAt-time.Now().Unix(), 10))
+		}
+
+		writer.WriteHeader(http.StatusOK)
+		if _, err = io.Copy(writer, blob); err != nil {
+			log.Printf("Error sending attachment: %s, err: %s\n", attachment.Id, err)
+		}
+	}
+}
+
+// NewResolveHandler answers attachments request with attachments frame correlated with it
+func NewResolveHandler(attachments *Attachments) websocket.Handler {
+	return func(ctx context.Context, conn websocket.WSConnection, env *websocket.Envelope) error {
+		var payload ResolvePayload
+		if err := env.DecodePayload(&payload); err != nil {
+			return err
+		}
+
+		resolved, err := attachments.Resolve(ctx, conn.Principal(), env.ConversationId, payload.Ids)
+		if err != nil {
+			return ToProtocolError(err)
+		}
+		return websocket.Reply(conn, env, TypeAttachments, AttachmentsPayload{Attachments: resolved})
+	}
+}
+
+// readFilePart streams file field of multipart request without buffering it
+func readFilePart(request *http.Request) (io.Reader, string, error) {
+	reader, err := request.MultipartReader()
+	if err != nil {
+		return nil, "", errMalformedUpload
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, "", errMalformedUpload
+		} else if err != nil {
+			return nil, "", err
+		}
+		if part.FormName() == fileFormField {
+			return part, part.FileName(), nil
+		}
+	}
+}
+
+// WriteServiceError maps attachment errors to http statuses, errors of conversations are mapped by chat
+func WriteServiceError(writer http.ResponseWriter, err error) {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, ErrEmptyAttachment), errors.Is(err, ErrInvalidFilename), errors.Is(err, ErrInvalidQuery),
+		errors.Is(err, errMalformedUpload):
+		util.WriteError(writer, http.StatusBadRequest, err.Error())
+	case errors.Is(err, ErrTooLarge), errors.As(err, &maxBytesErr):
+		util.WriteError(writer, http.StatusRequestEntityTooLarge, ErrTooLarge.Error())
+	case errors.Is(err, ErrInvalidSignature):
+		util.WriteError(writer, http.StatusForbidden, err.Error())
+	case errors.Is(err, repository.ErrAttachmentNotFound):
+		util.WriteError(writer, http.StatusNotFound, err.Error())
+	default:
+		chat.WriteServiceError(writer, err)
+	}
+}
+
+// ToProtocolError maps attachment errors to error codes reported to websocket clients
+func ToProtocolError(err error) error {
+	switch {
+	case errors.Is(err, ErrInvalidQuery):
+		return websocket.NewProtocolError(websocket.ErrCodeInvalid, err.Error())
+	default:
+		return chat.ToProtocolError(err)
+	}
+}
@@ -0,0 +1,95 @@
+package attachments
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+var (
+	ErrBlobNotFound = errors.New("Blob not found")
+	ErrInvalidKey   = errors.New("Malformed blob key")
+)
+
+// BlobStore keeps contents of attachments by key. It follows object storage semantics, so S3 compatible
+// store could be plugged in instead of the local one
+type BlobStore interface {
+	// Put stores the whole body under key, returning its size. Nothing is stored if reading body fails
+	Put(ctx context.Context, key string, contentType string, body io.Reader) (int64, error)
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete succeeds if there is no blob with such key
+	Delete(ctx context.Context, key string) error
+}
+
+// LocalStore keeps blobs as files in a single directory, blob is written to temporary file first,
+// so partially uploaded blobs are never visible
+type LocalStore struct {
+	dir string
+}
+
+func NewLocalStore(dir string) (*LocalStore, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	return &LocalStore{dir: dir}, nil
+}
+
+func (ls *LocalStore) Put(_ context.Context, key string, _ string, body io.Reader) (int64, error) {
+	path, err := ls.path(key)
+	if err != nil {
+		return 0, err
+	}
+
+	file, err := os.CreateTemp(ls.dir, ".upload-*")
+	if err != nil {
+		return 0, err
+	}
+	size, err := io.Copy(file, body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return 0, err
+	}
+	return size, nil
+}
+
+func (ls *LocalStore) Get(_ context.Context, key string) (io.ReadCloser, error) {
+	path, err := ls.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	return file, err
+}
+
+func (ls *LocalStore) Delete(_ context.Context, key string) error {
+	path, err := ls.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err = os.Remove(path); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// path does not let keys escape the directory or clash with temporary files
+func (ls *LocalStore) path(key string) (string, error) {
+	if key == "" || key[0] == '.' || filepath.Base(key) != key {
+		return "", ErrInvalidKey
+	}
+	return filepath.Join(ls.dir, key), nil
+}
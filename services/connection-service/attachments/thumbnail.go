@@ -0,0 +1,147 @@
+package attachments
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+)
+
+const (
+	ThumbnailContentType = "image/jpeg"
+
+	// images are decoded into memory, so larger ones are stored without thumbnail, decoded image of max size
+	// takes from 24 to 64 MB depending on its format
+	maxImagePixels   = 16_000_000
+	thumbnailQuality = 80
+)
+
+var thumbnailSources = map[string]bool{"image/jpeg": true, "image/png": true, "image/gif": true}
+
+// imageSize reads dimensions of image without decoding it
+func imageSize(src io.Reader) (int, int, error) {
+	cfg, _, err := image.DecodeConfig(src)
+	if err != nil {
+		return 0, 0, err
+	}
+	return cfg.Width, cfg.Height, nil
+}
+
+// writeThumbnail scales image down to fit into size x size square keeping its proportions, images which
+// already fit are just re-encoded. Transparent areas are filled with white, as thumbnails are encoded as jpeg
+func writeThumbnail(dst io.Writer, src io.Reader, size int) error {
+	img, _, err := image.Decode(src)
+	if err != nil {
+		return err
+	}
+
+	scaled := scaleDown(img, size)
+	bounds := scaled.Bounds()
+	thumbnail := image.NewRGBA(bounds)
+	draw.Draw(thumbnail, bounds, image.White, image.Point{}, draw.Src)
+	draw.Draw(thumbnail, bounds, scaled, bounds.Min, draw.Over)
+	return jpeg.Encode(dst, thumbnail, &jpeg.Options{Quality: thumbnailQuality})
+}
+
+// scaleDown averages every block of source pixels which is mapped to a single thumbnail pixel
+func scaleDown(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= size && height <= size {
+		return img
+	}
+
+	thumbWidth, thumbHeight := size, size
+	if width > height {
+		thumbHeight = height * size / width
+	} else {
+		thumbWidth = width * size / height
+	}
+	if thumbWidth == 0 {
+		thumbWidth = 1
+	}
+	if thumbHeight == 0 {
+		thumbHeight = 1
+	}
+
+	pixel := pixelReader(img)
+	scaled := image.NewRGBA64(image.Rect(0, 0, thumbWidth, thumbHeight))
+	for y := 0; y < thumbHeight; y++ {
+		fromY, toY := bounds.Min.Y+y*height/thumbHeight, bounds.Min.Y+(y+1)*height/thumbHeight
+		for x := 0; x < thumbWidth; x++ {
+			fromX, toX := bounds.Min.X+x*width/thumbWidth, bounds.Min.X+(x+1)*width/thumbWidth
+
+			var r, g, b, a, count uint64
+			for sy := fromY; sy < toY; sy++ {
+				for sx := fromX; sx < toX; sx++ {
+					pr, pg, pb, pa := pixel(sx, sy)
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+					count++
+				}
+			}
+			if count > 0 {
+				scaled.SetRGBA64(x, y, color.RGBA64{
+					R: uint16(r / count),
+					G: uint16(g / count),
+					B: uint16(b / count),
+					A: uint16(a / count),
+				})
+			}
+		}
+	}
+	return scaled
+}
+
+// pixelReader returns alpha-premultiplied 16 bit color components of image pixels. Decoded jpeg, png and gif images
+// are read directly, as At allocates color for every pixel
+func pixelReader(img image.Image) func(x, y int) (uint32, uint32, uint32, uint32) {
+	switch src := img.(type) {
+	case *image.YCbCr:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			yi, ci := src.YOffset(x, y), src.COffset(x, y)
+			r, g, b := color.YCbCrToRGB(src.Y[yi], src.Cb[ci], src.Cr[ci])
+			return uint32(r) * 0x101, uint32(g) * 0x101, uint32(b) * 0x101, 0xffff
+		}
+
+	case *image.RGBA:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			p := src.Pix[src.PixOffset(x, y):]
+			return uint32(p[0]) * 0x101, uint32(p[1]) * 0x101, uint32(p[2]) * 0x101, uint32(p[3]) * 0x101
+		}
+
+	case *image.NRGBA:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			p := src.Pix[src.PixOffset(x, y):]
+			a := uint32(p[3]) * 0x101
+			return uint32(p[0]) * 0x101 * a / 0xffff, uint32(p[1]) * 0x101 * a / 0xffff, uint32(p[2]) * 0x101 * a / 0xffff, a
+		}
+
+	case *image.Gray:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			v := uint32(src.Pix[src.PixOffset(x, y)]) * 0x101
+			return v, v, v, 0xffff
+		}
+
+	case *image.Paletted:
+		palette := make([][4]uint32, len(src.Palette))
+		for i, c := range src.Palette {
+			r, g, b, a := c.RGBA()
+			palette[i] = [4]uint32{r, g, b, a}
+		}
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			i := int(src.Pix[src.PixOffset(x, y)])
+			if i >= len(palette) {
+				return 0, 0, 0, 0
+			}
+			return palette[i][0], palette[i][1], palette[i][2], palette[i][3]
+		}
+
+	default:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			return img.At(x, y).RGBA()
+		}
+	}
+}
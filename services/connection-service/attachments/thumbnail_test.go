@@ -0,0 +1,75 @@
+package attachments
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestPixelReaderMatchesAt(t *testing.T) {
+	rect := image.Rect(1, 2, 9, 7)
+	palette := color.Palette{color.Black, color.NRGBA{R: 200, G: 100, B: 50, A: 128}, color.Transparent}
+
+	ycbcr := image.NewYCbCr(rect, image.YCbCrSubsampleRatio420)
+	for i := range ycbcr.Y {
+		ycbcr.Y[i] = uint8(i * 7)
+	}
+	for i := range ycbcr.Cb {
+		ycbcr.Cb[i], ycbcr.Cr[i] = uint8(i*31), uint8(255-i*17)
+	}
+
+	images := map[string]image.Image{
+		"ycbcr":    ycbcr,
+		"rgba":     image.NewRGBA(rect),
+		"nrgba":    image.NewNRGBA(rect),
+		"gray":     image.NewGray(rect),
+		"paletted": image.NewPaletted(rect, palette),
+		"generic":  image.NewCMYK(rect),
+	}
+	for _, img := range images {
+		if settable, ok := img.(interface{ Set(x, y int, c color.Color) }); ok && img != ycbcr {
+			for y := rect.Min.Y; y < rect.Max.Y; y++ {
+				for x := rect.Min.X; x < rect.Max.X; x++ {
+					settable.Set(x, y, palette[(x+y)%len(palette)])
+				}
+			}
+		}
+	}
+
+	for name, img := range images {
+		t.Run(name, func(t *testing.T) {
+			pixel := pixelReader(img)
+			for y := rect.Min.Y; y < rect.Max.Y; y++ {
+				for x := rect.Min.X; x < rect.Max.X; x++ {
+					r, g, b, a := pixel(x, y)
+					er, eg, eb, ea := img.At(x, y).RGBA()
+					// ycbcr is converted to 8 bit rgb, so it may differ from At in the lower byte
+					for i, pair := range [][2]uint32{{r, er}, {g, eg}, {b, eb}, {a, ea}} {
+						if diff := int(pair[0]) - int(pair[1]); diff > 0x101 || diff < -0x101 {
+							t.Fatalf("pixel (%d, %d) component %d is %#x, expected %#x", x, y, i, pair[0], pair[1])
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestScaleDownKeepsProportions(t *testing.T) {
+	tests := []struct {
+		width, height int
+		expected      image.Point
+	}{
+		{width: 100, height: 50, expected: image.Pt(10, 5)},
+		{width: 50, height: 100, expected: image.Pt(5, 10)},
+		{width: 1000, height: 1, expected: image.Pt(10, 1)},
+		{width: 8, height: 4, expected: image.Pt(8, 4)},
+	}
+
+	for _, test := range tests {
+		scaled := scaleDown(image.NewRGBA(image.Rect(0, 0, test.width, test.height)), 10)
+		if size := scaled.Bounds().Size(); size != test.expected {
+			t.Errorf("%dx%d is scaled to %v, expected %v", test.width, test.height, size, test.expected)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"online-chat-go/config"
+	"online-chat-go/db/repository"
+)
+
+// ApiKeyAuthorizer authorizes internal services by api key, only sha256 hashes of keys are stored,
+// which is enough since keys are random and long enough to make brute force pointless
+type ApiKeyAuthorizer struct {
+	header string
+	keys   repository.ApiKeyRepository
+}
+
+func NewApiKeyAuthorizer(config *config.ApiKeyConfig, keys repository.ApiKeyRepository) *ApiKeyAuthorizer {
+	return &ApiKeyAuthorizer{header: config.Header, keys: keys}
+}
+
+func (aa *ApiKeyAuthorizer) Authorize(req *http.Request) (*Principal, error) {
+	rawKey := req.Header.Get(aa.header)
+	if rawKey == "" {
+		return nil, ErrNoCredentials
+	}
+
+	hash := sha256.Sum256([]byte(rawKey))
+	key, err := aa.keys.GetActiveByHash(req.Context(), hash[:])
+	if errors.Is(err, repository.ErrApiKeyNotFound) {
+		return nil, errors.New("Invalid api key")
+	} else if err != nil {
+		return nil, err
+	}
+
+	principal := &Principal{
+		Id:          key.PrincipalId,
+		DisplayName: key.Name,
+		Roles:       key.Roles,
+		Scopes:      key.Scopes,
+		SessionId:   "api-key:" + key.Id,
+	}
+	if key.ExpiresAt != nil {
+		principal.ExpiresAt = *key.ExpiresAt
+	}
+	return principal, nil
+}
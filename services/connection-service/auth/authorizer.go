@@ -3,21 +3,47 @@ package auth
 import (
 	"errors"
 	"net/http"
-	"strconv"
+	"online-chat-go/util"
+)
+
+var (
+	ErrNoCredentials  = errors.New("No credentials provided")
+	ErrSessionRevoked = errors.New("Session has been revoked")
 )
 
 type Authorizer interface {
 	Authorize(req *http.Request) (*Principal, error)
 }
 
+// TokenAuthorizer is implemented by authorizers able to verify raw token passed in-band, e.g. to refresh credentials
+// of already established websocket connection
+type TokenAuthorizer interface {
+	AuthorizeToken(token string) (*Principal, error)
+}
+
 type NoOpAuthorizer struct{}
 
 func (n *NoOpAuthorizer) Authorize(_ *http.Request) (*Principal, error) {
 	return nil, errors.New("unimplemented yet")
 }
 
-type DummyAuthorizer struct{}
+type DummyAuthorizer struct {
+	userId string
+}
 
 func (d *DummyAuthorizer) Authorize(_ *http.Request) (*Principal, error) {
-	return &Principal{Id: strconv.Itoa(1)}, nil
+	return &Principal{Id: d.userId, DisplayName: "user"}, nil
+}
+
+// NewAuthenticatedHandler rejects requests which could not be authorized, passing principal to wrapped handler otherwise
+func NewAuthenticatedHandler(authorizer Authorizer, handler func(http.ResponseWriter, *http.Request, *Principal)) func(w http.ResponseWriter, r *http.Request) {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		principal, err := authorizer.Authorize(request)
+		if err != nil {
+			util.WriteError(writer, http.StatusUnauthorized, err.Error())
+			return
+		}
+
+		handler(writer, request, principal)
+	}
 }
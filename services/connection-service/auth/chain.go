@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"online-chat-go/config"
+	"online-chat-go/db/repository"
+)
+
+// ChainAuthorizer tries authorizers in order, moving to the next one only if request carries no credentials
+// for the current one, so invalid credentials are never silently downgraded to another authorization method
+type ChainAuthorizer struct {
+	authorizers []Authorizer
+}
+
+func NewChainAuthorizer(authorizers ...Authorizer) *ChainAuthorizer {
+	return &ChainAuthorizer{authorizers: authorizers}
+}
+
+func (ca *ChainAuthorizer) Authorize(req *http.Request) (*Principal, error) {
+	for _, authorizer := range ca.authorizers {
+		principal, err := authorizer.Authorize(req)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return principal, err
+	}
+
+	return nil, ErrNoCredentials
+}
+
+// AuthorizeToken delegates to the first authorizer in chain able to verify raw tokens
+func (ca *ChainAuthorizer) AuthorizeToken(token string) (*Principal, error) {
+	for _, authorizer := range ca.authorizers {
+		if tokenAuthorizer, ok := authorizer.(TokenAuthorizer); ok {
+			return tokenAuthorizer.AuthorizeToken(token)
+		}
+	}
+
+	return nil, errors.New("Authorizer does not support token authorization")
+}
+
+type Authorizers struct {
+	Chain  *ChainAuthorizer
+	Jwt    *JwtAuthorizer
+	Cookie *CookieAuthorizer
+}
+
+// NewAuthorizersFromConfig builds authorizers chain in order defined by config
+func NewAuthorizersFromConfig(cfg *config.AuthConfig, apiKeys repository.ApiKeyRepository) (*Authorizers, error) {
+	jwtAuthorizer, err := NewJwtAuthorizer(&cfg.Jwt)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Authorizers{
+		Jwt:    jwtAuthorizer,
+		Cookie: NewCookieAuthorizer(&cfg.Cookie, jwtAuthorizer),
+	}
+
+	chain := make([]Authorizer, 0, len(cfg.Authorizers))
+	for _, name := range cfg.Authorizers {
+		switch name {
+		case config.JwtAuthorizer:
+			chain = append(chain, result.Jwt)
+		case config.CookieAuthorizer:
+			chain = append(chain, result.Cookie)
+		case config.ApiKeyAuthorizer:
+			chain = append(chain, NewApiKeyAuthorizer(&cfg.ApiKey, apiKeys))
+		case config.DummyAuthorizer:
+			chain = append(chain, &DummyAuthorizer{userId: cfg.Dummy.UserId})
+		default:
+			return nil, fmt.Errorf("Unknown authorizer: %s", name)
+		}
+	}
+	result.Chain = NewChainAuthorizer(chain...)
+
+	return result, nil
+}
@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"online-chat-go/config"
+	"strings"
+)
+
+var ErrOriginNotAllowed = errors.New("Origin is not allowed to use session cookie")
+
+// CookieAuthorizer authorizes browsers by session token stored in http only cookie set on login. Browser sends cookie
+// on its own, so requests coming from pages of origins which are not allowed are rejected
+type CookieAuthorizer struct {
+	config     *config.CookieConfig
+	authorizer TokenAuthorizer
+}
+
+func NewCookieAuthorizer(config *config.CookieConfig, authorizer TokenAuthorizer) *CookieAuthorizer {
+	return &CookieAuthorizer{config: config, authorizer: authorizer}
+}
+
+func (ca *CookieAuthorizer) Authorize(req *http.Request) (*Principal, error) {
+	cookie, err := req.Cookie(ca.config.Name)
+	if errors.Is(err, http.ErrNoCookie) || (err == nil && cookie.Value == "") {
+		return nil, ErrNoCredentials
+	} else if err != nil {
+		return nil, err
+	}
+	if !ca.allowedOrigin(req.Header.Get("Origin")) {
+		return nil, ErrOriginNotAllowed
+	}
+
+	return ca.authorizer.AuthorizeToken(cookie.Value)
+}
+
+// allowedOrigin accepts requests without origin, browsers send it with every websocket handshake and cross origin
+// request, so cookie could not be sent without it on behalf of another page
+func (ca *CookieAuthorizer) allowedOrigin(origin string) bool {
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range ca.config.AllowedOrigins {
+		if strings.EqualFold(origin, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ca *CookieAuthorizer) AuthorizeToken(token string) (*Principal, error) {
+	return ca.authorizer.AuthorizeToken(token)
+}
+
+func (ca *CookieAuthorizer) SetSessionCookie(writer http.ResponseWriter, token *IssuedToken) {
+	http.SetCookie(writer, &http.Cookie{
+		Name:     ca.config.Name,
+		Value:    token.Token,
+		Path:     "/",
+		Expires:  token.ExpiresAt,
+		Secure:   ca.config.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func (ca *CookieAuthorizer) ClearSessionCookie(writer http.ResponseWriter) {
+	http.SetCookie(writer, &http.Cookie{
+		Name:     ca.config.Name,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   ca.config.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
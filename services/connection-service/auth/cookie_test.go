@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"errors"
+	"net/http/httptest"
+	"online-chat-go/config"
+	"testing"
+)
+
+// anyToken authorizes every token as the same user
+type anyToken struct{}
+
+func (anyToken) AuthorizeToken(_ string) (*Principal, error) {
+	return &Principal{Id: "user"}, nil
+}
+
+func TestCookieAuthorizerChecksOrigin(t *testing.T) {
+	cfg := &config.CookieConfig{Name: "session", AllowedOrigins: []string{"https://chat.example.com"}}
+	authorizer := NewCookieAuthorizer(cfg, anyToken{})
+
+	tests := []struct {
+		name     string
+		origin   string
+		cookie   bool
+		expected error
+	}{
+		{name: "allowed origin", origin: "https://chat.example.com", cookie: true},
+		{name: "allowed origin in other case", origin: "https://Chat.Example.com", cookie: true},
+		{name: "no origin", cookie: true},
+		{name: "sibling subdomain", origin: "https://evil.example.com", cookie: true, expected: ErrOriginNotAllowed},
+		{name: "other scheme", origin: "http://chat.example.com", cookie: true, expected: ErrOriginNotAllowed},
+		{name: "no cookie", origin: "https://evil.example.com", expected: ErrNoCredentials},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", "/", nil)
+			if test.origin != "" {
+				request.Header.Set("Origin", test.origin)
+			}
+			if test.cookie {
+				request.Header.Set("Cookie", "session=token")
+			}
+
+			if _, err := authorizer.Authorize(request); !errors.Is(err, test.expected) {
+				t.Errorf("authorization failed with err: %v, expected: %v", err, test.expected)
+			}
+		})
+	}
+}
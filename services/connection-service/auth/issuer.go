@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"errors"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"online-chat-go/config"
+	"os"
+	"strings"
+	"time"
+)
+
+type IssuedToken struct {
+	Token     string    `json:"token"`
+	SessionId string    `json:"session_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// TokenIssuer signs session tokens which are accepted by JwtAuthorizer configured with the same JwtConfig.
+// Private key should match either public key file or key of jwks file, tokens are issued with kid of the latter
+type TokenIssuer struct {
+	method   jwt.SigningMethod
+	key      any
+	kid      string
+	issuer   string
+	audience string
+	ttl      time.Duration
+}
+
+func NewTokenIssuer(config *config.JwtConfig) (*TokenIssuer, error) {
+	ti := &TokenIssuer{
+		issuer:   config.Issuer,
+		audience: config.Audience,
+		ttl:      config.TokenTtl,
+	}
+
+	if config.PrivateKeyFile != "" {
+		pem, err := os.ReadFile(config.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		var key *rsa.PrivateKey
+		if key, err = jwt.ParseRSAPrivateKeyFromPEM(pem); err != nil {
+			return nil, err
+		}
+		if ti.kid, err = verificationKid(config, &key.PublicKey); err != nil {
+			return nil, err
+		}
+		ti.method, ti.key = jwt.SigningMethodRS256, key
+	} else if config.Secret != "" {
+		ti.method, ti.key = jwt.SigningMethodHS256, []byte(config.Secret)
+	} else {
+		return nil, errors.New("No defined signing key for issuing tokens, should be either secret or private-key-file")
+	}
+
+	if ti.ttl <= 0 {
+		return nil, errors.New("Token ttl should be positive")
+	}
+
+	return ti, nil
+}
+
+// Issue signs token for principal, session id and expiry are assigned by issuer
+func (ti *TokenIssuer) Issue(principal *Principal) (*IssuedToken, error) {
+	sessionId, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(ti.ttl)
+	claims := jwt.MapClaims{
+		"sub":   principal.Id,
+		"name":  principal.DisplayName,
+		"roles": principal.Roles,
+		"jti":   sessionId.String(),
+		"iat":   now.Unix(),
+		"nbf":   now.Unix(),
+		"exp":   expiresAt.Unix(),
+	}
+	if len(principal.Scopes) > 0 {
+		claims["scope"] = strings.Join(principal.Scopes, " ")
+	}
+	if principal.TenantId != "" {
+		claims["tenant_id"] = principal.TenantId
+	}
+	if ti.issuer != "" {
+		claims["iss"] = ti.issuer
+	}
+	if ti.audience != "" {
+		claims["aud"] = ti.audience
+	}
+
+	token := jwt.NewWithClaims(ti.method, claims)
+	if ti.kid != "" {
+		token.Header["kid"] = ti.kid
+	}
+	signed, err := token.SignedString(ti.key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &IssuedToken{Token: signed, SessionId: sessionId.String(), ExpiresAt: time.Unix(expiresAt.Unix(), 0).UTC()}, nil
+}
+
+// verificationKid checks that tokens signed with private key could be verified. Public key file is used for tokens
+// without kid, so kid is only returned if matching key is found in jwks file
+func verificationKid(config *config.JwtConfig, publicKey *rsa.PublicKey) (string, error) {
+	if config.PublicKeyFile != "" {
+		pem, err := os.ReadFile(config.PublicKeyFile)
+		if err != nil {
+			return "", err
+		}
+		key, err := jwt.ParseRSAPublicKeyFromPEM(pem)
+		if err != nil {
+			return "", err
+		}
+		if publicKey.Equal(key) {
+			return "", nil
+		}
+	}
+
+	if config.JwksFile != "" {
+		keys, err := readJwks(config.JwksFile)
+		if err != nil {
+			return "", err
+		}
+		for kid, key := range keys {
+			if publicKey.Equal(key) {
+				return kid, nil
+			}
+		}
+	}
+
+	return "", errors.New("Private key file does not match public-key-file or any key of jwks-file, issued tokens could not be verified")
+}
@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"online-chat-go/config"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeRsaKeys(t *testing.T, dir string, name string) (*rsa.PrivateKey, string, string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	privatePath, publicPath := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+".pub.pem")
+	privatePem := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	publicPem := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public})
+	if err = os.WriteFile(privatePath, privatePem, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(publicPath, publicPem, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return key, privatePath, publicPath
+}
+
+func writeRsaJwks(t *testing.T, path string, kid string, key *rsa.PublicKey) {
+	t.Helper()
+	n := base64.RawURLEncoding.EncodeToString(key.N.Bytes())
+	e := base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+	data := fmt.Sprintf(`{"keys": [{"kid": %q, "kty": "RSA", "n": %q, "e": %q}]}`, kid, n, e)
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTokenIssuerRequiresMatchingVerificationKey(t *testing.T) {
+	dir := t.TempDir()
+	signing, privatePath, publicPath := writeRsaKeys(t, dir, "signing")
+	other, _, otherPublicPath := writeRsaKeys(t, dir, "other")
+	jwksPath, otherJwksPath := filepath.Join(dir, "jwks.json"), filepath.Join(dir, "other-jwks.json")
+	writeRsaJwks(t, jwksPath, "signing", &signing.PublicKey)
+	writeRsaJwks(t, otherJwksPath, "other", &other.PublicKey)
+
+	tests := []struct {
+		name     string
+		config   config.JwtConfig
+		accepted bool
+	}{
+		{name: "matching public key", config: config.JwtConfig{PublicKeyFile: publicPath}, accepted: true},
+		{name: "matching jwks key", config: config.JwtConfig{JwksFile: jwksPath}, accepted: true},
+		{name: "other public key, matching jwks key", config: config.JwtConfig{PublicKeyFile: otherPublicPath, JwksFile: jwksPath}, accepted: true},
+		{name: "other public key", config: config.JwtConfig{PublicKeyFile: otherPublicPath}},
+		{name: "other jwks key", config: config.JwtConfig{JwksFile: otherJwksPath}},
+		{name: "secret only", config: config.JwtConfig{Secret: "secret"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := test.config
+			cfg.PrivateKeyFile, cfg.TokenTtl = privatePath, time.Hour
+			issuer, err := NewTokenIssuer(&cfg)
+			if !test.accepted {
+				if err == nil {
+					t.Fatal("issuer is created with signing key which could not be verified")
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			token, err := issuer.Issue(&Principal{Id: "user"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			authorizer, err := NewJwtAuthorizer(&cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer authorizer.Close()
+			if _, err = authorizer.AuthorizeToken(token.Token); err != nil {
+				t.Errorf("issued token was rejected: %s", err)
+			}
+		})
+	}
+}
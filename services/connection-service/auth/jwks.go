@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	K   string `json:"k"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// JwksFile holds signing keys read from local JWKS file, keys are reloaded every time file changes
+type JwksFile struct {
+	path    string
+	keys    map[string]any
+	mut     *sync.RWMutex
+	watcher *fsnotify.Watcher
+}
+
+func NewJwksFile(path string) (*JwksFile, error) {
+	jf := &JwksFile{
+		path: filepath.Clean(path),
+		mut:  &sync.RWMutex{},
+	}
+	if err := jf.load(); err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	// watching directory instead of file itself, so atomic replacements via rename are not missed
+	if err = watcher.Add(filepath.Dir(jf.path)); err != nil {
+		_ = watcher.Close()
+		return nil, err
+	}
+	jf.watcher = watcher
+
+	go jf.watch()
+	return jf, nil
+}
+
+func (jf *JwksFile) Get(kid string) (any, bool) {
+	jf.mut.RLock()
+	defer jf.mut.RUnlock()
+	key, ok := jf.keys[kid]
+	return key, ok
+}
+
+func (jf *JwksFile) Close() error {
+	return jf.watcher.Close()
+}
+
+func (jf *JwksFile) watch() {
+	for {
+		select {
+		case event, ok := <-jf.watcher.Events:
+			if !ok {
+				return
+			}
+			// replacement via rename shows up as creation of file in watched directory
+			if filepath.Clean(event.Name) != jf.path || !(event.Has(fsnotify.Write) || event.Has(fsnotify.Create)) {
+				continue
+			}
+			if err := jf.load(); err != nil {
+				log.Println("Could not reload jwks file, keeping previous keys: ", err)
+			} else {
+				log.Println("reloaded jwks file: ", jf.path)
+			}
+
+		case err, ok := <-jf.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Println("Error watching jwks file: ", err)
+		}
+	}
+}
+
+func (jf *JwksFile) load() error {
+	keys, err := readJwks(jf.path)
+	if err != nil {
+		return err
+	}
+
+	jf.mut.Lock()
+	jf.keys = keys
+	jf.mut.Unlock()
+	return nil
+}
+
+// readJwks returns keys of JWKS file by their kid
+func readJwks(path string) (map[string]any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var set jsonWebKeySet
+	if err = json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]any, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Kid == "" {
+			return nil, errors.New("Jwks contains key without kid")
+		}
+
+		key, err := jwk.parse()
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %s: %w", jwk.Kid, err)
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+func (jwk *jsonWebKey) parse() (any, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+
+	case "oct":
+		return base64.RawURLEncoding.DecodeString(jwk.K)
+
+	default:
+		return nil, fmt.Errorf("unsupported key type: %s", jwk.Kty)
+	}
+}
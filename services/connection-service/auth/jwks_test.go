@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"online-chat-go/config"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeJwks(t *testing.T, path string, kid string, secret string) {
+	t.Helper()
+	data := fmt.Sprintf(`{"keys": [{"kid": %q, "kty": "oct", "k": %q}]}`, kid, base64.RawURLEncoding.EncodeToString([]byte(secret)))
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func signWithKid(t *testing.T, kid string, secret string) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "user", "exp": time.Now().Add(time.Hour).Unix()})
+	token.Header["kid"] = kid
+	signed, err := token.SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func awaitVerified(t *testing.T, authorizer *JwtAuthorizer, token string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := authorizer.AuthorizeToken(token)
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("token signed with rotated key was not accepted: %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestJwksFileReloadsRotatedKeys(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "jwks.json")
+	writeJwks(t, path, "first", "first-secret")
+
+	authorizer, err := NewJwtAuthorizer(&config.JwtConfig{JwksFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer authorizer.Close()
+
+	if _, err = authorizer.AuthorizeToken(signWithKid(t, "first", "first-secret")); err != nil {
+		t.Fatalf("token signed with initial key was rejected: %s", err)
+	}
+
+	t.Run("rewritten in place", func(t *testing.T) {
+		writeJwks(t, path, "second", "second-secret")
+		awaitVerified(t, authorizer, signWithKid(t, "second", "second-secret"))
+	})
+
+	t.Run("replaced via rename", func(t *testing.T) {
+		tmp := filepath.Join(dir, "jwks.json.tmp")
+		writeJwks(t, tmp, "third", "third-secret")
+		if err := os.Rename(tmp, path); err != nil {
+			t.Fatal(err)
+		}
+		awaitVerified(t, authorizer, signWithKid(t, "third", "third-secret"))
+		if _, err := authorizer.AuthorizeToken(signWithKid(t, "first", "first-secret")); err == nil {
+			t.Fatal("token signed with removed key was accepted")
+		}
+	})
+}
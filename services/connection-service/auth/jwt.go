@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"net/http"
+	"online-chat-go/config"
+	"os"
+	"strings"
+)
+
+type JwtAuthorizer struct {
+	secret    []byte
+	publicKey *rsa.PublicKey
+	jwks      *JwksFile
+	parser    *jwt.Parser
+}
+
+func NewJwtAuthorizer(config *config.JwtConfig) (*JwtAuthorizer, error) {
+	ja := &JwtAuthorizer{}
+
+	if config.Secret != "" {
+		ja.secret = []byte(config.Secret)
+	}
+
+	if config.PublicKeyFile != "" {
+		pem, err := os.ReadFile(config.PublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if ja.publicKey, err = jwt.ParseRSAPublicKeyFromPEM(pem); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.JwksFile != "" {
+		jwks, err := NewJwksFile(config.JwksFile)
+		if err != nil {
+			return nil, err
+		}
+		ja.jwks = jwks
+	}
+
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg(), jwt.SigningMethodRS256.Alg()}),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(config.Leeway),
+	}
+	if config.Issuer != "" {
+		options = append(options, jwt.WithIssuer(config.Issuer))
+	}
+	if config.Audience != "" {
+		options = append(options, jwt.WithAudience(config.Audience))
+	}
+	ja.parser = jwt.NewParser(options...)
+
+	return ja, nil
+}
+
+func (ja *JwtAuthorizer) Authorize(req *http.Request) (*Principal, error) {
+	rawToken, err := ExtractToken(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return ja.AuthorizeToken(rawToken)
+}
+
+func (ja *JwtAuthorizer) AuthorizeToken(rawToken string) (*Principal, error) {
+	claims := jwt.MapClaims{}
+	if _, err := ja.parser.ParseWithClaims(rawToken, claims, ja.keyFunc); err != nil {
+		return nil, fmt.Errorf("Invalid access token: %w", err)
+	}
+
+	return principalFromClaims(claims)
+}
+
+func (ja *JwtAuthorizer) Close() error {
+	if ja.jwks != nil {
+		return ja.jwks.Close()
+	}
+	return nil
+}
+
+// keyFunc picks verification key for token, key type mismatch with token alg is rejected by jwt library itself
+func (ja *JwtAuthorizer) keyFunc(token *jwt.Token) (any, error) {
+	if kid, ok := token.Header["kid"].(string); ok && ja.jwks != nil {
+		if key, ok := ja.jwks.Get(kid); ok {
+			return key, nil
+		}
+		return nil, fmt.Errorf("unknown key id: %s", kid)
+	}
+
+	switch token.Method.(type) {
+	case *jwt.SigningMethodHMAC:
+		if ja.secret != nil {
+			return ja.secret, nil
+		}
+	case *jwt.SigningMethodRSA:
+		if ja.publicKey != nil {
+			return ja.publicKey, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no key configured for signing method: %s", token.Method.Alg())
+}
+
+func principalFromClaims(claims jwt.MapClaims) (*Principal, error) {
+	subject, err := claims.GetSubject()
+	if err != nil || subject == "" {
+		return nil, errors.New("Invalid access token: missing subject")
+	}
+
+	principal := &Principal{
+		Id:          subject,
+		DisplayName: stringClaim(claims, "name"),
+		Roles:       stringsClaim(claims, "roles"),
+		TenantId:    stringClaim(claims, "tenant_id"),
+		SessionId:   stringClaim(claims, "jti"),
+		Claims:      claims,
+	}
+	if principal.DisplayName == "" {
+		principal.DisplayName = subject
+	}
+
+	// OAuth2 style space delimited "scope" takes precedence over "scp" array
+	if scope := stringClaim(claims, "scope"); scope != "" {
+		principal.Scopes = strings.Fields(scope)
+	} else {
+		principal.Scopes = stringsClaim(claims, "scp")
+	}
+
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		principal.ExpiresAt = exp.Time
+	}
+
+	return principal, nil
+}
+
+func stringClaim(claims jwt.MapClaims, name string) string {
+	value, _ := claims[name].(string)
+	return value
+}
+
+func stringsClaim(claims jwt.MapClaims, name string) []string {
+	switch value := claims[name].(type) {
+	case string:
+		return []string{value}
+	case []any:
+		result := make([]string, 0, len(value))
+		for _, v := range value {
+			if str, ok := v.(string); ok {
+				result = append(result, str)
+			}
+		}
+		return result
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"online-chat-go/db/repository"
+	"online-chat-go/util"
+)
+
+const maxCredentialsBodySize = 4096
+
+var ErrInvalidCredentials = errors.New("Invalid username or password")
+
+type credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type registeredUser struct {
+	Id       string `json:"id"`
+	Username string `json:"username"`
+	*IssuedToken
+}
+
+func NewLoginHandler(users repository.UserRepository, issuer *TokenIssuer, cookies *CookieAuthorizer) func(w http.ResponseWriter, r *http.Request) {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		creds, ok := readCredentials(writer, request)
+		if !ok {
+			return
+		}
+
+		user, err := users.GetByUserName(request.Context(), creds.Username)
+		if errors.Is(err, repository.ErrUserNotFound) {
+			_ = VerifyPassword(string(dummyPasswordHash), creds.Password)
+			util.WriteError(writer, http.StatusUnauthorized, ErrInvalidCredentials.Error())
+			return
+		} else if err != nil {
+			log.Println("Error fetching user: ", err)
+			util.WriteError(writer, http.StatusInternalServerError, "Could not log in")
+			return
+		}
+
+		if err = VerifyPassword(user.Password, creds.Password); errors.Is(err, ErrInvalidCredentials) {
+			util.WriteError(writer, http.StatusUnauthorized, err.Error())
+			return
+		} else if err != nil {
+			log.Println("Error verifying password: ", err)
+			util.WriteError(writer, http.StatusInternalServerError, "Could not log in")
+			return
+		}
+
+		token, err := issuer.Issue(principalFromUser(user))
+		if err != nil {
+			log.Println("Error issuing token: ", err)
+			util.WriteError(writer, http.StatusInternalServerError, "Could not log in")
+			return
+		}
+
+		log.Printf("user logged in with id: %s, session id: %s\n", user.Id, token.SessionId)
+		cookies.SetSessionCookie(writer, token)
+		util.WriteJson(writer, http.StatusOK, token)
+	}
+}
+
+func NewRegisterHandler(users repository.UserRepository, issuer *TokenIssuer, cookies *CookieAuthorizer) func(w http.ResponseWriter, r *http.Request) {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		creds, ok := readCredentials(writer, request)
+		if !ok {
+			return
+		}
+
+		if err := ValidateUserName(creds.Username); err != nil {
+			util.WriteError(writer, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := ValidatePassword(creds.Password); err != nil {
+			util.WriteError(writer, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		hash, err := HashPassword(creds.Password)
+		if err != nil {
+			log.Println("Error hashing password: ", err)
+			util.WriteError(writer, http.StatusInternalServerError, "Could not register user")
+			return
+		}
+
+		user, err := users.Create(request.Context(), creds.Username, hash)
+		if errors.Is(err, repository.ErrUserAlreadyExists) {
+			util.WriteError(writer, http.StatusConflict, "Username is already taken")
+			return
+		} else if err != nil {
+			log.Println("Error creating user: ", err)
+			util.WriteError(writer, http.StatusInternalServerError, "Could not register user")
+			return
+		}
+
+		token, err := issuer.Issue(principalFromUser(user))
+		if err != nil {
+			log.Println("Error issuing token: ", err)
+			util.WriteError(writer, http.StatusInternalServerError, "Could not register user")
+			return
+		}
+
+		log.Printf("registered user with id: %s\n", user.Id)
+		cookies.SetSessionCookie(writer, token)
+		util.WriteJson(writer, http.StatusCreated, registeredUser{Id: user.Id, Username: user.Username, IssuedToken: token})
+	}
+}
+
+func NewLogoutHandler(authorizer Authorizer, revoker *SessionRevoker, cookies *CookieAuthorizer) func(w http.ResponseWriter, r *http.Request) {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if !util.RequireMethod(writer, request, http.MethodPost) {
+			return
+		}
+
+		principal, err := authorizer.Authorize(request)
+		if err != nil {
+			util.WriteError(writer, http.StatusUnauthorized, err.Error())
+			return
+		}
+
+		if err = revoker.Revoke(request.Context(), principal); err != nil {
+			log.Println("Error revoking session: ", err)
+			util.WriteError(writer, http.StatusInternalServerError, "Could not log out")
+			return
+		}
+
+		log.Printf("user logged out with id: %s, session id: %s\n", principal.Id, principal.SessionId)
+		cookies.ClearSessionCookie(writer)
+		writer.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func readCredentials(writer http.ResponseWriter, request *http.Request) (*credentials, bool) {
+	if !util.RequireMethod(writer, request, http.MethodPost) {
+		return nil, false
+	}
+
+	var creds credentials
+	if err := util.ReadJson(writer, request, maxCredentialsBodySize, &creds); err != nil {
+		util.WriteError(writer, http.StatusBadRequest, "Malformed request body")
+		return nil, false
+	}
+	if creds.Username == "" || creds.Password == "" {
+		util.WriteError(writer, http.StatusBadRequest, "Username and password are required")
+		return nil, false
+	}
+
+	return &creds, true
+}
+
+func principalFromUser(user *repository.DbUser) *Principal {
+	return &Principal{Id: user.Id, DisplayName: user.DisplayName, Roles: user.Roles}
+}
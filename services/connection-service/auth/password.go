@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"errors"
+	"golang.org/x/crypto/bcrypt"
+	"regexp"
+	"unicode"
+)
+
+const (
+	passwordHashCost  = 12
+	minPasswordLength = 8
+	maxPasswordLength = 72 // bcrypt silently ignores everything past 72 bytes
+)
+
+var userNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{3,32}$`)
+
+// dummyPasswordHash is compared against when user is not found, so response time does not reveal whether user exists
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy-password"), passwordHashCost)
+
+type PolicyViolationError struct {
+	msg string
+}
+
+func (err *PolicyViolationError) Error() string {
+	return err.msg
+}
+
+func ValidateUserName(userName string) error {
+	if !userNamePattern.MatchString(userName) {
+		return &PolicyViolationError{"Username should be 3 to 32 characters long and contain only letters, digits, '_', '.' or '-'"}
+	}
+	return nil
+}
+
+func ValidatePassword(password string) error {
+	if len(password) < minPasswordLength {
+		return &PolicyViolationError{"Password should be at least 8 characters long"}
+	}
+	if len(password) > maxPasswordLength {
+		return &PolicyViolationError{"Password should be at most 72 bytes long"}
+	}
+
+	var hasLetter, hasDigit bool
+	for _, r := range password {
+		hasLetter = hasLetter || unicode.IsLetter(r)
+		hasDigit = hasDigit || unicode.IsDigit(r)
+	}
+	if !hasLetter || !hasDigit {
+		return &PolicyViolationError{"Password should contain both letters and digits"}
+	}
+
+	return nil
+}
+
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordHashCost)
+	return string(hash), err
+}
+
+func VerifyPassword(hash string, password string) error {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return ErrInvalidCredentials
+	}
+	return err
+}
@@ -1,5 +1,46 @@
 package auth
 
+import (
+	"time"
+)
+
+const (
+	RoleAdmin     = "admin"
+	RoleModerator = "moderator"
+)
+
 type Principal struct {
-	Id string
+	Id          string
+	DisplayName string
+	Roles       []string
+	Scopes      []string
+	TenantId    string
+	SessionId   string
+	ExpiresAt   time.Time // zero value means credential never expires
+	Claims      map[string]any
+}
+
+func (p *Principal) HasRole(role string) bool {
+	return contains(p.Roles, role)
+}
+
+func (p *Principal) HasScope(scope string) bool {
+	return contains(p.Scopes, scope)
+}
+
+func (p *Principal) IsModerator() bool {
+	return p.HasRole(RoleModerator) || p.HasRole(RoleAdmin)
+}
+
+func (p *Principal) Expired(now time.Time) bool {
+	return !p.ExpiresAt.IsZero() && !now.Before(p.ExpiresAt)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
 }
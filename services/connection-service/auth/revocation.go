@@ -0,0 +1,179 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"online-chat-go/db/repository"
+	"online-chat-go/notifications"
+	"online-chat-go/util"
+	"time"
+)
+
+const RevokedSessionsTopic = "/sessions/revoked"
+
+const (
+	// revoked sessions whose expiry is not known are cached for ttl, they are looked up in repository afterwards
+	revokedCacheTtl      = time.Hour
+	revokedPruneInterval = time.Minute
+)
+
+// RevokedSession ExpiresAt is expiry of credentials session was authorized with, if they expire
+type RevokedSession struct {
+	SessionId string     `json:"session_id"`
+	UserId    string     `json:"user_id"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// SessionRevoker persists revoked sessions and announces them over notification bus,
+// so every instance is able to kick connections opened with revoked credentials. Revoked sessions are cached
+// until their credentials expire, as they are rejected anyway afterwards
+type SessionRevoker struct {
+	sessions  repository.SessionRepository
+	bus       notifications.NotificationBus
+	revoked   *util.SafeMap[string, time.Time] // session id -> time until which it is cached
+	onRevoked func(session RevokedSession)
+}
+
+func NewSessionRevoker(sessions repository.SessionRepository, bus notifications.NotificationBus) *SessionRevoker {
+	return &SessionRevoker{
+		sessions: sessions,
+		bus:      bus,
+		revoked:  util.NewSafeMap[string, time.Time](),
+	}
+}
+
+func (sr *SessionRevoker) SetOnRevoked(callback func(session RevokedSession)) {
+	sr.onRevoked = callback
+}
+
+func (sr *SessionRevoker) Revoke(ctx context.Context, principal *Principal) error {
+	if principal.SessionId == "" {
+		return errors.New("Principal has no session id, it can not be revoked")
+	}
+
+	var expiresAt *time.Time
+	if !principal.ExpiresAt.IsZero() {
+		expiresAt = &principal.ExpiresAt
+	}
+	if err := sr.sessions.Revoke(ctx, principal.SessionId, principal.Id, expiresAt); err != nil {
+		return err
+	}
+	sr.cache(principal.SessionId, expiresAt)
+
+	msg, err := json.Marshal(RevokedSession{SessionId: principal.SessionId, UserId: principal.Id, ExpiresAt: expiresAt})
+	if err != nil {
+		return err
+	}
+	return sr.bus.Publish(ctx, RevokedSessionsTopic, msg)
+}
+
+func (sr *SessionRevoker) IsRevoked(ctx context.Context, sessionId string) (bool, error) {
+	if sessionId == "" {
+		return false, nil
+	}
+	if _, ok := sr.revoked.Get(sessionId); ok {
+		return true, nil
+	}
+
+	revoked, err := sr.sessions.IsRevoked(ctx, sessionId)
+	if revoked {
+		sr.cache(sessionId, nil)
+	}
+	return revoked, err
+}
+
+// HandleRevocation should be registered as notification bus handler for RevokedSessionsTopic
+func (sr *SessionRevoker) HandleRevocation(_ string, msg []byte) {
+	var session RevokedSession
+	if err := json.Unmarshal(msg, &session); err != nil {
+		log.Println("Malformed session revocation message: ", err)
+		return
+	}
+
+	sr.cache(session.SessionId, session.ExpiresAt)
+	if sr.onRevoked != nil {
+		sr.onRevoked(session)
+	}
+}
+
+// Start periodically forgets revoked sessions whose cache time is over until context is cancelled
+func (sr *SessionRevoker) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(revokedPruneInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case now := <-ticker.C:
+				sr.prune(now)
+			}
+		}
+	}()
+}
+
+func (sr *SessionRevoker) cache(sessionId string, expiresAt *time.Time) {
+	until := time.Now().Add(revokedCacheTtl)
+	if expiresAt != nil {
+		until = *expiresAt
+	}
+	sr.revoked.Set(sessionId, until)
+}
+
+func (sr *SessionRevoker) prune(now time.Time) {
+	var expired []string
+	sr.revoked.ForEach(func(sessionId string, until time.Time) {
+		if now.After(until) {
+			expired = append(expired, sessionId)
+		}
+	})
+	for _, sessionId := range expired {
+		sr.revoked.Delete(sessionId)
+	}
+}
+
+// RevocationAwareAuthorizer rejects principals whose session has been revoked
+type RevocationAwareAuthorizer struct {
+	authorizer Authorizer
+	revoker    *SessionRevoker
+}
+
+func NewRevocationAwareAuthorizer(authorizer Authorizer, revoker *SessionRevoker) *RevocationAwareAuthorizer {
+	return &RevocationAwareAuthorizer{authorizer: authorizer, revoker: revoker}
+}
+
+func (ra *RevocationAwareAuthorizer) Authorize(req *http.Request) (*Principal, error) {
+	principal, err := ra.authorizer.Authorize(req)
+	if err != nil {
+		return nil, err
+	}
+	return ra.checkRevoked(req.Context(), principal)
+}
+
+func (ra *RevocationAwareAuthorizer) AuthorizeToken(token string) (*Principal, error) {
+	tokenAuthorizer, ok := ra.authorizer.(TokenAuthorizer)
+	if !ok {
+		return nil, errors.New("Authorizer does not support token authorization")
+	}
+
+	principal, err := tokenAuthorizer.AuthorizeToken(token)
+	if err != nil {
+		return nil, err
+	}
+	return ra.checkRevoked(context.Background(), principal)
+}
+
+func (ra *RevocationAwareAuthorizer) checkRevoked(ctx context.Context, principal *Principal) (*Principal, error) {
+	revoked, err := ra.revoker.IsRevoked(ctx, principal.SessionId)
+	if err != nil {
+		return nil, err
+	} else if revoked {
+		return nil, ErrSessionRevoked
+	}
+	return principal, nil
+}
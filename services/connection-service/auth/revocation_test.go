@@ -0,0 +1,27 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionRevokerPrunesExpiredSessions(t *testing.T) {
+	revoker := NewSessionRevoker(nil, nil)
+	now := time.Now()
+	expired, valid := now.Add(-time.Minute), now.Add(time.Minute)
+	revoker.cache("expired", &expired)
+	revoker.cache("valid", &valid)
+	revoker.cache("unknown-expiry", nil)
+
+	revoker.prune(now)
+	for sessionId, cached := range map[string]bool{"expired": false, "valid": true, "unknown-expiry": true} {
+		if _, ok := revoker.revoked.Get(sessionId); ok != cached {
+			t.Errorf("session %s is cached: %t, expected %t", sessionId, ok, cached)
+		}
+	}
+
+	revoker.prune(now.Add(revokedCacheTtl + time.Second))
+	if left := revoker.revoked.Len(); left != 0 {
+		t.Errorf("%d sessions are cached after their cache time, expected none", left)
+	}
+}
@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// TokenSubprotocol is the marker browsers put into Sec-WebSocket-Protocol, followed by the token itself,
+// since they are unable to set custom headers on websocket handshake
+const TokenSubprotocol = "access_token"
+
+const accessTokenQueryParam = "access_token"
+
+// ExtractToken looks for bearer token in Authorization header, access_token query parameter
+// and Sec-WebSocket-Protocol header, in that order
+func ExtractToken(req *http.Request) (string, error) {
+	// other authorization schemes are left for other authorizers
+	if scheme, token, _ := strings.Cut(req.Header.Get("Authorization"), " "); strings.EqualFold(scheme, "Bearer") {
+		if token = strings.TrimSpace(token); token == "" {
+			return "", errors.New("Malformed Authorization header, expected bearer token")
+		}
+		return token, nil
+	}
+
+	if token := req.URL.Query().Get(accessTokenQueryParam); token != "" {
+		return token, nil
+	}
+
+	protocols := subprotocols(req)
+	for i := 0; i < len(protocols)-1; i++ {
+		if protocols[i] == TokenSubprotocol {
+			return protocols[i+1], nil
+		}
+	}
+
+	return "", ErrNoCredentials
+}
+
+func subprotocols(req *http.Request) []string {
+	var protocols []string
+	for _, header := range req.Header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(header, ",") {
+			if protocol = strings.TrimSpace(protocol); protocol != "" {
+				protocols = append(protocols, protocol)
+			}
+		}
+	}
+	return protocols
+}
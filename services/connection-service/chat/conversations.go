@@ -0,0 +1,456 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	"log"
+	"online-chat-go/auth"
+	"online-chat-go/config"
+	"online-chat-go/db/repository"
+	"online-chat-go/notifications"
+	"online-chat-go/websocket"
+	"time"
+)
+
+const (
+	maxGroupTitleLength   = 128
+	maxMessageAttachments = 10
+	// retry of message which is still being inserted waits for insert to finish at most commitWait
+	commitWait         = 2 * time.Second
+	commitPollInterval = 50 * time.Millisecond
+)
+
+var (
+	ErrNotMember        = errors.New("User is not a member of conversation")
+	ErrNotOwner         = errors.New("Only conversation owner is allowed to do this")
+	ErrNotGroup         = errors.New("Members could only be changed in group conversations")
+	ErrInvalidId        = errors.New("Malformed id")
+	ErrInvalidTitle     = errors.New("Group title should be non empty and at most 128 characters long")
+	ErrSelfConversation = errors.New("Direct conversation with yourself is not allowed")
+	ErrAttachments      = errors.New("Message could have at most 10 distinct attachments")
+	ErrSendInProgress   = errors.New("Message with the same id is still being sent, retry later")
+)
+
+type Conversation struct {
+	Id        string    `json:"id"`
+	Kind      string    `json:"kind"`
+	Title     *string   `json:"title,omitempty"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	Muted     bool      `json:"muted"`
+	Archived  bool      `json:"archived"`
+}
+
+const TypeConversationSettings = "conversation_settings"
+
+// ConversationSettings are personal settings of conversation member, synchronized between all devices of member
+type ConversationSettings struct {
+	Muted    bool `json:"muted"`
+	Archived bool `json:"archived"`
+}
+
+// SettingsUpdate changes only settings which are set
+type SettingsUpdate struct {
+	Muted    *bool `json:"muted,omitempty"`
+	Archived *bool `json:"archived,omitempty"`
+}
+
+const TypeMessage = "message"
+
+// MessagePayload is the payload of message envelope delivered to conversation members
+type MessagePayload struct {
+	Seq         int64           `json:"seq"`
+	SenderId    string          `json:"sender_id"`
+	ClientId    string          `json:"client_id,omitempty"`
+	SentAt      time.Time       `json:"sent_at"`
+	EditedAt    *time.Time      `json:"edited_at,omitempty"`
+	DeletedAt   *time.Time      `json:"deleted_at,omitempty"`
+	ParentId    *string         `json:"parent_id,omitempty"`
+	Content     json.RawMessage `json:"content"`
+	Attachments []string        `json:"attachments,omitempty"`
+}
+
+type ConversationService struct {
+	conversations repository.ConversationRepository
+	messages      repository.MessageRepository
+	reactions     repository.ReactionRepository
+	threads       repository.ThreadRepository
+	dedup         *Deduplicator
+	bus           notifications.NotificationBus
+	editWindow    time.Duration
+	maxReactions  int
+	maxMembers    int
+}
+
+func NewConversationService(
+	conversations repository.ConversationRepository,
+	messages repository.MessageRepository,
+	reactions repository.ReactionRepository,
+	threads repository.ThreadRepository,
+	dedup *Deduplicator,
+	bus notifications.NotificationBus,
+	cfg *config.ChatConfig,
+) *ConversationService {
+	return &ConversationService{
+		conversations: conversations,
+		messages:      messages,
+		reactions:     reactions,
+		threads:       threads,
+		dedup:         dedup,
+		bus:           bus,
+		editWindow:    cfg.EditWindow,
+		maxReactions:  cfg.MaxReactions,
+		maxMembers:    cfg.MaxGroupMembers,
+	}
+}
+
+func (cs *ConversationService) CreateDirect(ctx context.Context, principal *auth.Principal, peerId string) (*Conversation, error) {
+	if !validId(principal.Id) || !validId(peerId) {
+		return nil, ErrInvalidId
+	} else if peerId == principal.Id {
+		return nil, ErrSelfConversation
+	}
+
+	conversation, err := cs.conversations.CreateDirect(ctx, principal.Id, peerId)
+	if err != nil {
+		return nil, err
+	}
+	return toConversation(conversation), nil
+}
+
+func (cs *ConversationService) CreateGroup(ctx context.Context, principal *auth.Principal, title string, memberIds []string) (*Conversation, error) {
+	if title == "" || len([]rune(title)) > maxGroupTitleLength {
+		return nil, ErrInvalidTitle
+	}
+	if !validId(principal.Id) {
+		return nil, ErrInvalidId
+	}
+	distinct := map[string]bool{principal.Id: true}
+	for _, id := range memberIds {
+		if !validId(id) {
+			return nil, ErrInvalidId
+		}
+		distinct[id] = true
+	}
+	if len(distinct) > cs.maxMembers {
+		return nil, repository.ErrMembersLimit
+	}
+
+	conversation, err := cs.conversations.CreateGroup(ctx, principal.Id, title, memberIds)
+	if err != nil {
+		return nil, err
+	}
+	return toConversation(conversation), nil
+}
+
+func (cs *ConversationService) List(ctx context.Context, principal *auth.Principal) ([]Conversation, error) {
+	if !validId(principal.Id) {
+		return nil, ErrInvalidId
+	}
+	conversations, err := cs.conversations.ListByMember(ctx, principal.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]Conversation, 0, len(conversations))
+	for i := range conversations {
+		result = append(result, *toMemberConversation(&conversations[i]))
+	}
+	return result, nil
+}
+
+// AddMember adds user to group conversation, only owners are allowed to invite new members
+func (cs *ConversationService) AddMember(ctx context.Context, principal *auth.Principal, conversationId string, userId string) error {
+	if !validId(principal.Id) || !validId(conversationId) || !validId(userId) {
+		return ErrInvalidId
+	}
+
+	conversation, err := cs.conversations.GetById(ctx, conversationId)
+	if err != nil {
+		return err
+	} else if conversation.Kind != repository.ConversationGroup {
+		return ErrNotGroup
+	}
+
+	members, err := cs.conversations.GetMembers(ctx, conversationId)
+	if err != nil {
+		return err
+	}
+
+	role, ok := memberRole(members, principal.Id)
+	if !ok {
+		return ErrNotMember
+	} else if role != repository.MemberRoleOwner {
+		return ErrNotOwner
+	}
+
+	return cs.conversations.AddMember(ctx, conversationId, userId, cs.maxMembers)
+}
+
+// Leave removes member from group conversation, if the last owner leaves the longest standing member becomes owner
+func (cs *ConversationService) Leave(ctx context.Context, principal *auth.Principal, conversationId string) error {
+	if err := cs.CheckMember(ctx, principal.Id, conversationId); err != nil {
+		return err
+	}
+
+	conversation, err := cs.conversations.GetById(ctx, conversationId)
+	if err != nil {
+		return err
+	} else if conversation.Kind != repository.ConversationGroup {
+		return ErrNotGroup
+	}
+
+	return cs.conversations.RemoveMember(ctx, conversationId, principal.Id)
+}
+
+// UpdateSettings changes personal settings of member and notifies other devices of member about the change
+func (cs *ConversationService) UpdateSettings(ctx context.Context, principal *auth.Principal, conversationId string, update SettingsUpdate) (*ConversationSettings, error) {
+	if err := cs.CheckMember(ctx, principal.Id, conversationId); err != nil {
+		return nil, err
+	}
+
+	updated, err := cs.conversations.UpdateSettings(ctx, conversationId, principal.Id, update.Muted, update.Archived)
+	if err != nil {
+		return nil, err
+	}
+
+	settings := &ConversationSettings{Muted: updated.Muted, Archived: updated.Archived}
+	env, err := newEvent(ctx, TypeConversationSettings, conversationId, "", settings)
+	if err == nil {
+		err = cs.publishToUser(ctx, principal.Id, env)
+	}
+	if err != nil {
+		log.Printf("Error publishing conversation settings to user: %s, err: %s\n", principal.Id, err)
+	}
+	return settings, nil
+}
+
+func (cs *ConversationService) CheckMember(ctx context.Context, userId string, conversationId string) error {
+	if !validId(userId) || !validId(conversationId) {
+		return ErrInvalidId
+	}
+
+	member, err := cs.conversations.IsMember(ctx, conversationId, userId)
+	if err != nil {
+		return err
+	} else if !member {
+		return ErrNotMember
+	}
+	return nil
+}
+
+// Send stores message and delivers it to every member of conversation, including sender's other connections,
+// replies are only delivered to subscribers of thread. Message is accepted at most once per client id within
+// deduplication window, retries get the original server id. Once message is stored it is considered accepted,
+// members who missed live delivery will get it from history. Attachments should be uploaded to conversation beforehand
+func (cs *ConversationService) Send(ctx context.Context, principal *auth.Principal, conversationId string, parentId *string, clientId string, content json.RawMessage, attachmentIds []string) (*SentMessage, error) {
+	if !validAttachments(attachmentIds) {
+		return nil, ErrAttachments
+	}
+	if err := cs.CheckMember(ctx, principal.Id, conversationId); err != nil {
+		return nil, err
+	}
+	var root *repository.DbMessage
+	if parentId != nil {
+		var err error
+		if root, err = cs.threadRoot(ctx, conversationId, *parentId); err != nil {
+			return nil, err
+		} else if root.DeletedAt != nil {
+			return nil, ErrMessageDeleted
+		}
+	}
+
+	sent, err := cs.dedup.Reserve(ctx, principal.Id, clientId)
+	if err != nil {
+		return nil, err
+	} else if sent.Duplicate {
+		return sent, cs.awaitCommitted(ctx, sent.MessageId)
+	}
+
+	msg := &repository.DbMessage{
+		Id:             sent.MessageId,
+		ConversationId: conversationId,
+		SenderId:       principal.Id,
+		ClientId:       &clientId,
+		Content:        content,
+		SentAt:         sent.SentAt,
+		ParentId:       parentId,
+		AttachmentIds:  attachmentIds,
+	}
+	if parentId != nil {
+		err = cs.sendReply(ctx, root, msg)
+	} else {
+		err = cs.messages.Insert(ctx, msg)
+	}
+	if err != nil {
+		cs.dedup.Release(context.Background(), principal.Id, clientId, sent.MessageId)
+		return nil, err
+	} else if parentId != nil {
+		return sent, nil
+	}
+
+	env, err := messageEnvelope(msg)
+	if err == nil {
+		env.Origin = websocket.Origin(ctx)
+		err = cs.FanOutEnvelope(ctx, conversationId, env)
+	}
+	if err != nil {
+		log.Printf("Error delivering message with id: %s, err: %s\n", sent.MessageId, err)
+	}
+
+	return sent, nil
+}
+
+// awaitCommitted waits for the first attempt of duplicate message to be stored, so retry is only acknowledged
+// once message is there. If first attempt is still running or fails, ErrSendInProgress tells client to retry,
+// its reservation is released on failure, so the next retry stores message anew
+func (cs *ConversationService) awaitCommitted(ctx context.Context, messageId string) error {
+	ctx, cancel := context.WithTimeout(ctx, commitWait)
+	defer cancel()
+	ticker := time.NewTicker(commitPollInterval)
+	defer ticker.Stop()
+
+	for {
+		exists, err := cs.messages.Exists(ctx, messageId)
+		if err != nil && ctx.Err() == nil {
+			return err
+		} else if exists {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ErrSendInProgress
+		case <-ticker.C:
+		}
+	}
+}
+
+func (cs *ConversationService) FanOutEnvelope(ctx context.Context, conversationId string, env *websocket.Envelope) error {
+	msg, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	return cs.FanOut(ctx, conversationId, msg)
+}
+
+// FanOut publishes message to personal topic of every conversation member
+func (cs *ConversationService) FanOut(ctx context.Context, conversationId string, msg []byte) error {
+	memberIds, err := cs.conversations.GetMemberIds(ctx, conversationId)
+	if err != nil {
+		return err
+	}
+	return cs.publishToUsers(ctx, memberIds, msg)
+}
+
+// publishToUsers publishes message to personal topics of users, returning the last error if any of them failed
+func (cs *ConversationService) publishToUsers(ctx context.Context, userIds []string, msg []byte) error {
+	var publishErr error
+	for _, userId := range userIds {
+		if err := cs.bus.Publish(ctx, notifications.UserTopic(userId), msg); err != nil {
+			log.Printf("Error publishing message to user: %s, err: %s\n", userId, err)
+			publishErr = err
+		}
+	}
+	return publishErr
+}
+
+// newEvent builds envelope of event caused by request, it is not delivered back to connection request came from
+func newEvent(ctx context.Context, msgType string, conversationId string, messageId string, payload any) (*websocket.Envelope, error) {
+	env, err := websocket.NewEnvelope(msgType, payload)
+	if err != nil {
+		return nil, err
+	}
+	env.Id = messageId
+	env.ConversationId = conversationId
+	env.Origin = websocket.Origin(ctx)
+	return env, nil
+}
+
+// publishToUser sends envelope to all devices of user
+func (cs *ConversationService) publishToUser(ctx context.Context, userId string, env *websocket.Envelope) error {
+	msg, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	return cs.bus.Publish(ctx, notifications.UserTopic(userId), msg)
+}
+
+func messageEnvelope(msg *repository.DbMessage) (*websocket.Envelope, error) {
+	payload := MessagePayload{
+		Seq:         msg.Seq,
+		SenderId:    msg.SenderId,
+		SentAt:      msg.SentAt.UTC(),
+		EditedAt:    msg.EditedAt,
+		DeletedAt:   msg.DeletedAt,
+		ParentId:    msg.ParentId,
+		Content:     msg.Content,
+		Attachments: msg.AttachmentIds,
+	}
+	if msg.ClientId != nil {
+		payload.ClientId = *msg.ClientId
+	}
+
+	env, err := websocket.NewEnvelope(TypeMessage, payload)
+	if err != nil {
+		return nil, err
+	}
+	env.Id = msg.Id
+	env.ConversationId = msg.ConversationId
+	return env, nil
+}
+
+func toConversation(conversation *repository.DbConversation) *Conversation {
+	return &Conversation{
+		Id:        conversation.Id,
+		Kind:      conversation.Kind,
+		Title:     conversation.Title,
+		CreatedBy: conversation.CreatedBy,
+		CreatedAt: conversation.CreatedAt,
+	}
+}
+
+func toMemberConversation(conversation *repository.DbMemberConversation) *Conversation {
+	return &Conversation{
+		Id:        conversation.Id,
+		Kind:      conversation.Kind,
+		Title:     conversation.Title,
+		CreatedBy: conversation.CreatedBy,
+		CreatedAt: conversation.CreatedAt,
+		Muted:     conversation.Muted,
+		Archived:  conversation.Archived,
+	}
+}
+
+func memberRole(members []repository.DbConversationMember, userId string) (string, bool) {
+	for _, member := range members {
+		if member.UserId == userId {
+			return member.Role, true
+		}
+	}
+	return "", false
+}
+
+func validAttachments(ids []string) bool {
+	if len(ids) > maxMessageAttachments {
+		return false
+	}
+	for i, id := range ids {
+		if !validId(id) {
+			return false
+		}
+		for _, other := range ids[:i] {
+			if other == id {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func validId(id string) bool {
+	_, err := uuid.Parse(id)
+	return err == nil
+}
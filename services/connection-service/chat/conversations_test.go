@@ -0,0 +1,34 @@
+package chat
+
+import (
+	"github.com/google/uuid"
+	"testing"
+)
+
+func TestValidAttachments(t *testing.T) {
+	ids := make([]string, maxMessageAttachments+1)
+	for i := range ids {
+		ids[i] = uuid.NewString()
+	}
+
+	tests := []struct {
+		name  string
+		ids   []string
+		valid bool
+	}{
+		{name: "no attachments", valid: true},
+		{name: "distinct ids", ids: ids[:2], valid: true},
+		{name: "max attachments", ids: ids[:maxMessageAttachments], valid: true},
+		{name: "too many attachments", ids: ids},
+		{name: "duplicate id", ids: []string{ids[0], ids[1], ids[0]}},
+		{name: "malformed id", ids: []string{ids[0], "attachment"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if valid := validAttachments(test.ids); valid != test.valid {
+				t.Errorf("attachments are valid: %t, expected %t", valid, test.valid)
+			}
+		})
+	}
+}
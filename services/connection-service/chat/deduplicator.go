@@ -0,0 +1,73 @@
+package chat
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"log"
+	"online-chat-go/db/repository"
+	"time"
+)
+
+type SentMessage struct {
+	MessageId string
+	SentAt    time.Time
+	Duplicate bool
+}
+
+// Deduplicator assigns server ids to client messages, so retries with the same client id within window
+// are recognized as duplicates no matter which instance they arrive at
+type Deduplicator struct {
+	sent   repository.DeduplicationRepository
+	window time.Duration
+}
+
+func NewDeduplicator(sent repository.DeduplicationRepository, window time.Duration) *Deduplicator {
+	return &Deduplicator{sent: sent, window: window}
+}
+
+func (d *Deduplicator) Reserve(ctx context.Context, userId string, clientId string) (*SentMessage, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	candidate := repository.DbSentMessage{MessageId: id.String(), SentAt: now}
+	reserved, err := d.sent.Reserve(ctx, userId, clientId, candidate, now.Add(-d.window))
+	if err != nil {
+		return nil, err
+	}
+
+	return &SentMessage{
+		MessageId: reserved.MessageId,
+		SentAt:    reserved.SentAt.UTC(),
+		Duplicate: reserved.MessageId != candidate.MessageId,
+	}, nil
+}
+
+// Release forgets reservation of message which could not be delivered, so client retry is not treated as duplicate
+func (d *Deduplicator) Release(ctx context.Context, userId string, clientId string, messageId string) {
+	if err := d.sent.Release(ctx, userId, clientId, messageId); err != nil {
+		log.Printf("Error releasing message reservation, user id: %s, client id: %s, err: %s\n", userId, clientId, err)
+	}
+}
+
+// Start periodically purges reservations which are out of deduplication window until context is cancelled
+func (d *Deduplicator) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(d.window)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case <-ticker.C:
+				if _, err := d.sent.PurgeOlderThan(ctx, time.Now().Add(-d.window)); err != nil {
+					log.Println("Error purging message reservations: ", err)
+				}
+			}
+		}
+	}()
+}
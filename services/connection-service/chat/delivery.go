@@ -0,0 +1,500 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"online-chat-go/auth"
+	"online-chat-go/db/repository"
+	"online-chat-go/util"
+	"online-chat-go/websocket"
+	"sync"
+)
+
+const (
+	TypeSynced = "synced"
+
+	LastSeenParam  = "last_seen"
+	DeviceIdParam  = "device_id"
+	maxDeviceIdLen = 64
+	replayPageSize = 100
+	// maxTrackedSeqs limits seqs of live messages connection keeps until they are verified to have no gap,
+	// messages written once it is reached are not tracked, so cursor stays before them and they are replayed
+	maxTrackedSeqs = 1000
+)
+
+// SyncedPayload is sent once replay of missed messages is over and connection switched to live delivery,
+// Truncated tells that client should catch up the rest using history
+type SyncedPayload struct {
+	Replayed  int   `json:"replayed"`
+	LastSeq   int64 `json:"last_seq"`
+	Truncated bool  `json:"truncated,omitempty"`
+}
+
+// deliveryState holds live messages of connection until replay is over, so live delivery starts
+// exactly where replay ends, and tracks delivery cursor of connection
+type deliveryState struct {
+	mut      sync.Mutex
+	live     bool
+	buffered []pendingMessage
+	replayed map[string]bool
+	// overflowed is set once buffer limit is exceeded, connection is closed then and nothing is buffered anymore
+	overflowed bool
+	// cursor is seq up to which every message of user has been written to connection, written holds seqs of
+	// messages written above it. Live messages arrive out of seq order and some of them may never arrive, so cursor
+	// only moves across them once repository confirms there is no gap. Nothing is tracked until cursor is known
+	tracking  bool
+	cursor    int64
+	written   map[int64]bool
+	verifying bool
+}
+
+// pendingMessage onWritten is called once chat message it carries is written to connection, after is seq of
+// replayed message which precedes it, zero for live messages
+type pendingMessage struct {
+	msg       websocket.WsMessage
+	delivered *DeliveredMessage
+	after     int64
+	onWritten func()
+}
+
+func newDeliveryState() *deliveryState {
+	return &deliveryState{replayed: make(map[string]bool), written: make(map[int64]bool)}
+}
+
+// startTracking sets cursor tracking starts from, it should be called before any chat message is written
+func (s *deliveryState) startTracking(cursor int64) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.tracking = true
+	s.cursor = cursor
+}
+
+// markWritten should be called with mutex held, it tells whether written seqs should be verified. Replayed
+// messages follow each other, so cursor moves right away when previous one is written
+func (s *deliveryState) markWritten(seq int64, after int64) bool {
+	if !s.tracking || seq <= s.cursor {
+		return false
+	}
+	if after != 0 && after == s.cursor {
+		s.cursor = seq
+		return false
+	}
+	if len(s.written) >= maxTrackedSeqs {
+		return false
+	}
+
+	s.written[seq] = true
+	if len(s.written) < maxTrackedSeqs || s.verifying {
+		return false
+	}
+	s.verifying = true
+	return true
+}
+
+// Delivery writes messages published to user topics into user's connections and on connect replays
+// messages missed since client's last seen message or since device's delivery cursor
+type Delivery struct {
+	wss         *websocket.WSServer
+	messages    repository.MessageRepository
+	cursors     repository.DeliveryCursorRepository
+	maxReplay   int
+	maxBuffered int
+	states      *util.SafeMap[string, *deliveryState]
+
+	onDelivered  func(userId string, msg *DeliveredMessage)
+	coalesceKeys map[string]func(env *websocket.Envelope) string
+}
+
+func NewDelivery(
+	wss *websocket.WSServer,
+	messages repository.MessageRepository,
+	cursors repository.DeliveryCursorRepository,
+	maxReplay int,
+	maxBuffered int,
+) *Delivery {
+	return &Delivery{
+		wss:          wss,
+		messages:     messages,
+		cursors:      cursors,
+		maxReplay:    maxReplay,
+		maxBuffered:  maxBuffered,
+		states:       util.NewSafeMap[string, *deliveryState](),
+		coalesceKeys: make(map[string]func(env *websocket.Envelope) string),
+	}
+}
+
+// SetOnDelivered sets callback called once chat message is written to socket of at least one connection of user,
+// it may be called more than once for the same message
+func (d *Delivery) SetOnDelivered(callback func(userId string, msg *DeliveredMessage)) {
+	d.onDelivered = callback
+}
+
+// SetCoalesceKey marks envelopes of given type as the ones which supersede each other when they have the same key,
+// so connections which fall behind could skip stale ones. It should be called before delivery starts
+func (d *Delivery) SetCoalesceKey(msgType string, key func(env *websocket.Envelope) string) {
+	d.coalesceKeys[msgType] = key
+}
+
+// Deliver writes message to every connection of user except the one it originates from, encoded with codec
+// negotiated by connection. Connections which are still replaying get it once replay is over. Messages are queued
+// to connections in order Deliver is called, so it should be called in order messages arrive rather than concurrently
+func (d *Delivery) Deliver(userId string, msg websocket.WsMessage) error {
+	frame, err := websocket.NewFrame(msg)
+	if err != nil {
+		log.Printf("Error decoding frame published to user: %s, err: %s\n", userId, err)
+		return err
+	}
+	origin, delivered := frame.Origin, inspectFrame(frame.Envelope)
+	var key string
+	if coalesceKey, ok := d.coalesceKeys[frame.Envelope.Type]; ok {
+		key = coalesceKey(frame.Envelope)
+	}
+
+	var once sync.Once
+	return d.wss.ForEachUserConnection(userId, func(conn websocket.WSConnection) {
+		if origin != "" && conn.Id() == origin {
+			// client has message it sent, it only counts as written
+			if state, ok := d.states.Get(conn.Id()); ok && delivered != nil {
+				d.markWritten(userId, state, delivered.Seq, 0)
+			}
+			return
+		}
+		encoded, err := frame.EncodeFor(conn.Codec())
+		if err != nil {
+			log.Printf("Error encoding frame for connection: %s, err: %s\n", conn.Id(), err)
+			return
+		}
+		encoded.Key = key
+		pending := pendingMessage{msg: encoded, delivered: delivered}
+		if delivered != nil {
+			pending.onWritten = func() { once.Do(func() { d.notifyDelivered(userId, delivered) }) }
+		}
+		d.deliverTo(userId, conn, pending)
+	})
+}
+
+// deliverTo queues message to connection, or buffers it until replay is over
+func (d *Delivery) deliverTo(userId string, conn websocket.WSConnection, pending pendingMessage) {
+	if closed(conn) {
+		return
+	}
+	state, created := d.states.ComputeIfAbsent(conn.Id(), newDeliveryState)
+	if created && closed(conn) {
+		d.states.Delete(conn.Id())
+		return
+	}
+
+	state.mut.Lock()
+	if !state.live {
+		if state.overflowed || len(state.buffered) < d.maxBuffered {
+			if !state.overflowed {
+				state.buffered = append(state.buffered, pending)
+			}
+			state.mut.Unlock()
+			return
+		}
+
+		// replay waits for client, so client which fell behind that far is better off catching up on reconnect
+		state.overflowed, state.buffered = true, nil
+		state.mut.Unlock()
+		go func() { _ = conn.CloseWithReason(websocket.CloseSlowConsumer, "slow consumer") }()
+		return
+	}
+	state.mut.Unlock()
+
+	_ = conn.Write(d.track(userId, state, pending))
+}
+
+// markWritten counts chat message for cursor of connection, verifying written seqs once there are enough of them
+func (d *Delivery) markWritten(userId string, state *deliveryState, seq int64, after int64) {
+	state.mut.Lock()
+	verify := state.markWritten(seq, after)
+	state.mut.Unlock()
+	if verify {
+		go d.verify(context.Background(), userId, state)
+	}
+}
+
+// track makes chat message count for cursor of connection once it is written to socket rather than queued,
+// so messages which were still queued when connection dropped are replayed on reconnect
+func (d *Delivery) track(userId string, state *deliveryState, pending pendingMessage) websocket.WsMessage {
+	msg := pending.msg
+	if pending.delivered == nil {
+		return msg
+	}
+
+	seq, after, onWritten := pending.delivered.Seq, pending.after, pending.onWritten
+	msg.Written = func() {
+		d.markWritten(userId, state, seq, after)
+		if onWritten != nil {
+			onWritten()
+		}
+	}
+	return msg
+}
+
+// verify moves cursor across written seqs as long as repository has no message of user in between them.
+// Repository waits for messages being inserted, so message with lower seq could not be committed afterwards
+func (d *Delivery) verify(ctx context.Context, userId string, state *deliveryState) {
+	state.mut.Lock()
+	verified, pending := state.cursor, len(state.written) > 0
+	state.mut.Unlock()
+
+	for pending {
+		seqs, err := d.messages.ListSeqsForMemberAfter(ctx, userId, verified, replayPageSize)
+		if err != nil {
+			log.Printf("Error verifying delivery cursor of user: %s, err: %s\n", userId, err)
+			break
+		}
+
+		state.mut.Lock()
+		i := 0
+		for ; i < len(seqs) && state.written[seqs[i]]; i++ {
+			verified = seqs[i]
+		}
+		state.mut.Unlock()
+		if i < len(seqs) || len(seqs) < replayPageSize {
+			break
+		}
+	}
+
+	state.mut.Lock()
+	defer state.mut.Unlock()
+	if verified > state.cursor {
+		state.cursor = verified
+	}
+	for seq := range state.written {
+		if seq <= state.cursor {
+			delete(state.written, seq)
+		}
+	}
+	state.verifying = false
+}
+
+func (d *Delivery) notifyDelivered(userId string, msg *DeliveredMessage) {
+	if d.onDelivered != nil && msg.SenderId != userId {
+		go d.onDelivered(userId, msg)
+	}
+}
+
+// Start replays missed messages and switches connection to live delivery, it should run before connection
+// starts serving client frames. Cursor of device is saved once connection is closed, connections which did not
+// identify their device are only replayed from last seen message they send on handshake
+func (d *Delivery) Start(principal *auth.Principal, conn websocket.WSConnection) {
+	state, _ := d.states.ComputeIfAbsent(conn.Id(), newDeliveryState)
+	device := deviceId(conn)
+	go func() {
+		<-conn.Done()
+		d.states.Delete(conn.Id())
+		d.saveCursor(principal.Id, device, state)
+	}()
+
+	ctx := context.Background()
+	fromSeq, err := d.resolveCursor(ctx, principal.Id, device, conn)
+	if err != nil {
+		log.Printf("Unable to resolve delivery cursor of user: %s, err: %s\n", principal.Id, err)
+		d.goLive(principal.Id, conn, state)
+		return
+	} else if fromSeq == 0 {
+		// nothing has been delivered to device yet, client is expected to load history
+		d.trackLatest(ctx, principal.Id, device, state)
+		d.goLive(principal.Id, conn, state)
+		return
+	}
+
+	if device != "" {
+		state.startTracking(fromSeq)
+	}
+	synced := d.replay(ctx, principal.Id, fromSeq, conn, state)
+	d.goLive(principal.Id, conn, state)
+	if err = websocket.Reply(conn, nil, TypeSynced, synced); err != nil && !errors.Is(err, websocket.ErrConnectionClosed) {
+		log.Println("Error sending sync notification: ", err)
+	}
+}
+
+// trackLatest starts cursor of device at the latest message of user, the ones before it are loaded from history
+func (d *Delivery) trackLatest(ctx context.Context, userId string, deviceId string, state *deliveryState) {
+	if deviceId == "" {
+		return
+	}
+	latest, err := d.messages.GetLatestSeqForMember(ctx, userId)
+	if err != nil {
+		log.Printf("Unable to resolve latest message of user: %s, err: %s\n", userId, err)
+		return
+	}
+	state.startTracking(latest)
+}
+
+// resolveCursor prefers last seen message id sent by client on handshake over cursor stored for device
+func (d *Delivery) resolveCursor(ctx context.Context, userId string, deviceId string, conn websocket.WSConnection) (int64, error) {
+	if lastSeen := conn.Query().Get(LastSeenParam); lastSeen != "" && validId(lastSeen) {
+		seq, err := d.messages.GetSeqForMember(ctx, userId, lastSeen)
+		if err == nil || !errors.Is(err, repository.ErrMessageNotFound) {
+			return seq, err
+		}
+	}
+	if deviceId == "" {
+		return 0, nil
+	}
+	return d.cursors.Get(ctx, userId, deviceId)
+}
+
+func (d *Delivery) replay(ctx context.Context, userId string, fromSeq int64, conn websocket.WSConnection, state *deliveryState) *SyncedPayload {
+	synced := &SyncedPayload{LastSeq: fromSeq}
+	for synced.Replayed < d.maxReplay {
+		limit := replayPageSize
+		if rest := d.maxReplay - synced.Replayed; rest < limit {
+			limit = rest
+		}
+		messages, err := d.messages.ListForMemberAfter(ctx, userId, synced.LastSeq, limit)
+		if err != nil {
+			log.Printf("Error replaying messages to user: %s, err: %s\n", userId, err)
+			synced.Truncated = true
+			return synced
+		}
+
+		// receipts are only reported for the latest message of each conversation in page, it covers the previous ones
+		latest := make(map[string]int)
+		for i := range messages {
+			latest[messages[i].ConversationId] = i
+		}
+		for i := range messages {
+			var onWritten func()
+			if latest[messages[i].ConversationId] == i {
+				delivered := toDeliveredMessage(&messages[i])
+				onWritten = func() { d.notifyDelivered(userId, delivered) }
+			}
+			if !d.replayMessage(userId, conn, state, &messages[i], synced.LastSeq, onWritten) {
+				return synced
+			}
+			synced.Replayed++
+			synced.LastSeq = messages[i].Seq
+		}
+		if len(messages) < limit {
+			return synced
+		}
+	}
+
+	synced.Truncated = true
+	return synced
+}
+
+func (d *Delivery) replayMessage(userId string, conn websocket.WSConnection, state *deliveryState, msg *repository.DbMessage, after int64, onWritten func()) bool {
+	env, err := messageEnvelope(msg)
+	var encoded websocket.WsMessage
+	if err == nil {
+		encoded, err = env.Encode(conn.Codec())
+	}
+	if err == nil {
+		// replay waits for client instead of dropping messages, so it could not be outrun by slow consumer policy
+		pending := pendingMessage{msg: encoded, delivered: toDeliveredMessage(msg), after: after, onWritten: onWritten}
+		err = conn.WriteWait(d.track(userId, state, pending))
+	}
+	if err != nil {
+		if !errors.Is(err, websocket.ErrConnectionClosed) {
+			log.Printf("Error replaying message with id: %s, err: %s\n", msg.Id, err)
+		}
+		return false
+	}
+
+	state.mut.Lock()
+	state.replayed[msg.Id] = true
+	state.mut.Unlock()
+	return true
+}
+
+// goLive flushes messages buffered during replay, skipping already replayed ones. Ids are compared instead of
+// seqs because messages could be committed out of seq order, so smaller seq could still arrive live after replay
+func (d *Delivery) goLive(userId string, conn websocket.WSConnection, state *deliveryState) {
+	state.mut.Lock()
+	defer state.mut.Unlock()
+
+	for _, pending := range state.buffered {
+		if pending.delivered != nil && state.replayed[pending.delivered.Id] {
+			continue
+		}
+		// written callback locks state, but it runs in writer of connection, so it just waits for flush to finish
+		if err := conn.Write(d.track(userId, state, pending)); err != nil {
+			break
+		}
+	}
+	state.buffered = nil
+	state.replayed = nil
+	state.live = true
+}
+
+func (d *Delivery) saveCursor(userId string, deviceId string, state *deliveryState) {
+	state.mut.Lock()
+	tracking := state.tracking
+	state.mut.Unlock()
+	if !tracking || deviceId == "" {
+		return
+	}
+
+	ctx := context.Background()
+	d.verify(ctx, userId, state)
+	state.mut.Lock()
+	cursor := state.cursor
+	state.mut.Unlock()
+	if cursor == 0 {
+		return
+	}
+	if err := d.cursors.Advance(ctx, userId, deviceId, cursor); err != nil {
+		log.Printf("Error saving delivery cursor of user: %s, err: %s\n", userId, err)
+	}
+}
+
+// DeliveredMessage identifies chat message written to user's connection
+type DeliveredMessage struct {
+	Id             string
+	ConversationId string
+	SenderId       string
+	Seq            int64
+}
+
+// inspectFrame extracts chat message frame carries, other envelopes are not tracked by cursors and receipts
+// so message is nil for them
+func inspectFrame(env *websocket.Envelope) *DeliveredMessage {
+	if env.Type != TypeMessage {
+		return nil
+	}
+
+	var payload struct {
+		Seq      int64  `json:"seq"`
+		SenderId string `json:"sender_id"`
+	}
+	if err := json.Unmarshal(env.Payload, &payload); err != nil || payload.Seq == 0 {
+		return nil
+	}
+	return &DeliveredMessage{
+		Id:             env.Id,
+		ConversationId: env.ConversationId,
+		SenderId:       payload.SenderId,
+		Seq:            payload.Seq,
+	}
+}
+
+func toDeliveredMessage(msg *repository.DbMessage) *DeliveredMessage {
+	return &DeliveredMessage{Id: msg.Id, ConversationId: msg.ConversationId, SenderId: msg.SenderId, Seq: msg.Seq}
+}
+
+// deviceId returns empty id if client did not identify its device, cursor is not kept for such connections
+// as sharing it would let one device skip messages another one has not received
+func deviceId(conn websocket.WSConnection) string {
+	id := conn.Query().Get(DeviceIdParam)
+	if len(id) > maxDeviceIdLen {
+		return ""
+	}
+	return id
+}
+
+func closed(conn websocket.WSConnection) bool {
+	select {
+	case <-conn.Done():
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,257 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"online-chat-go/auth"
+	"online-chat-go/config"
+	"online-chat-go/db/repository"
+	"online-chat-go/websocket"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	deliveryUserId   = "user"
+	deliveryDeviceId = "device"
+)
+
+// queuedConn holds messages until flush writes them, as writer of connection would
+type queuedConn struct {
+	websocket.WSConnection
+	mut    sync.Mutex
+	queued []websocket.WsMessage
+	done   chan bool
+	once   sync.Once
+}
+
+func newQueuedConn() *queuedConn {
+	return &queuedConn{done: make(chan bool)}
+}
+
+func (c *queuedConn) Id() string {
+	return "connection"
+}
+
+func (c *queuedConn) Codec() websocket.Codec {
+	return websocket.JsonCodec
+}
+
+func (c *queuedConn) Query() url.Values {
+	return url.Values{DeviceIdParam: []string{deliveryDeviceId}}
+}
+
+func (c *queuedConn) Done() <-chan bool {
+	return c.done
+}
+
+func (c *queuedConn) Write(msg websocket.WsMessage) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.queued = append(c.queued, msg)
+	return nil
+}
+
+func (c *queuedConn) WriteWait(msg websocket.WsMessage) error {
+	return c.Write(msg)
+}
+
+func (c *queuedConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return nil
+}
+
+func (c *queuedConn) CloseWithReason(_ int, _ string) error {
+	return c.Close()
+}
+
+// flush writes queued messages in order, returning ids of chat messages and types of other envelopes
+func (c *queuedConn) flush(t *testing.T) []string {
+	t.Helper()
+	c.mut.Lock()
+	queued := c.queued
+	c.queued = nil
+	c.mut.Unlock()
+
+	var written []string
+	for _, msg := range queued {
+		env, err := websocket.DecodeEnvelope(websocket.JsonCodec, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env.Type == TypeMessage {
+			written = append(written, env.Id)
+		} else {
+			written = append(written, env.Type)
+		}
+		if msg.Written != nil {
+			msg.Written()
+		}
+	}
+	return written
+}
+
+// storedMessages holds messages of user in seq order, beforeReturn is called once the first page is listed
+type storedMessages struct {
+	repository.MessageRepository
+	mut          sync.Mutex
+	messages     []repository.DbMessage
+	beforeReturn func()
+}
+
+func (m *storedMessages) store(msgs ...repository.DbMessage) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.messages = append(m.messages, msgs...)
+}
+
+func (m *storedMessages) ListForMemberAfter(_ context.Context, _ string, seq int64, limit int) ([]repository.DbMessage, error) {
+	m.mut.Lock()
+	var page []repository.DbMessage
+	for _, msg := range m.messages {
+		if msg.Seq > seq && len(page) < limit {
+			page = append(page, msg)
+		}
+	}
+	beforeReturn := m.beforeReturn
+	m.beforeReturn = nil
+	m.mut.Unlock()
+
+	if beforeReturn != nil {
+		beforeReturn()
+	}
+	return page, nil
+}
+
+func (m *storedMessages) ListSeqsForMemberAfter(ctx context.Context, userId string, seq int64, limit int) ([]int64, error) {
+	page, err := m.ListForMemberAfter(ctx, userId, seq, limit)
+	seqs := make([]int64, len(page))
+	for i := range page {
+		seqs[i] = page[i].Seq
+	}
+	return seqs, err
+}
+
+// savedCursors serves stored cursor of device and reports cursors saved
+type savedCursors struct {
+	cursor int64
+	saved  chan int64
+}
+
+func (c *savedCursors) Get(_ context.Context, _ string, _ string) (int64, error) {
+	return c.cursor, nil
+}
+
+func (c *savedCursors) Advance(_ context.Context, _ string, _ string, seq int64) error {
+	c.saved <- seq
+	return nil
+}
+
+func deliveryMessage(seq int64, id string) repository.DbMessage {
+	return repository.DbMessage{Id: id, Seq: seq, ConversationId: "conversation", SenderId: "sender", Content: []byte(`"hi"`)}
+}
+
+func newTestDelivery(t *testing.T, messages *storedMessages, cursors *savedCursors) (*Delivery, *queuedConn) {
+	t.Helper()
+	wss := websocket.NewWSServer(&config.WsConfig{})
+	conn := newQueuedConn()
+	if err := wss.AddConnection(deliveryUserId, conn); err != nil {
+		t.Fatal(err)
+	}
+	return NewDelivery(wss, messages, cursors, 100, 100), conn
+}
+
+func publish(t *testing.T, delivery *Delivery, msg repository.DbMessage) {
+	t.Helper()
+	env, err := messageEnvelope(&msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = delivery.Deliver(deliveryUserId, websocket.BusMessage(data)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeliveryFlushesLiveMessagesAfterReplay(t *testing.T) {
+	messages := &storedMessages{}
+	messages.store(deliveryMessage(1, "m1"), deliveryMessage(2, "m2"), deliveryMessage(3, "m3"))
+	delivery, conn := newTestDelivery(t, messages, &savedCursors{cursor: 1, saved: make(chan int64, 1)})
+
+	// m3 is replayed and arrives live as well, m4 is committed once replay listed messages
+	messages.beforeReturn = func() {
+		messages.store(deliveryMessage(4, "m4"))
+		publish(t, delivery, deliveryMessage(3, "m3"))
+		publish(t, delivery, deliveryMessage(4, "m4"))
+	}
+	delivery.Start(&auth.Principal{Id: deliveryUserId}, conn)
+
+	expected := []string{"m2", "m3", "m4", TypeSynced}
+	written := conn.flush(t)
+	if len(written) != len(expected) {
+		t.Fatalf("written messages are %v, expected %v", written, expected)
+	}
+	for i := range expected {
+		if written[i] != expected[i] {
+			t.Fatalf("written messages are %v, expected %v", written, expected)
+		}
+	}
+
+	// once connection is live messages are written right away
+	publish(t, delivery, deliveryMessage(5, "m5"))
+	if written = conn.flush(t); len(written) != 1 || written[0] != "m5" {
+		t.Errorf("live messages are %v, expected [m5]", written)
+	}
+}
+
+func TestDeliverySavesCursorOnDone(t *testing.T) {
+	tests := []struct {
+		name      string
+		published []int64
+		flushed   bool
+		expected  int64
+	}{
+		{name: "written messages without gap", published: []int64{4, 3}, flushed: true, expected: 4},
+		{name: "message which did not arrive yet", published: []int64{4}, flushed: true, expected: 2},
+		{name: "messages which are not written yet", published: []int64{3, 4}, expected: 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			messages := &storedMessages{}
+			messages.store(deliveryMessage(1, "m1"), deliveryMessage(2, "m2"))
+			cursors := &savedCursors{cursor: 1, saved: make(chan int64, 1)}
+			delivery, conn := newTestDelivery(t, messages, cursors)
+
+			// m3 and m4 are committed once replay listed messages and arrive live afterwards, if at all
+			messages.beforeReturn = func() {
+				messages.store(deliveryMessage(3, "m3"), deliveryMessage(4, "m4"))
+			}
+			delivery.Start(&auth.Principal{Id: deliveryUserId}, conn)
+			conn.flush(t)
+
+			for _, seq := range test.published {
+				publish(t, delivery, deliveryMessage(seq, fmt.Sprintf("m%d", seq)))
+			}
+			if test.flushed {
+				conn.flush(t)
+			}
+			_ = conn.Close()
+
+			select {
+			case cursor := <-cursors.saved:
+				if cursor != test.expected {
+					t.Errorf("saved cursor is %d, expected %d", cursor, test.expected)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("cursor is not saved once connection is closed")
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"online-chat-go/auth"
+	"online-chat-go/db/repository"
+	"time"
+)
+
+const (
+	TypeEdit           = "edit"
+	TypeDelete         = "delete"
+	TypeMessageEdited  = "message_edited"
+	TypeMessageDeleted = "message_deleted"
+)
+
+var (
+	ErrNotAuthor         = errors.New("Only author is allowed to change message")
+	ErrEditWindowExpired = errors.New("Message could no longer be edited")
+	ErrMessageDeleted    = errors.New("Message has been deleted")
+)
+
+// MessageEditedEvent is delivered to conversation members in envelope whose id is id of edited message
+type MessageEditedEvent struct {
+	Seq      int64           `json:"seq"`
+	Content  json.RawMessage `json:"content"`
+	EditedAt time.Time       `json:"edited_at"`
+}
+
+// MessageDeletedEvent is delivered in envelope whose id is id of deleted message, messages deleted only
+// for user are reported just to devices of that user
+type MessageDeletedEvent struct {
+	Seq         int64     `json:"seq"`
+	DeletedAt   time.Time `json:"deleted_at"`
+	DeletedBy   string    `json:"deleted_by,omitempty"`
+	ForEveryone bool      `json:"for_everyone"`
+}
+
+// Edit replaces content of message, only author is allowed to do it within edit window
+func (cs *ConversationService) Edit(ctx context.Context, principal *auth.Principal, conversationId string, messageId string, content json.RawMessage) (*MessageEditedEvent, error) {
+	msg, err := cs.memberMessage(ctx, principal, conversationId, messageId)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	switch {
+	case msg.SenderId != principal.Id:
+		return nil, ErrNotAuthor
+	case msg.DeletedAt != nil:
+		return nil, ErrMessageDeleted
+	case now.Sub(msg.SentAt) > cs.editWindow:
+		return nil, ErrEditWindowExpired
+	}
+
+	if err = cs.messages.Edit(ctx, conversationId, messageId, content, now); errors.Is(err, repository.ErrMessageNotFound) {
+		return nil, ErrMessageDeleted
+	} else if err != nil {
+		return nil, err
+	}
+
+	event := &MessageEditedEvent{Seq: msg.Seq, Content: content, EditedAt: now}
+	if err = cs.fanOutEvent(ctx, conversationId, messageId, TypeMessageEdited, event); err != nil {
+		log.Printf("Error delivering edit of message with id: %s, err: %s\n", messageId, err)
+	}
+	return event, nil
+}
+
+// Delete either hides message for user or turns it into tombstone for everyone. Only author could delete message
+// for everyone, unless user is moderator who is allowed to delete any message even without being a member
+func (cs *ConversationService) Delete(ctx context.Context, principal *auth.Principal, conversationId string, messageId string, forEveryone bool) (*MessageDeletedEvent, error) {
+	if !forEveryone {
+		return cs.hide(ctx, principal, conversationId, messageId)
+	}
+
+	var msg *repository.DbMessage
+	var err error
+	if principal.IsModerator() {
+		if !validId(principal.Id) || !validId(conversationId) || !validId(messageId) {
+			return nil, ErrInvalidId
+		}
+		msg, err = cs.messages.Get(ctx, conversationId, messageId)
+	} else {
+		msg, err = cs.memberMessage(ctx, principal, conversationId, messageId)
+		if err == nil && msg.SenderId != principal.Id {
+			err = ErrNotAuthor
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	event := &MessageDeletedEvent{Seq: msg.Seq, DeletedAt: time.Now().UTC(), DeletedBy: principal.Id, ForEveryone: true}
+	if msg.DeletedAt != nil {
+		// deletion is idempotent, so client could safely retry it
+		event.DeletedAt = *msg.DeletedAt
+		if msg.DeletedBy != nil {
+			event.DeletedBy = *msg.DeletedBy
+		}
+		return event, nil
+	}
+
+	if err = cs.messages.Delete(ctx, conversationId, messageId, principal.Id, event.DeletedAt); err != nil && !errors.Is(err, repository.ErrMessageNotFound) {
+		return nil, err
+	}
+
+	if err = cs.fanOutEvent(ctx, conversationId, messageId, TypeMessageDeleted, event); err != nil {
+		log.Printf("Error delivering deletion of message with id: %s, err: %s\n", messageId, err)
+	}
+	return event, nil
+}
+
+func (cs *ConversationService) hide(ctx context.Context, principal *auth.Principal, conversationId string, messageId string) (*MessageDeletedEvent, error) {
+	msg, err := cs.memberMessage(ctx, principal, conversationId, messageId)
+	if err != nil {
+		return nil, err
+	}
+	if err = cs.messages.Hide(ctx, principal.Id, messageId); err != nil {
+		return nil, err
+	}
+
+	event := &MessageDeletedEvent{Seq: msg.Seq, DeletedAt: time.Now().UTC()}
+	env, err := newEvent(ctx, TypeMessageDeleted, conversationId, messageId, event)
+	if err == nil {
+		err = cs.publishToUser(ctx, principal.Id, env)
+	}
+	if err != nil {
+		log.Printf("Error publishing deletion of message to user: %s, err: %s\n", principal.Id, err)
+	}
+	return event, nil
+}
+
+func (cs *ConversationService) memberMessage(ctx context.Context, principal *auth.Principal, conversationId string, messageId string) (*repository.DbMessage, error) {
+	if !validId(messageId) {
+		return nil, ErrInvalidId
+	}
+	if err := cs.CheckMember(ctx, principal.Id, conversationId); err != nil {
+		return nil, err
+	}
+	return cs.messages.Get(ctx, conversationId, messageId)
+}
+
+func (cs *ConversationService) fanOutEvent(ctx context.Context, conversationId string, messageId string, msgType string, event any) error {
+	env, err := newEvent(ctx, msgType, conversationId, messageId, event)
+	if err != nil {
+		return err
+	}
+	return cs.FanOutEnvelope(ctx, conversationId, env)
+}
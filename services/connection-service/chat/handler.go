@@ -0,0 +1,271 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"online-chat-go/auth"
+	"online-chat-go/db/repository"
+	"online-chat-go/util"
+	"strconv"
+)
+
+const maxRequestBodySize = 64 * 1024
+
+type createConversationRequest struct {
+	Kind      string   `json:"kind"`
+	PeerId    string   `json:"peer_id"`
+	Title     string   `json:"title"`
+	MemberIds []string `json:"member_ids"`
+}
+
+type settingsRequest struct {
+	ConversationId string `json:"conversation_id"`
+	SettingsUpdate
+}
+
+type editRequest struct {
+	ConversationId string          `json:"conversation_id"`
+	MessageId      string          `json:"message_id"`
+	Content        json.RawMessage `json:"content"`
+}
+
+type memberRequest struct {
+	ConversationId string `json:"conversation_id"`
+	UserId         string `json:"user_id"`
+}
+
+// NewConversationsHandler serves GET (list own conversations) and POST (create conversation) on /conversations
+func NewConversationsHandler(service *ConversationService) func(http.ResponseWriter, *http.Request, *auth.Principal) {
+	return func(writer http.ResponseWriter, request *http.Request, principal *auth.Principal) {
+		switch request.Method {
+		case http.MethodGet:
+			conversations, err := service.List(request.Context(), principal)
+			if err != nil {
+				WriteServiceError(writer, err)
+				return
+			}
+			util.WriteJson(writer, http.StatusOK, conversations)
+
+		case http.MethodPost:
+			var body createConversationRequest
+			if err := util.ReadJson(writer, request, maxRequestBodySize, &body); err != nil {
+				util.WriteError(writer, http.StatusBadRequest, "Malformed request body")
+				return
+			}
+
+			var conversation *Conversation
+			var err error
+			switch body.Kind {
+			case repository.ConversationDirect:
+				conversation, err = service.CreateDirect(request.Context(), principal, body.PeerId)
+			case repository.ConversationGroup:
+				conversation, err = service.CreateGroup(request.Context(), principal, body.Title, body.MemberIds)
+			default:
+				util.WriteError(writer, http.StatusBadRequest, "Conversation kind should be either direct or group")
+				return
+			}
+
+			if err != nil {
+				WriteServiceError(writer, err)
+				return
+			}
+			util.WriteJson(writer, http.StatusCreated, conversation)
+
+		default:
+			writer.Header().Set("Allow", "GET, POST")
+			util.WriteError(writer, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	}
+}
+
+// NewMembersHandler serves POST (add member) and DELETE (leave conversation) on /conversations/members
+func NewMembersHandler(service *ConversationService) func(http.ResponseWriter, *http.Request, *auth.Principal) {
+	return func(writer http.ResponseWriter, request *http.Request, principal *auth.Principal) {
+		switch request.Method {
+		case http.MethodPost:
+			var body memberRequest
+			if err := util.ReadJson(writer, request, maxRequestBodySize, &body); err != nil {
+				util.WriteError(writer, http.StatusBadRequest, "Malformed request body")
+				return
+			}
+
+			if err := service.AddMember(request.Context(), principal, body.ConversationId, body.UserId); err != nil {
+				WriteServiceError(writer, err)
+				return
+			}
+			writer.WriteHeader(http.StatusNoContent)
+
+		case http.MethodDelete:
+			conversationId := request.URL.Query().Get("conversation_id")
+			if err := service.Leave(request.Context(), principal, conversationId); err != nil {
+				WriteServiceError(writer, err)
+				return
+			}
+			writer.WriteHeader(http.StatusNoContent)
+
+		default:
+			writer.Header().Set("Allow", "POST, DELETE")
+			util.WriteError(writer, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	}
+}
+
+// NewSettingsHandler serves POST on /conversations/settings, changing only settings present in request body
+func NewSettingsHandler(service *ConversationService) func(http.ResponseWriter, *http.Request, *auth.Principal) {
+	return func(writer http.ResponseWriter, request *http.Request, principal *auth.Principal) {
+		if !util.RequireMethod(writer, request, http.MethodPost) {
+			return
+		}
+
+		var body settingsRequest
+		if err := util.ReadJson(writer, request, maxRequestBodySize, &body); err != nil {
+			util.WriteError(writer, http.StatusBadRequest, "Malformed request body")
+			return
+		}
+
+		settings, err := service.UpdateSettings(request.Context(), principal, body.ConversationId, body.SettingsUpdate)
+		if err != nil {
+			WriteServiceError(writer, err)
+			return
+		}
+		util.WriteJson(writer, http.StatusOK, settings)
+	}
+}
+
+// NewMessagesHandler serves on /conversations/messages GET (history, query parameters: conversation_id, before
+// or after, limit), PATCH (edit message) and DELETE (query parameters: conversation_id, message_id, for_everyone)
+func NewMessagesHandler(service *ConversationService) func(http.ResponseWriter, *http.Request, *auth.Principal) {
+	return func(writer http.ResponseWriter, request *http.Request, principal *auth.Principal) {
+		params := request.URL.Query()
+		switch request.Method {
+		case http.MethodGet:
+			query, ok := readHistoryQuery(writer, params)
+			if !ok {
+				return
+			}
+
+			page, err := service.History(request.Context(), principal, params.Get("conversation_id"), query)
+			if err != nil {
+				WriteServiceError(writer, err)
+				return
+			}
+			util.WriteJson(writer, http.StatusOK, page)
+
+		case http.MethodPatch:
+			var body editRequest
+			if err := util.ReadJson(writer, request, maxRequestBodySize, &body); err != nil || len(body.Content) == 0 {
+				util.WriteError(writer, http.StatusBadRequest, "Malformed request body")
+				return
+			}
+
+			event, err := service.Edit(request.Context(), principal, body.ConversationId, body.MessageId, body.Content)
+			if err != nil {
+				WriteServiceError(writer, err)
+				return
+			}
+			util.WriteJson(writer, http.StatusOK, event)
+
+		case http.MethodDelete:
+			forEveryone, err := strconv.ParseBool(params.Get("for_everyone"))
+			if err != nil && params.Has("for_everyone") {
+				util.WriteError(writer, http.StatusBadRequest, "for_everyone should be a boolean")
+				return
+			}
+
+			event, err := service.Delete(request.Context(), principal, params.Get("conversation_id"), params.Get("message_id"), forEveryone)
+			if err != nil {
+				WriteServiceError(writer, err)
+				return
+			}
+			util.WriteJson(writer, http.StatusOK, event)
+
+		default:
+			writer.Header().Set("Allow", "GET, PATCH, DELETE")
+			util.WriteError(writer, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	}
+}
+
+// NewThreadHandler serves GET on /conversations/threads, query parameters: conversation_id, message_id of thread root,
+// before or after, limit
+func NewThreadHandler(service *ConversationService) func(http.ResponseWriter, *http.Request, *auth.Principal) {
+	return func(writer http.ResponseWriter, request *http.Request, principal *auth.Principal) {
+		if !util.RequireMethod(writer, request, http.MethodGet) {
+			return
+		}
+
+		params := request.URL.Query()
+		query, ok := readHistoryQuery(writer, params)
+		if !ok {
+			return
+		}
+
+		page, err := service.Thread(request.Context(), principal, params.Get("conversation_id"), params.Get("message_id"), query)
+		if err != nil {
+			WriteServiceError(writer, err)
+			return
+		}
+		util.WriteJson(writer, http.StatusOK, page)
+	}
+}
+
+// NewReceiptsHandler serves GET on /conversations/receipts, query parameters: conversation_id, message_id
+func NewReceiptsHandler(receipts *Receipts) func(http.ResponseWriter, *http.Request, *auth.Principal) {
+	return func(writer http.ResponseWriter, request *http.Request, principal *auth.Principal) {
+		if !util.RequireMethod(writer, request, http.MethodGet) {
+			return
+		}
+
+		params := request.URL.Query()
+		summary, err := receipts.Summary(request.Context(), principal, params.Get("conversation_id"), params.Get("message_id"))
+		if err != nil {
+			WriteServiceError(writer, err)
+			return
+		}
+		util.WriteJson(writer, http.StatusOK, summary)
+	}
+}
+
+func readHistoryQuery(writer http.ResponseWriter, params url.Values) (HistoryQuery, bool) {
+	query := HistoryQuery{Before: optionalParam(params, "before"), After: optionalParam(params, "after")}
+	if limit := params.Get("limit"); limit != "" {
+		var err error
+		if query.Limit, err = strconv.Atoi(limit); err != nil {
+			util.WriteError(writer, http.StatusBadRequest, "Limit should be a number")
+			return query, false
+		}
+	}
+	return query, true
+}
+
+func optionalParam(params url.Values, name string) *string {
+	if !params.Has(name) {
+		return nil
+	}
+	value := params.Get(name)
+	return &value
+}
+
+// WriteServiceError maps chat errors to http statuses, hiding details of unexpected ones
+func WriteServiceError(writer http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrInvalidId), errors.Is(err, ErrInvalidTitle), errors.Is(err, ErrSelfConversation),
+		errors.Is(err, ErrNotGroup), errors.Is(err, ErrInvalidHistoryQuery), errors.Is(err, ErrNestedThread),
+		errors.Is(err, ErrAttachments), errors.Is(err, repository.ErrMembersLimit):
+		util.WriteError(writer, http.StatusBadRequest, err.Error())
+	case errors.Is(err, ErrMessageDeleted):
+		util.WriteError(writer, http.StatusConflict, err.Error())
+	case errors.Is(err, ErrNotMember), errors.Is(err, ErrNotOwner), errors.Is(err, ErrNotAuthor),
+		errors.Is(err, ErrEditWindowExpired):
+		util.WriteError(writer, http.StatusForbidden, err.Error())
+	case errors.Is(err, repository.ErrConversationNotFound), errors.Is(err, repository.ErrUserNotFound),
+		errors.Is(err, repository.ErrMessageNotFound), errors.Is(err, repository.ErrAttachmentNotFound):
+		util.WriteError(writer, http.StatusNotFound, err.Error())
+	default:
+		log.Println("Error handling request: ", err)
+		util.WriteError(writer, http.StatusInternalServerError, "Internal server error")
+	}
+}
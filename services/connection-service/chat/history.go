@@ -0,0 +1,133 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"online-chat-go/auth"
+	"online-chat-go/db/repository"
+	"time"
+)
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 100
+)
+
+var ErrInvalidHistoryQuery = errors.New("Only one of before and after cursors could be specified")
+
+type HistoryQuery struct {
+	Before *string `json:"before,omitempty"`
+	After  *string `json:"after,omitempty"`
+	Limit  int     `json:"limit,omitempty"`
+}
+
+type HistoryMessage struct {
+	Id             string          `json:"id"`
+	Seq            int64           `json:"seq"`
+	ConversationId string          `json:"conversation_id"`
+	SenderId       string          `json:"sender_id"`
+	ClientId       *string         `json:"client_id,omitempty"`
+	SentAt         time.Time       `json:"sent_at"`
+	EditedAt       *time.Time      `json:"edited_at,omitempty"`
+	DeletedAt      *time.Time      `json:"deleted_at,omitempty"`
+	Content        json.RawMessage `json:"content"`
+	Attachments    []string        `json:"attachments,omitempty"`
+	Reactions      []ReactionCount `json:"reactions,omitempty"`
+	ParentId       *string         `json:"parent_id,omitempty"`
+	ReplyCount     int             `json:"reply_count,omitempty"`
+	LastReplyId    *string         `json:"last_reply_id,omitempty"`
+	LastReplyAt    *time.Time      `json:"last_reply_at,omitempty"`
+}
+
+// HistoryPage always lists messages in chronological order, HasMore tells whether there are more messages
+// in the direction of the query, ids of the first and the last message serve as cursors for next pages
+type HistoryPage struct {
+	Messages []HistoryMessage `json:"messages"`
+	HasMore  bool             `json:"has_more"`
+}
+
+// History lists top level messages of conversation, thread replies are listed by Thread
+func (cs *ConversationService) History(ctx context.Context, principal *auth.Principal, conversationId string, query HistoryQuery) (*HistoryPage, error) {
+	if err := validateHistoryQuery(query); err != nil {
+		return nil, err
+	}
+	if err := cs.CheckMember(ctx, principal.Id, conversationId); err != nil {
+		return nil, err
+	}
+	return cs.history(ctx, principal, conversationId, nil, query)
+}
+
+func validateHistoryQuery(query HistoryQuery) error {
+	if query.Before != nil && query.After != nil {
+		return ErrInvalidHistoryQuery
+	}
+	for _, cursor := range []*string{query.Before, query.After} {
+		if cursor != nil && !validId(*cursor) {
+			return ErrInvalidId
+		}
+	}
+	return nil
+}
+
+func (cs *ConversationService) history(ctx context.Context, principal *auth.Principal, conversationId string, parentId *string, query HistoryQuery) (*HistoryPage, error) {
+	limit := query.Limit
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	} else if limit > maxHistoryLimit {
+		limit = maxHistoryLimit
+	}
+
+	// one extra message is fetched to find out whether there are more of them
+	var messages []repository.DbMessage
+	var err error
+	if query.After != nil {
+		messages, err = cs.messages.ListAfter(ctx, principal.Id, conversationId, parentId, *query.After, limit+1)
+	} else {
+		messages, err = cs.messages.ListBefore(ctx, principal.Id, conversationId, parentId, query.Before, limit+1)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	page := &HistoryPage{HasMore: len(messages) > limit, Messages: make([]HistoryMessage, 0, limit)}
+	if page.HasMore {
+		messages = messages[:limit]
+	}
+	if query.After == nil {
+		reverse(messages)
+	}
+	for i := range messages {
+		page.Messages = append(page.Messages, toHistoryMessage(&messages[i]))
+	}
+	if err = cs.attachReactions(ctx, principal.Id, page.Messages); err != nil {
+		return nil, err
+	}
+
+	return page, nil
+}
+
+func toHistoryMessage(msg *repository.DbMessage) HistoryMessage {
+	return HistoryMessage{
+		Id:             msg.Id,
+		Seq:            msg.Seq,
+		ConversationId: msg.ConversationId,
+		SenderId:       msg.SenderId,
+		ClientId:       msg.ClientId,
+		SentAt:         msg.SentAt.UTC(),
+		EditedAt:       msg.EditedAt,
+		DeletedAt:      msg.DeletedAt,
+		Content:        msg.Content,
+		Attachments:    msg.AttachmentIds,
+		ParentId:       msg.ParentId,
+		ReplyCount:     msg.ReplyCount,
+		LastReplyId:    msg.LastReplyId,
+		LastReplyAt:    msg.LastReplyAt,
+	}
+}
+
+func reverse[T any](values []T) {
+	for i, j := 0, len(values)-1; i < j; i, j = i+1, j-1 {
+		values[i], values[j] = values[j], values[i]
+	}
+}
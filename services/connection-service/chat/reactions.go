@@ -0,0 +1,106 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"log"
+	"online-chat-go/auth"
+	"online-chat-go/db/repository"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	TypeReactionAdd    = "reaction_add"
+	TypeReactionRemove = "reaction_remove"
+	TypeReaction       = "reaction"
+
+	maxEmojiLength = 32
+)
+
+var ErrInvalidEmoji = errors.New("Emoji should be non empty and at most 32 bytes long without spaces")
+
+// ReactionEvent is delivered to conversation members in envelope whose id is id of the message reaction is on
+type ReactionEvent struct {
+	Seq     int64  `json:"seq"`
+	UserId  string `json:"user_id"`
+	Emoji   string `json:"emoji"`
+	Removed bool   `json:"removed,omitempty"`
+}
+
+type ReactionCount struct {
+	Emoji   string `json:"emoji"`
+	Count   int    `json:"count"`
+	Reacted bool   `json:"reacted,omitempty"`
+}
+
+// React adds or removes reaction of user on message, members are notified only if reactions have actually changed
+func (cs *ConversationService) React(ctx context.Context, principal *auth.Principal, conversationId string, messageId string, emoji string, remove bool) error {
+	if !validEmoji(emoji) {
+		return ErrInvalidEmoji
+	}
+
+	msg, err := cs.memberMessage(ctx, principal, conversationId, messageId)
+	if err != nil {
+		return err
+	} else if msg.DeletedAt != nil {
+		return ErrMessageDeleted
+	}
+
+	var changed bool
+	if remove {
+		changed, err = cs.reactions.Remove(ctx, messageId, principal.Id, emoji)
+	} else {
+		changed, err = cs.reactions.Add(ctx, messageId, principal.Id, emoji, cs.maxReactions)
+	}
+	if err != nil || !changed {
+		return err
+	}
+
+	event := ReactionEvent{Seq: msg.Seq, UserId: principal.Id, Emoji: emoji, Removed: remove}
+	if err = cs.fanOutEvent(ctx, conversationId, messageId, TypeReaction, event); err != nil {
+		log.Printf("Error delivering reaction on message with id: %s, err: %s\n", messageId, err)
+	}
+	return nil
+}
+
+// attachReactions fills aggregated reactions of history messages
+func (cs *ConversationService) attachReactions(ctx context.Context, userId string, messages []HistoryMessage) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	ids := make([]string, 0, len(messages))
+	for i := range messages {
+		ids = append(ids, messages[i].Id)
+	}
+	counts, err := cs.reactions.Count(ctx, userId, ids)
+	if err != nil {
+		return err
+	}
+
+	byMessage := make(map[string][]ReactionCount)
+	for _, count := range counts {
+		byMessage[count.MessageId] = append(byMessage[count.MessageId], toReactionCount(&count))
+	}
+	for i := range messages {
+		messages[i].Reactions = byMessage[messages[i].Id]
+	}
+	return nil
+}
+
+func toReactionCount(count *repository.DbReactionCount) ReactionCount {
+	return ReactionCount{Emoji: count.Emoji, Count: count.Count, Reacted: count.Reacted}
+}
+
+func validEmoji(emoji string) bool {
+	if emoji == "" || len(emoji) > maxEmojiLength || !utf8.ValidString(emoji) {
+		return false
+	}
+	for _, r := range emoji {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,32 @@
+package chat
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidEmoji(t *testing.T) {
+	tests := []struct {
+		emoji string
+		valid bool
+	}{
+		{emoji: "👍", valid: true},
+		{emoji: "👨‍👩‍👧", valid: true},
+		{emoji: ":thumbsup:", valid: true},
+		{emoji: ""},
+		{emoji: "👍 "},
+		{emoji: "\n"},
+		{emoji: "\u0007"},
+		{emoji: "\xff"},
+		{emoji: strings.Repeat("a", maxEmojiLength), valid: true},
+		{emoji: strings.Repeat("a", maxEmojiLength+1)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.emoji, func(t *testing.T) {
+			if valid := validEmoji(test.emoji); valid != test.valid {
+				t.Errorf("emoji %q is valid: %t, expected %t", test.emoji, valid, test.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"online-chat-go/auth"
+	"online-chat-go/db/repository"
+	"online-chat-go/notifications"
+	"online-chat-go/websocket"
+	"time"
+)
+
+const (
+	TypeReceipt = "receipt"
+	TypeRead    = "read"
+
+	ReceiptDelivered = "delivered"
+	ReceiptRead      = "read"
+)
+
+// ReceiptEvent tells that message and all the previous messages of conversation were delivered to or read by user
+type ReceiptEvent struct {
+	UserId    string    `json:"user_id"`
+	MessageId string    `json:"message_id"`
+	Seq       int64     `json:"seq"`
+	Status    string    `json:"status"`
+	At        time.Time `json:"at"`
+}
+
+// ReceiptSummary counts conversation members other than author who got and read message, members who joined
+// after message was sent are not its recipients
+type ReceiptSummary struct {
+	MessageId  string `json:"message_id"`
+	Seq        int64  `json:"seq"`
+	Recipients int    `json:"recipients"`
+	Delivered  int    `json:"delivered"`
+	Read       int    `json:"read"`
+}
+
+// Receipts keeps per member delivery and read markers of conversations. Delivery receipts are sent to author
+// of message, read receipts are sent to author and to other devices of reader, so they can sync unread state
+type Receipts struct {
+	conversations *ConversationService
+	receipts      repository.ReceiptRepository
+	messages      repository.MessageRepository
+	bus           notifications.NotificationBus
+}
+
+func NewReceipts(
+	conversations *ConversationService,
+	receipts repository.ReceiptRepository,
+	messages repository.MessageRepository,
+	bus notifications.NotificationBus,
+) *Receipts {
+	return &Receipts{conversations: conversations, receipts: receipts, messages: messages, bus: bus}
+}
+
+// OnDelivered could be set as Delivery callback
+func (r *Receipts) OnDelivered(userId string, msg *DeliveredMessage) {
+	ctx := context.Background()
+	advanced, err := r.receipts.AdvanceDelivered(ctx, msg.ConversationId, userId, msg.Seq)
+	if err != nil {
+		log.Printf("Error storing delivery receipt of user: %s, message id: %s, err: %s\n", userId, msg.Id, err)
+		return
+	} else if !advanced {
+		return
+	}
+
+	event := ReceiptEvent{UserId: userId, MessageId: msg.Id, Seq: msg.Seq, Status: ReceiptDelivered, At: time.Now().UTC()}
+	r.publish(ctx, msg.ConversationId, "", event, msg.SenderId)
+}
+
+// MarkRead moves read marker of user up to given message, marker is never moved backwards
+func (r *Receipts) MarkRead(ctx context.Context, principal *auth.Principal, conversationId string, messageId string) error {
+	if !validId(messageId) {
+		return ErrInvalidId
+	}
+	if err := r.conversations.CheckMember(ctx, principal.Id, conversationId); err != nil {
+		return err
+	}
+
+	msg, err := r.messages.Get(ctx, conversationId, messageId)
+	if err != nil {
+		return err
+	}
+
+	advanced, err := r.receipts.AdvanceRead(ctx, conversationId, principal.Id, msg.Seq)
+	if err != nil || !advanced {
+		return err
+	}
+
+	event := ReceiptEvent{UserId: principal.Id, MessageId: msg.Id, Seq: msg.Seq, Status: ReceiptRead, At: time.Now().UTC()}
+	recipients := []string{principal.Id}
+	if msg.SenderId != principal.Id {
+		recipients = append(recipients, msg.SenderId)
+	}
+	r.publish(ctx, conversationId, websocket.Origin(ctx), event, recipients...)
+	return nil
+}
+
+func (r *Receipts) Summary(ctx context.Context, principal *auth.Principal, conversationId string, messageId string) (*ReceiptSummary, error) {
+	if !validId(messageId) {
+		return nil, ErrInvalidId
+	}
+	if err := r.conversations.CheckMember(ctx, principal.Id, conversationId); err != nil {
+		return nil, err
+	}
+
+	msg, err := r.messages.Get(ctx, conversationId, messageId)
+	if err != nil {
+		return nil, err
+	}
+
+	counts, err := r.receipts.Count(ctx, conversationId, msg.SenderId, msg.Seq, msg.SentAt)
+	if err != nil {
+		return nil, err
+	}
+	return &ReceiptSummary{
+		MessageId:  msg.Id,
+		Seq:        msg.Seq,
+		Recipients: counts.Recipients,
+		Delivered:  counts.Delivered,
+		Read:       counts.Read,
+	}, nil
+}
+
+func (r *Receipts) publish(ctx context.Context, conversationId string, origin string, event ReceiptEvent, userIds ...string) {
+	env, err := websocket.NewEnvelope(TypeReceipt, event)
+	if err != nil {
+		log.Println("Error encoding receipt: ", err)
+		return
+	}
+	env.ConversationId = conversationId
+	env.Origin = origin
+
+	msg, err := json.Marshal(env)
+	if err != nil {
+		log.Println("Error encoding receipt: ", err)
+		return
+	}
+	for _, id := range userIds {
+		if err = r.bus.Publish(ctx, notifications.UserTopic(id), msg); err != nil {
+			log.Printf("Error publishing receipt to user: %s, err: %s\n", id, err)
+		}
+	}
+}
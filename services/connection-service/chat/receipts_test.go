@@ -0,0 +1,53 @@
+package chat
+
+import (
+	"context"
+	"online-chat-go/auth"
+	"online-chat-go/config"
+	"online-chat-go/db/repository"
+	"testing"
+	"time"
+)
+
+// sentMessage serves the same message for every id
+type sentMessage struct {
+	repository.MessageRepository
+	msg repository.DbMessage
+}
+
+func (m *sentMessage) Get(_ context.Context, _ string, _ string) (*repository.DbMessage, error) {
+	msg := m.msg
+	return &msg, nil
+}
+
+// joinedMembers counts recipients of message by time members joined at
+type joinedMembers struct {
+	repository.ReceiptRepository
+	joinedAt []time.Time
+}
+
+func (r *joinedMembers) Count(_ context.Context, _ string, _ string, _ int64, sentAt time.Time) (*repository.DbReceiptCounts, error) {
+	counts := &repository.DbReceiptCounts{}
+	for _, joinedAt := range r.joinedAt {
+		if !joinedAt.After(sentAt) {
+			counts.Recipients++
+		}
+	}
+	return counts, nil
+}
+
+func TestReceiptSummaryCountsMembersJoinedBeforeMessage(t *testing.T) {
+	sentAt := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	messages := &sentMessage{msg: repository.DbMessage{Id: typingConversationId, Seq: 1, SenderId: "sender", SentAt: sentAt}}
+	receipts := &joinedMembers{joinedAt: []time.Time{sentAt.Add(-time.Hour), sentAt, sentAt.Add(time.Hour)}}
+	conversations := NewConversationService(&typingMembers{member: true}, messages, nil, nil, nil, &countedBus{}, &config.ChatConfig{})
+
+	summary, err := NewReceipts(conversations, receipts, messages, &countedBus{}).
+		Summary(context.Background(), &auth.Principal{Id: typingUserId}, typingConversationId, typingConversationId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Recipients != 2 {
+		t.Errorf("message has %d recipients, expected 2", summary.Recipients)
+	}
+}
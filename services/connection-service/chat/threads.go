@@ -0,0 +1,133 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"online-chat-go/auth"
+	"online-chat-go/db/repository"
+	"online-chat-go/websocket"
+	"time"
+)
+
+const (
+	TypeThread            = "thread"
+	TypeThreadUpdated     = "thread_updated"
+	TypeThreadSubscribe   = "thread_subscribe"
+	TypeThreadUnsubscribe = "thread_unsubscribe"
+)
+
+var ErrNestedThread = errors.New("Replies could only be sent to top level messages")
+
+// ThreadUpdatedEvent is delivered to all conversation members in envelope whose id is id of thread root message,
+// so they could update reply metadata, replies themselves are delivered only to thread subscribers
+type ThreadUpdatedEvent struct {
+	ReplyCount  int       `json:"reply_count"`
+	LastReplyId string    `json:"last_reply_id"`
+	LastReplyAt time.Time `json:"last_reply_at"`
+}
+
+// ThreadPage lists replies of thread along with its root message
+type ThreadPage struct {
+	Root HistoryMessage `json:"root"`
+	*HistoryPage
+}
+
+// Thread lists replies of message in the same manner as History lists top level messages
+func (cs *ConversationService) Thread(ctx context.Context, principal *auth.Principal, conversationId string, messageId string, query HistoryQuery) (*ThreadPage, error) {
+	if err := validateHistoryQuery(query); err != nil {
+		return nil, err
+	}
+
+	root, err := cs.memberMessage(ctx, principal, conversationId, messageId)
+	if err != nil {
+		return nil, err
+	} else if root.ParentId != nil {
+		return nil, ErrNestedThread
+	}
+
+	page, err := cs.history(ctx, principal, conversationId, &root.Id, query)
+	if err != nil {
+		return nil, err
+	}
+
+	thread := &ThreadPage{Root: toHistoryMessage(root), HistoryPage: page}
+	if err = cs.attachReactions(ctx, principal.Id, []HistoryMessage{thread.Root}); err != nil {
+		return nil, err
+	}
+	return thread, nil
+}
+
+// Subscribe lets member follow or mute thread, muted thread replies are still available via Thread
+func (cs *ConversationService) Subscribe(ctx context.Context, principal *auth.Principal, conversationId string, messageId string, subscribed bool) error {
+	if !validId(messageId) {
+		return ErrInvalidId
+	}
+	if err := cs.CheckMember(ctx, principal.Id, conversationId); err != nil {
+		return err
+	}
+	if _, err := cs.threadRoot(ctx, conversationId, messageId); err != nil {
+		return err
+	}
+	return cs.threads.SetSubscribed(ctx, messageId, principal.Id, subscribed)
+}
+
+func (cs *ConversationService) threadRoot(ctx context.Context, conversationId string, messageId string) (*repository.DbMessage, error) {
+	if !validId(messageId) {
+		return nil, ErrInvalidId
+	}
+
+	root, err := cs.messages.Get(ctx, conversationId, messageId)
+	if err != nil {
+		return nil, err
+	} else if root.ParentId != nil {
+		return nil, ErrNestedThread
+	}
+	return root, nil
+}
+
+// sendReply stores reply, subscribing its sender and author of the root message to thread, then delivers it to
+// subscribers and notifies all members about new reply. Only storing errors are returned, reply is accepted once stored
+func (cs *ConversationService) sendReply(ctx context.Context, root *repository.DbMessage, msg *repository.DbMessage) error {
+	replyCount, err := cs.messages.InsertReply(ctx, msg)
+	if err != nil {
+		return err
+	}
+
+	err = cs.threads.SubscribeIfAbsent(ctx, root.Id, root.SenderId)
+	if err == nil {
+		err = cs.threads.SetSubscribed(ctx, root.Id, msg.SenderId, true)
+	}
+	if err != nil {
+		log.Printf("Error subscribing participants of thread: %s, err: %s\n", root.Id, err)
+	}
+
+	if err = cs.deliverReply(ctx, msg); err != nil {
+		log.Printf("Error delivering reply with id: %s, err: %s\n", msg.Id, err)
+	}
+
+	event := ThreadUpdatedEvent{ReplyCount: replyCount, LastReplyId: msg.Id, LastReplyAt: msg.SentAt.UTC()}
+	if err = cs.fanOutEvent(ctx, msg.ConversationId, root.Id, TypeThreadUpdated, event); err != nil {
+		log.Printf("Error delivering update of thread: %s, err: %s\n", root.Id, err)
+	}
+	return nil
+}
+
+func (cs *ConversationService) deliverReply(ctx context.Context, msg *repository.DbMessage) error {
+	subscriberIds, err := cs.threads.GetSubscriberIds(ctx, *msg.ParentId)
+	if err != nil {
+		return err
+	}
+
+	env, err := messageEnvelope(msg)
+	if err != nil {
+		return err
+	}
+	env.Origin = websocket.Origin(ctx)
+	data, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	return cs.publishToUsers(ctx, subscriberIds, data)
+}
@@ -0,0 +1,193 @@
+package chat
+
+import (
+	"context"
+	"log"
+	"online-chat-go/auth"
+	"online-chat-go/websocket"
+	"sync"
+	"time"
+)
+
+const TypeTyping = "typing"
+
+// TypingEvent is the payload of ephemeral typing frame delivered to conversation members, ExpiresAt tells
+// when members should consider user stopped typing unless they get another event
+type TypingEvent struct {
+	UserId    string     `json:"user_id"`
+	Typing    bool       `json:"typing"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+type typingKey struct {
+	userId         string
+	conversationId string
+}
+
+// typingState is kept for throttle interval after user stops typing, so start and stop transitions are
+// throttled as well. Typing is the actual state of user, published is the one members were told about,
+// change which could not be published due to throttle is published once interval elapses
+type typingState struct {
+	typing      bool
+	published   bool
+	publishedAt time.Time
+	expiresAt   time.Time
+	origin      string
+	timer       *time.Timer
+}
+
+// Typing publishes typing events of users to conversation members without storing them. Typing state of user
+// is published at most once per throttle interval, stop is published either by client request or once timeout elapses
+type Typing struct {
+	conversations *ConversationService
+	throttle      time.Duration
+	timeout       time.Duration
+
+	mut    sync.Mutex
+	states map[typingKey]*typingState
+}
+
+func NewTyping(conversations *ConversationService, throttle time.Duration, timeout time.Duration) *Typing {
+	return &Typing{
+		conversations: conversations,
+		throttle:      throttle,
+		timeout:       timeout,
+		states:        make(map[typingKey]*typingState),
+	}
+}
+
+func (t *Typing) Update(ctx context.Context, principal *auth.Principal, conversationId string, typing bool) error {
+	key := typingKey{userId: principal.Id, conversationId: conversationId}
+	t.mut.Lock()
+	state, known := t.states[key]
+	// membership is checked whenever user starts typing or typing would be published again, so member who was
+	// removed could not go on with typing state kept from before removal
+	check := typing && (!known || !state.typing || time.Since(state.publishedAt) >= t.throttle)
+	t.mut.Unlock()
+
+	if !known && !typing {
+		return nil
+	}
+	if check {
+		if err := t.conversations.CheckMember(ctx, key.userId, key.conversationId); err != nil {
+			t.forget(key)
+			return err
+		}
+	}
+
+	now := time.Now().UTC()
+	t.mut.Lock()
+	state, known = t.states[key]
+	if !known {
+		if !typing {
+			t.mut.Unlock()
+			return nil
+		}
+		state = &typingState{}
+		t.states[key] = state
+	} else if !typing && !state.typing {
+		t.mut.Unlock()
+		return nil
+	}
+
+	state.typing, state.origin = typing, websocket.Origin(ctx)
+	if typing {
+		state.expiresAt = now.Add(t.timeout)
+	}
+	// repeated start is published as well once interval elapses, so members learn about prolonged expiry
+	var event *TypingEvent
+	if now.Sub(state.publishedAt) >= t.throttle {
+		event = t.markPublished(key, state, now)
+	}
+	t.schedule(key, state, now)
+	t.mut.Unlock()
+
+	if event == nil {
+		return nil
+	}
+	return t.publish(ctx, key, *event)
+}
+
+// tick publishes change which was throttled, stops typing which was not prolonged before timeout and forgets
+// state of user who stopped typing once throttle interval is over
+func (t *Typing) tick(key typingKey, state *typingState) {
+	t.mut.Lock()
+	if t.states[key] != state {
+		t.mut.Unlock()
+		return
+	}
+
+	now := time.Now().UTC()
+	if state.typing && !now.Before(state.expiresAt) {
+		state.typing = false
+	}
+	var event *TypingEvent
+	if now.Sub(state.publishedAt) >= t.throttle {
+		if state.typing != state.published {
+			event = t.markPublished(key, state, now)
+		} else if !state.typing {
+			delete(t.states, key)
+			t.mut.Unlock()
+			return
+		}
+	}
+	t.schedule(key, state, now)
+	origin := state.origin
+	t.mut.Unlock()
+
+	if event == nil {
+		return
+	}
+	if err := t.publish(websocket.WithOrigin(context.Background(), origin), key, *event); err != nil {
+		log.Printf("Error publishing typing state of user: %s, err: %s\n", key.userId, err)
+	}
+}
+
+// forget drops state of user who is not member of conversation, members see published typing expire
+func (t *Typing) forget(key typingKey) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	if state, ok := t.states[key]; ok {
+		if state.timer != nil {
+			state.timer.Stop()
+		}
+		delete(t.states, key)
+	}
+}
+
+// markPublished should be called with mutex held, it returns event describing current state
+func (t *Typing) markPublished(key typingKey, state *typingState, now time.Time) *TypingEvent {
+	state.published, state.publishedAt = state.typing, now
+	event := &TypingEvent{UserId: key.userId, Typing: state.typing}
+	if state.typing {
+		expiresAt := state.expiresAt
+		event.ExpiresAt = &expiresAt
+	}
+	return event
+}
+
+// schedule should be called with mutex held, state is checked again either when pending change could be
+// published or when published typing expires
+func (t *Typing) schedule(key typingKey, state *typingState, now time.Time) {
+	next := state.publishedAt.Add(t.throttle)
+	if state.typing && state.published {
+		next = state.expiresAt
+	}
+
+	if state.timer == nil {
+		state.timer = time.AfterFunc(next.Sub(now), func() { t.tick(key, state) })
+	} else {
+		state.timer.Reset(next.Sub(now))
+	}
+}
+
+func (t *Typing) publish(ctx context.Context, key typingKey, event TypingEvent) error {
+	env, err := websocket.NewEnvelope(TypeTyping, event)
+	if err != nil {
+		return err
+	}
+	env.ConversationId = key.conversationId
+	env.Origin = websocket.Origin(ctx)
+	return t.conversations.FanOutEnvelope(ctx, key.conversationId, env)
+}
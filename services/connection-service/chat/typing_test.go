@@ -0,0 +1,89 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"online-chat-go/auth"
+	"online-chat-go/config"
+	"online-chat-go/db/repository"
+	"online-chat-go/notifications"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	typingUserId         = "00000000-0000-0000-0000-000000000001"
+	typingConversationId = "00000000-0000-0000-0000-000000000002"
+)
+
+// typingMembers tells whether user is member of conversation, membership could be changed by test
+type typingMembers struct {
+	repository.ConversationRepository
+	mut    sync.Mutex
+	member bool
+}
+
+func (m *typingMembers) setMember(member bool) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.member = member
+}
+
+func (m *typingMembers) IsMember(_ context.Context, _ string, _ string) (bool, error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	return m.member, nil
+}
+
+func (m *typingMembers) GetMemberIds(_ context.Context, _ string) ([]string, error) {
+	return []string{"member"}, nil
+}
+
+// countedBus counts messages published
+type countedBus struct {
+	notifications.NotificationBus
+	mut       sync.Mutex
+	published int
+}
+
+func (b *countedBus) Publish(_ context.Context, _ string, _ []byte) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	b.published++
+	return nil
+}
+
+func (b *countedBus) count() int {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	return b.published
+}
+
+func TestTypingChecksMembershipOnEveryStart(t *testing.T) {
+	members, bus := &typingMembers{member: true}, &countedBus{}
+	conversations := NewConversationService(members, nil, nil, nil, nil, bus, &config.ChatConfig{})
+	typing := NewTyping(conversations, 10*time.Millisecond, time.Minute)
+	principal := &auth.Principal{Id: typingUserId}
+
+	if err := typing.Update(context.Background(), principal, typingConversationId, true); err != nil {
+		t.Fatal(err)
+	}
+	if published := bus.count(); published != 1 {
+		t.Fatalf("published %d typing events, expected 1", published)
+	}
+
+	// member is removed while typing, start which would be published again is rejected
+	members.setMember(false)
+	time.Sleep(20 * time.Millisecond)
+	if err := typing.Update(context.Background(), principal, typingConversationId, true); !errors.Is(err, ErrNotMember) {
+		t.Fatalf("typing of removed member failed with err: %v, expected: %v", err, ErrNotMember)
+	}
+	if err := typing.Update(context.Background(), principal, typingConversationId, false); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if published := bus.count(); published != 1 {
+		t.Errorf("published %d typing events, expected 1", published)
+	}
+}
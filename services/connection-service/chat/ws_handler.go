@@ -0,0 +1,245 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"online-chat-go/db/repository"
+	"online-chat-go/websocket"
+	"time"
+)
+
+type SendMessagePayload struct {
+	Content     json.RawMessage `json:"content"`
+	ParentId    *string         `json:"parent_id,omitempty"`
+	Attachments []string        `json:"attachments,omitempty"`
+}
+
+// NewSendMessageHandler acknowledges every accepted message with server assigned id, so client may safely
+// resend unacknowledged messages with the same id after reconnect
+func NewSendMessageHandler(service *ConversationService) websocket.Handler {
+	return func(ctx context.Context, conn websocket.WSConnection, env *websocket.Envelope) error {
+		var payload SendMessagePayload
+		if err := env.DecodePayload(&payload); err != nil {
+			return websocket.ReplyNack(conn, env, err)
+		}
+		if env.Id == "" {
+			return websocket.ReplyNack(conn, env, websocket.NewProtocolError(websocket.ErrCodeInvalid, "Message id is required"))
+		}
+		if len(payload.Content) == 0 {
+			return websocket.ReplyNack(conn, env, websocket.NewProtocolError(websocket.ErrCodeInvalid, "Message content is required"))
+		}
+
+		sent, err := service.Send(ctx, conn.Principal(), env.ConversationId, payload.ParentId, env.Id, payload.Content, payload.Attachments)
+		if err != nil {
+			return websocket.ReplyNack(conn, env, ToProtocolError(err))
+		}
+
+		return websocket.ReplyAck(conn, env, websocket.AckPayload{
+			MessageId:       sent.MessageId,
+			ServerTimestamp: sent.SentAt,
+			Duplicate:       sent.Duplicate,
+		})
+	}
+}
+
+const TypeHistory = "history"
+
+// NewHistoryRequestHandler answers history request with history frame correlated with it
+func NewHistoryRequestHandler(service *ConversationService) websocket.Handler {
+	return func(ctx context.Context, conn websocket.WSConnection, env *websocket.Envelope) error {
+		var query HistoryQuery
+		if len(env.Payload) > 0 {
+			if err := env.DecodePayload(&query); err != nil {
+				return err
+			}
+		}
+
+		page, err := service.History(ctx, conn.Principal(), env.ConversationId, query)
+		if err != nil {
+			return ToProtocolError(err)
+		}
+		return websocket.Reply(conn, env, TypeHistory, page)
+	}
+}
+
+type TypingPayload struct {
+	Typing bool `json:"typing"`
+}
+
+// NewTypingHandler publishes typing events of client, they are ephemeral so no reply is sent
+func NewTypingHandler(typing *Typing) websocket.Handler {
+	return func(ctx context.Context, conn websocket.WSConnection, env *websocket.Envelope) error {
+		var payload TypingPayload
+		if err := env.DecodePayload(&payload); err != nil {
+			return err
+		}
+		return ToProtocolError(typing.Update(ctx, conn.Principal(), env.ConversationId, payload.Typing))
+	}
+}
+
+type ReadPayload struct {
+	MessageId string `json:"message_id"`
+}
+
+// NewReadHandler marks conversation read up to given message, request is acknowledged
+func NewReadHandler(receipts *Receipts) websocket.Handler {
+	return func(ctx context.Context, conn websocket.WSConnection, env *websocket.Envelope) error {
+		var payload ReadPayload
+		if err := env.DecodePayload(&payload); err != nil {
+			return err
+		}
+
+		if err := receipts.MarkRead(ctx, conn.Principal(), env.ConversationId, payload.MessageId); err != nil {
+			return ToProtocolError(err)
+		}
+		return websocket.ReplyAck(conn, env, websocket.AckPayload{MessageId: payload.MessageId, ServerTimestamp: time.Now().UTC()})
+	}
+}
+
+// NewSettingsRequestHandler updates personal conversation settings, replying with resulting settings
+func NewSettingsRequestHandler(service *ConversationService) websocket.Handler {
+	return func(ctx context.Context, conn websocket.WSConnection, env *websocket.Envelope) error {
+		var update SettingsUpdate
+		if err := env.DecodePayload(&update); err != nil {
+			return err
+		}
+
+		settings, err := service.UpdateSettings(ctx, conn.Principal(), env.ConversationId, update)
+		if err != nil {
+			return ToProtocolError(err)
+		}
+		return websocket.Reply(conn, env, TypeConversationSettings, settings)
+	}
+}
+
+type EditPayload struct {
+	MessageId string          `json:"message_id"`
+	Content   json.RawMessage `json:"content"`
+}
+
+type DeletePayload struct {
+	MessageId   string `json:"message_id"`
+	ForEveryone bool   `json:"for_everyone"`
+}
+
+// NewEditHandler replaces content of message, replying with message_edited frame correlated with request
+func NewEditHandler(service *ConversationService) websocket.Handler {
+	return func(ctx context.Context, conn websocket.WSConnection, env *websocket.Envelope) error {
+		var payload EditPayload
+		if err := env.DecodePayload(&payload); err != nil {
+			return err
+		}
+		if len(payload.Content) == 0 {
+			return websocket.NewProtocolError(websocket.ErrCodeInvalid, "Message content is required")
+		}
+
+		event, err := service.Edit(ctx, conn.Principal(), env.ConversationId, payload.MessageId, payload.Content)
+		if err != nil {
+			return ToProtocolError(err)
+		}
+		return websocket.Reply(conn, env, TypeMessageEdited, event)
+	}
+}
+
+// NewDeleteHandler deletes message for user or for everyone, replying with message_deleted frame correlated with request
+func NewDeleteHandler(service *ConversationService) websocket.Handler {
+	return func(ctx context.Context, conn websocket.WSConnection, env *websocket.Envelope) error {
+		var payload DeletePayload
+		if err := env.DecodePayload(&payload); err != nil {
+			return err
+		}
+
+		event, err := service.Delete(ctx, conn.Principal(), env.ConversationId, payload.MessageId, payload.ForEveryone)
+		if err != nil {
+			return ToProtocolError(err)
+		}
+		return websocket.Reply(conn, env, TypeMessageDeleted, event)
+	}
+}
+
+type ReactionPayload struct {
+	MessageId string `json:"message_id"`
+	Emoji     string `json:"emoji"`
+}
+
+// NewReactionHandler adds or removes reaction depending on message type it is registered for, request is acknowledged
+func NewReactionHandler(service *ConversationService) websocket.Handler {
+	return func(ctx context.Context, conn websocket.WSConnection, env *websocket.Envelope) error {
+		var payload ReactionPayload
+		if err := env.DecodePayload(&payload); err != nil {
+			return err
+		}
+
+		remove := env.Type == TypeReactionRemove
+		if err := service.React(ctx, conn.Principal(), env.ConversationId, payload.MessageId, payload.Emoji, remove); err != nil {
+			return ToProtocolError(err)
+		}
+		return websocket.ReplyAck(conn, env, websocket.AckPayload{MessageId: payload.MessageId, ServerTimestamp: time.Now().UTC()})
+	}
+}
+
+type ThreadQuery struct {
+	MessageId string `json:"message_id"`
+	HistoryQuery
+}
+
+type ThreadSubscriptionPayload struct {
+	MessageId string `json:"message_id"`
+}
+
+// NewThreadRequestHandler answers thread request with thread frame correlated with it
+func NewThreadRequestHandler(service *ConversationService) websocket.Handler {
+	return func(ctx context.Context, conn websocket.WSConnection, env *websocket.Envelope) error {
+		var query ThreadQuery
+		if err := env.DecodePayload(&query); err != nil {
+			return err
+		}
+
+		page, err := service.Thread(ctx, conn.Principal(), env.ConversationId, query.MessageId, query.HistoryQuery)
+		if err != nil {
+			return ToProtocolError(err)
+		}
+		return websocket.Reply(conn, env, TypeThread, page)
+	}
+}
+
+// NewThreadSubscriptionHandler subscribes to or unsubscribes from thread depending on message type
+// it is registered for, request is acknowledged
+func NewThreadSubscriptionHandler(service *ConversationService) websocket.Handler {
+	return func(ctx context.Context, conn websocket.WSConnection, env *websocket.Envelope) error {
+		var payload ThreadSubscriptionPayload
+		if err := env.DecodePayload(&payload); err != nil {
+			return err
+		}
+
+		subscribed := env.Type == TypeThreadSubscribe
+		if err := service.Subscribe(ctx, conn.Principal(), env.ConversationId, payload.MessageId, subscribed); err != nil {
+			return ToProtocolError(err)
+		}
+		return websocket.ReplyAck(conn, env, websocket.AckPayload{MessageId: payload.MessageId, ServerTimestamp: time.Now().UTC()})
+	}
+}
+
+// ToProtocolError maps chat errors to error codes reported to websocket clients
+func ToProtocolError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, ErrSendInProgress):
+		return &websocket.ProtocolError{Code: websocket.ErrCodeInProgress, Message: err.Error(), RetryAfter: commitWait}
+	case errors.Is(err, ErrInvalidId), errors.Is(err, ErrInvalidTitle), errors.Is(err, ErrSelfConversation),
+		errors.Is(err, ErrNotGroup), errors.Is(err, ErrInvalidHistoryQuery), errors.Is(err, ErrMessageDeleted),
+		errors.Is(err, ErrInvalidEmoji), errors.Is(err, repository.ErrReactionLimit), errors.Is(err, ErrNestedThread),
+		errors.Is(err, ErrAttachments), errors.Is(err, repository.ErrMembersLimit):
+		return websocket.NewProtocolError(websocket.ErrCodeInvalid, err.Error())
+	case errors.Is(err, ErrNotMember), errors.Is(err, ErrNotOwner), errors.Is(err, ErrNotAuthor),
+		errors.Is(err, ErrEditWindowExpired):
+		return websocket.NewProtocolError(websocket.ErrCodeForbidden, err.Error())
+	case errors.Is(err, repository.ErrConversationNotFound), errors.Is(err, repository.ErrUserNotFound),
+		errors.Is(err, repository.ErrMessageNotFound), errors.Is(err, repository.ErrAttachmentNotFound):
+		return websocket.NewProtocolError(websocket.ErrCodeNotFound, err.Error())
+	default:
+		return err
+	}
+}
@@ -1,7 +1,10 @@
 package config
 
 import (
+	"compress/flate"
 	"errors"
+	"fmt"
+	"github.com/google/uuid"
 	"github.com/spf13/viper"
 	"log"
 	"time"
@@ -11,10 +14,32 @@ type Config struct {
 	App             AppConfig
 	Ws              WsConfig
 	NotificationBus NotificationBusConfig `mapstructure:"notification-bus"`
+	Auth            AuthConfig
+	Db              DbConfig
+	Chat            ChatConfig
+	Presence        PresenceConfig
+	Attachments     AttachmentsConfig
+	RateLimit       RateLimitConfig `mapstructure:"rate-limit"`
 }
 
+// AppConfig DrainPeriod is the time clients are given to reconnect elsewhere on shutdown before their
+// connections are closed. MetricsPort serves /debug/vars separately from public api, so it could be kept
+// internal, zero disables it
 type AppConfig struct {
-	Port int
+	Port        int
+	MetricsPort int           `mapstructure:"metrics-port"`
+	DrainPeriod time.Duration `mapstructure:"drain-period"`
+}
+
+func (ac *AppConfig) validate() error {
+	if ac.DrainPeriod < 0 {
+		return errors.New("Drain period should not be negative")
+	}
+	if ac.MetricsPort < 0 || ac.MetricsPort == ac.Port {
+		return errors.New("Metrics port should not be negative and should differ from app port")
+	}
+
+	return nil
 }
 
 type WsConfig struct {
@@ -22,6 +47,62 @@ type WsConfig struct {
 	PingInterval time.Duration `mapstructure:"ping-interval"`
 	ReadLimit    int64         `mapstructure:"read-limit"`
 	BufferSize   int64         `mapstructure:"buffer-size"`
+	SlowConsumer string        `mapstructure:"slow-consumer"`
+	Compression  CompressionConfig
+	// MaxConnections limits connections of instance, MaxUserConnections limits connections of user to instance,
+	// zero means no limit. UserLimitPolicy decides whether new connection of user evicts the oldest one or is rejected
+	MaxConnections     int    `mapstructure:"max-connections"`
+	MaxUserConnections int    `mapstructure:"max-user-connections"`
+	UserLimitPolicy    string `mapstructure:"user-limit-policy"`
+}
+
+const (
+	UserLimitEvictOldest = "evict-oldest"
+	UserLimitReject      = "reject"
+)
+
+// Slow consumer policies decide what happens to keyed message, such as typing or presence, sent to connection
+// whose queue of buffer-size messages is full. Drop oldest drops the oldest queued keyed message, coalesce replaces
+// queued message superseded by the new one and disconnects if there is none. Messages without key, such as chat
+// messages, are never dropped, connection is closed instead so client catches up on reconnect
+const (
+	SlowConsumerDropOldest = "drop-oldest"
+	SlowConsumerDropNewest = "drop-newest"
+	SlowConsumerCoalesce   = "coalesce"
+	SlowConsumerDisconnect = "disconnect"
+)
+
+// CompressionConfig Level is deflate level from 1 (best speed) to 9 (best compression), data messages
+// shorter than MinSize bytes are sent uncompressed
+type CompressionConfig struct {
+	Enabled bool
+	Level   int
+	MinSize int `mapstructure:"min-size"`
+}
+
+func (wc *WsConfig) validate() error {
+	if wc.BufferSize <= 0 {
+		return errors.New("Websocket buffer size should be positive")
+	}
+	switch wc.SlowConsumer {
+	case SlowConsumerDropOldest, SlowConsumerDropNewest, SlowConsumerCoalesce, SlowConsumerDisconnect:
+	default:
+		return fmt.Errorf("Unknown slow consumer policy: %s", wc.SlowConsumer)
+	}
+	if wc.Compression.Enabled && (wc.Compression.Level < flate.BestSpeed || wc.Compression.Level > flate.BestCompression) {
+		return errors.New("Compression level should be from 1 to 9")
+	}
+	if wc.Compression.MinSize < 0 {
+		return errors.New("Compression min size should not be negative")
+	}
+	if wc.MaxConnections < 0 || wc.MaxUserConnections < 0 {
+		return errors.New("Max connections should not be negative")
+	}
+	if wc.UserLimitPolicy != UserLimitEvictOldest && wc.UserLimitPolicy != UserLimitReject {
+		return fmt.Errorf("Unknown user connections limit policy: %s", wc.UserLimitPolicy)
+	}
+
+	return nil
 }
 
 type NotificationBusConfig struct {
@@ -52,6 +133,248 @@ func (rc *RedisConfig) validate() error {
 	return nil
 }
 
+const (
+	JwtAuthorizer    = "jwt"
+	CookieAuthorizer = "cookie"
+	ApiKeyAuthorizer = "api-key"
+	DummyAuthorizer  = "dummy"
+)
+
+type AuthConfig struct {
+	Authorizers []string
+	Jwt         JwtConfig
+	Cookie      CookieConfig
+	ApiKey      ApiKeyConfig `mapstructure:"api-key"`
+	Dummy       DummyConfig
+}
+
+// DummyConfig UserId is id of existing user every request is authorized as
+type DummyConfig struct {
+	UserId string `mapstructure:"user-id"`
+}
+
+func (ac *AuthConfig) validate() error {
+	if len(ac.Authorizers) == 0 {
+		return errors.New("No defined authorizers, should be at least one of jwt, cookie, api-key or dummy")
+	}
+
+	for _, name := range ac.Authorizers {
+		switch name {
+		case JwtAuthorizer, CookieAuthorizer, ApiKeyAuthorizer:
+		case DummyAuthorizer:
+			if _, err := uuid.Parse(ac.Dummy.UserId); err != nil {
+				return errors.New("Dummy authorizer user id should be valid uuid")
+			}
+		default:
+			return fmt.Errorf("Unknown authorizer: %s", name)
+		}
+	}
+
+	if ac.Cookie.Name == "" {
+		return errors.New("No defined session cookie name")
+	}
+	if ac.ApiKey.Header == "" {
+		return errors.New("No defined api key header")
+	}
+
+	return ac.Jwt.validate()
+}
+
+// CookieConfig AllowedOrigins are origins of pages allowed to send requests authorized by session cookie,
+// browsers attach it to requests of pages on other origins of the same site as well
+type CookieConfig struct {
+	Name           string
+	Secure         bool
+	AllowedOrigins []string `mapstructure:"allowed-origins"`
+}
+
+type ApiKeyConfig struct {
+	Header string
+}
+
+type JwtConfig struct {
+	Secret         string `json:"-"` // lets anyone sign tokens, so it is left out of printed config
+	PublicKeyFile  string `mapstructure:"public-key-file"`
+	PrivateKeyFile string `mapstructure:"private-key-file"`
+	JwksFile       string `mapstructure:"jwks-file"`
+	Issuer         string
+	Audience       string
+	Leeway         time.Duration
+	TokenTtl       time.Duration `mapstructure:"token-ttl"`
+}
+
+func (jc *JwtConfig) validate() error {
+	if jc.Secret == "" && jc.PublicKeyFile == "" && jc.JwksFile == "" {
+		return errors.New("No defined signing keys for jwt, should be at least one of secret, public-key-file or jwks-file")
+	}
+
+	return nil
+}
+
+type ChatConfig struct {
+	DedupWindow  time.Duration `mapstructure:"dedup-window"`
+	EditWindow   time.Duration `mapstructure:"edit-window"`
+	MaxReplay    int           `mapstructure:"max-replay"`
+	MaxReactions int           `mapstructure:"max-reactions"`
+	// MaxReplayBuffer limits live messages held for connection while it is replaying, client which does not keep up
+	// is disconnected once it is exceeded and catches up from its cursor on reconnect
+	MaxReplayBuffer int `mapstructure:"max-replay-buffer"`
+	// MaxGroupMembers limits members of group conversation, owner included
+	MaxGroupMembers int `mapstructure:"max-group-members"`
+	Typing          TypingConfig
+}
+
+// TypingConfig Throttle is the minimal interval between typing events of user in conversation,
+// Timeout is the time after which user is considered to stop typing if client does not tell so
+type TypingConfig struct {
+	Throttle time.Duration
+	Timeout  time.Duration
+}
+
+func (cc *ChatConfig) validate() error {
+	if cc.DedupWindow <= 0 {
+		return errors.New("Deduplication window should be positive")
+	}
+	if cc.EditWindow <= 0 {
+		return errors.New("Edit window should be positive")
+	}
+	if cc.MaxReplay <= 0 {
+		return errors.New("Max replayed messages count should be positive")
+	}
+	if cc.MaxReactions <= 0 {
+		return errors.New("Max reactions count should be positive")
+	}
+	if cc.MaxReplayBuffer <= 0 {
+		return errors.New("Max replay buffer size should be positive")
+	}
+	if cc.MaxGroupMembers < 2 {
+		return errors.New("Max group members count should be at least 2")
+	}
+	if cc.Typing.Throttle <= 0 || cc.Typing.Timeout <= cc.Typing.Throttle {
+		return errors.New("Typing throttle should be positive and less than typing timeout")
+	}
+
+	return nil
+}
+
+type DbConfig struct {
+	Url string
+}
+
+func (dc *DbConfig) validate() error {
+	if dc.Url == "" {
+		return errors.New("No defined url for database")
+	}
+
+	return nil
+}
+
+// PresenceConfig Ttl is the time after which presence of instance which stopped sending heartbeats is discarded
+type PresenceConfig struct {
+	Ttl time.Duration
+}
+
+func (pc *PresenceConfig) validate() error {
+	if pc.Ttl <= 0 {
+		return errors.New("Presence ttl should be positive")
+	}
+	return nil
+}
+
+const LocalBlobStore = "local"
+
+// AttachmentsConfig MaxSize is the limit of uploaded file size in bytes, ThumbnailSize is the limit of thumbnail
+// width and height in pixels, download urls are signed with Secret and expire after UrlTtl, attachments which
+// were not sent within OrphanTtl are purged
+type AttachmentsConfig struct {
+	Store         string
+	Dir           string
+	MaxSize       int64         `mapstructure:"max-size"`
+	ThumbnailSize int           `mapstructure:"thumbnail-size"`
+	Secret        string        `json:"-"` // lets anyone sign download urls, so it is left out of printed config
+	UrlTtl        time.Duration `mapstructure:"url-ttl"`
+	OrphanTtl     time.Duration `mapstructure:"orphan-ttl"`
+}
+
+func (ac *AttachmentsConfig) validate() error {
+	if ac.Store != LocalBlobStore {
+		return fmt.Errorf("Unknown attachments store: %s", ac.Store)
+	}
+	if ac.Dir == "" {
+		return errors.New("No defined directory for attachments")
+	}
+	if ac.MaxSize <= 0 || ac.ThumbnailSize <= 0 {
+		return errors.New("Attachment max size and thumbnail size should be positive")
+	}
+	if ac.Secret == "" {
+		return errors.New("No defined secret for signing attachment urls")
+	}
+	if ac.UrlTtl <= 0 || ac.OrphanTtl <= 0 {
+		return errors.New("Attachment url ttl and orphan ttl should be positive")
+	}
+	return nil
+}
+
+// RateLimitConfig limits inbound frames. Connection limit applies to every frame of single connection and is
+// enforced by instance, User limit applies to every frame of user and Types limits to frames of given type sent
+// by user, they are enforced over all instances via Redis. Limits of user are multiplied by the largest multiplier
+// of its Roles. Connection is closed once it exceeds limits MaxViolations times within ViolationWindow.
+// Upgrade limits websocket handshakes per client address, which is read from ClientIpHeader if instance is
+// behind proxy, the last address of header is used as it is the one added by proxy
+type RateLimitConfig struct {
+	Upgrade         RateConfig
+	ClientIpHeader  string `mapstructure:"client-ip-header"`
+	Connection      RateConfig
+	User            RateConfig
+	Types           map[string]RateConfig
+	Roles           map[string]float64
+	MaxViolations   int           `mapstructure:"max-violations"`
+	ViolationWindow time.Duration `mapstructure:"violation-window"`
+	Redis           RedisInstanceConfig
+}
+
+// RateConfig Rate is the number of frames per second, Burst is the number of frames which could be sent at once
+type RateConfig struct {
+	Rate  float64
+	Burst int
+}
+
+func (rc *RateConfig) validate() error {
+	if rc.Rate <= 0 || rc.Burst <= 0 {
+		return errors.New("Rate limit rate and burst should be positive")
+	}
+	return nil
+}
+
+func (rc *RateLimitConfig) validate() error {
+	if err := rc.Upgrade.validate(); err != nil {
+		return err
+	}
+	if err := rc.Connection.validate(); err != nil {
+		return err
+	}
+	if err := rc.User.validate(); err != nil {
+		return err
+	}
+	for msgType, rate := range rc.Types {
+		if err := rate.validate(); err != nil {
+			return fmt.Errorf("Invalid rate limit of message type %s: %w", msgType, err)
+		}
+	}
+	for role, multiplier := range rc.Roles {
+		if multiplier <= 0 {
+			return fmt.Errorf("Rate limit multiplier of role %s should be positive", role)
+		}
+	}
+	if rc.MaxViolations <= 0 || rc.ViolationWindow <= 0 {
+		return errors.New("Rate limit max violations and violation window should be positive")
+	}
+	if rc.Redis.Host == "" {
+		return errors.New("No defined redis host for rate limits")
+	}
+	return nil
+}
+
 type ConsulConfig struct {
 	Host             string
 	Port             int
@@ -84,8 +407,32 @@ func readFromConfigFile() {
 }
 
 func validateConfig(config Config) error {
+	if err := config.App.validate(); err != nil {
+		return err
+	}
+	if err := config.Ws.validate(); err != nil {
+		return err
+	}
 	if err := config.NotificationBus.Redis.validate(); err != nil {
 		return err
 	}
+	if err := config.Auth.validate(); err != nil {
+		return err
+	}
+	if err := config.Db.validate(); err != nil {
+		return err
+	}
+	if err := config.Chat.validate(); err != nil {
+		return err
+	}
+	if err := config.Presence.validate(); err != nil {
+		return err
+	}
+	if err := config.Attachments.validate(); err != nil {
+		return err
+	}
+	if err := config.RateLimit.validate(); err != nil {
+		return err
+	}
 	return nil
 }
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS revoked_sessions
+(
+    session_id TEXT PRIMARY KEY,
+    user_id    TEXT        NOT NULL,
+    expires_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX revoked_sessions_expires_at_idx ON revoked_sessions (expires_at);
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS api_keys
+(
+    id           UUID PRIMARY KEY     DEFAULT gen_random_uuid(),
+    key_hash     BYTEA UNIQUE NOT NULL,
+    name         TEXT         NOT NULL,
+    principal_id TEXT         NOT NULL,
+    roles        TEXT[]       NOT NULL DEFAULT '{}',
+    scopes       TEXT[]       NOT NULL DEFAULT '{}',
+    expires_at   TIMESTAMPTZ,
+    revoked_at   TIMESTAMPTZ,
+    created_at   TIMESTAMPTZ  NOT NULL DEFAULT now()
+);
@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS conversations
+(
+    id         UUID PRIMARY KEY     DEFAULT gen_random_uuid(),
+    kind       TEXT        NOT NULL CHECK (kind IN ('direct', 'group')),
+    title      TEXT,
+    direct_key TEXT UNIQUE,
+    created_by UUID        NOT NULL REFERENCES users (id),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CHECK ((kind = 'direct') = (direct_key IS NOT NULL))
+);
+
+CREATE TABLE IF NOT EXISTS conversation_members
+(
+    conversation_id UUID        NOT NULL REFERENCES conversations (id) ON DELETE CASCADE,
+    user_id         UUID        NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    role            TEXT        NOT NULL DEFAULT 'member' CHECK (role IN ('owner', 'member')),
+    joined_at       TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (conversation_id, user_id)
+);
+
+CREATE INDEX conversation_members_user_id_idx ON conversation_members (user_id);
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS message_deduplication
+(
+    user_id    TEXT        NOT NULL,
+    client_id  TEXT        NOT NULL,
+    message_id UUID        NOT NULL,
+    sent_at    TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (user_id, client_id)
+);
+
+CREATE INDEX message_deduplication_sent_at_idx ON message_deduplication (sent_at);
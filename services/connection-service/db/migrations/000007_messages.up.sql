@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS messages
+(
+    id              UUID PRIMARY KEY,
+    seq             BIGSERIAL UNIQUE NOT NULL,
+    conversation_id UUID             NOT NULL REFERENCES conversations (id) ON DELETE CASCADE,
+    sender_id       UUID             NOT NULL REFERENCES users (id),
+    client_id       TEXT,
+    content         JSONB            NOT NULL,
+    sent_at         TIMESTAMPTZ      NOT NULL
+);
+
+CREATE INDEX messages_conversation_id_seq_idx ON messages (conversation_id, seq);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS delivery_cursors
+(
+    user_id    UUID        NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    device_id  TEXT        NOT NULL,
+    last_seq   BIGINT      NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, device_id)
+);
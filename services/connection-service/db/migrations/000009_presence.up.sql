@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS presence_sessions
+(
+    user_id      UUID        NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    instance_id  UUID        NOT NULL,
+    away         BOOLEAN     NOT NULL DEFAULT FALSE,
+    heartbeat_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, instance_id)
+);
+
+CREATE INDEX presence_sessions_instance_id_idx ON presence_sessions (instance_id);
+CREATE INDEX presence_sessions_heartbeat_at_idx ON presence_sessions (heartbeat_at);
+
+CREATE TABLE IF NOT EXISTS user_last_seen
+(
+    user_id      UUID PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+    last_seen_at TIMESTAMPTZ NOT NULL
+);
@@ -0,0 +1,3 @@
+ALTER TABLE conversation_members
+    ADD COLUMN IF NOT EXISTS delivered_seq BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS read_seq      BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,3 @@
+ALTER TABLE conversation_members
+    ADD COLUMN IF NOT EXISTS muted    BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD COLUMN IF NOT EXISTS archived BOOLEAN NOT NULL DEFAULT FALSE;
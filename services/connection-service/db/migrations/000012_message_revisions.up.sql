@@ -0,0 +1,24 @@
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS edited_at  TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS deleted_by UUID REFERENCES users (id) ON DELETE SET NULL;
+
+-- previous contents of edited messages, removed once message is deleted
+CREATE TABLE IF NOT EXISTS message_revisions
+(
+    id          BIGSERIAL PRIMARY KEY,
+    message_id  UUID        NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+    content     JSONB       NOT NULL,
+    replaced_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX message_revisions_message_id_idx ON message_revisions (message_id);
+
+-- messages deleted by user only for themselves
+CREATE TABLE IF NOT EXISTS hidden_messages
+(
+    user_id    UUID        NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    message_id UUID        NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+    hidden_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, message_id)
+);
@@ -0,0 +1,18 @@
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS parent_id     UUID REFERENCES messages (id) ON DELETE CASCADE,
+    ADD COLUMN IF NOT EXISTS reply_count   INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS last_reply_id UUID,
+    ADD COLUMN IF NOT EXISTS last_reply_at TIMESTAMPTZ;
+
+CREATE INDEX messages_parent_id_seq_idx ON messages (parent_id, seq) WHERE parent_id IS NOT NULL;
+
+-- users who get live replies of thread, participants are subscribed automatically but could opt out
+CREATE TABLE IF NOT EXISTS thread_subscriptions
+(
+    message_id UUID    NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+    user_id    UUID    NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    subscribed BOOLEAN NOT NULL,
+    PRIMARY KEY (message_id, user_id)
+);
+
+CREATE INDEX thread_subscriptions_user_id_idx ON thread_subscriptions (user_id);
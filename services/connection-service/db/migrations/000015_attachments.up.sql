@@ -0,0 +1,23 @@
+-- attachments are uploaded to conversation before message referencing them is sent, contents are kept in blob store
+CREATE TABLE IF NOT EXISTS attachments
+(
+    id              UUID PRIMARY KEY,
+    conversation_id UUID        NOT NULL REFERENCES conversations (id) ON DELETE CASCADE,
+    uploader_id     UUID        NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    message_id      UUID REFERENCES messages (id) ON DELETE SET NULL,
+    filename        TEXT        NOT NULL,
+    content_type    TEXT        NOT NULL,
+    size            BIGINT      NOT NULL,
+    width           INTEGER,
+    height          INTEGER,
+    has_thumbnail   BOOLEAN     NOT NULL DEFAULT FALSE,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+    deleted_at      TIMESTAMPTZ
+);
+
+CREATE INDEX attachments_message_id_idx ON attachments (message_id);
+-- attachments which were never sent or whose message was deleted are purged along with their blobs
+CREATE INDEX attachments_purge_idx ON attachments (created_at) WHERE message_id IS NULL OR deleted_at IS NOT NULL;
+
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS attachment_ids UUID[] NOT NULL DEFAULT '{}';
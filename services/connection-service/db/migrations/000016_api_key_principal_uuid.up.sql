@@ -0,0 +1,3 @@
+-- principals of api keys act as users, so their ids should be ids of users
+ALTER TABLE api_keys
+    ALTER COLUMN principal_id TYPE UUID USING principal_id::UUID;
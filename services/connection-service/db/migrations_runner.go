@@ -1,12 +1,18 @@
 package db
 
 import (
+	"embed"
 	"github.com/golang-migrate/migrate/v4"
 	_ "github.com/golang-migrate/migrate/v4/database/postgres"
 	"github.com/golang-migrate/migrate/v4/source/iofs"
 	"io/fs"
 )
 
+//go:embed migrations/*.sql
+var Migrations embed.FS
+
+const MigrationsPath = "migrations"
+
 func RunMigrations(fs fs.FS, path string, dbUrl string) error {
 	driver, err := iofs.New(fs, path)
 	if err != nil {
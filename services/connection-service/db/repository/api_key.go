@@ -0,0 +1,53 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+var ErrApiKeyNotFound = errors.New("Api key not found")
+
+type DbApiKey struct {
+	Id          string
+	Name        string
+	PrincipalId string
+	Roles       []string
+	Scopes      []string
+	ExpiresAt   *time.Time
+}
+
+type ApiKeyRepository interface {
+	GetActiveByHash(ctx context.Context, keyHash []byte) (*DbApiKey, error)
+}
+
+type PgApiKeyRepository struct {
+	pool *pgxpool.Pool
+}
+
+func NewPgApiKeyRepository(pool *pgxpool.Pool) *PgApiKeyRepository {
+	return &PgApiKeyRepository{pool: pool}
+}
+
+func (pg *PgApiKeyRepository) GetActiveByHash(ctx context.Context, keyHash []byte) (*DbApiKey, error) {
+	const query = `SELECT id, name, principal_id, roles, scopes, expires_at
+				   FROM api_keys k
+				   WHERE k.key_hash = $1
+				     AND k.revoked_at IS NULL
+				     AND (k.expires_at IS NULL OR k.expires_at > now())`
+	rows, err := pg.pool.Query(ctx, query, keyHash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := pgx.CollectOneRow(rows, pgx.RowToStructByPos[DbApiKey])
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrApiKeyNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
@@ -0,0 +1,129 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+var ErrAttachmentNotFound = errors.New("Attachment not found")
+
+type DbAttachment struct {
+	Id             string
+	ConversationId string
+	UploaderId     string
+	MessageId      *string
+	Filename       string
+	ContentType    string
+	Size           int64
+	Width          *int
+	Height         *int
+	HasThumbnail   bool
+	CreatedAt      time.Time
+	DeletedAt      *time.Time
+}
+
+type AttachmentRepository interface {
+	Insert(ctx context.Context, attachment *DbAttachment) error
+	// Get returns attachment unless it was deleted
+	Get(ctx context.Context, id string) (*DbAttachment, error)
+	// SetThumbnail marks attachment as having thumbnail, it returns false if attachment was deleted or removed
+	SetThumbnail(ctx context.Context, id string) (bool, error)
+	// ListVisible returns attachments of conversation which are either sent or uploaded by user, in order of ids
+	ListVisible(ctx context.Context, userId string, conversationId string, ids []string) ([]DbAttachment, error)
+	// ListPurgeable returns ids of deleted attachments and of the ones which were not sent until given time
+	ListPurgeable(ctx context.Context, uploadedBefore time.Time, limit int) ([]string, error)
+	// Remove removes attachments which are still purgeable, returning ids of removed ones
+	Remove(ctx context.Context, ids []string, uploadedBefore time.Time) ([]string, error)
+}
+
+type PgAttachmentRepository struct {
+	pool *pgxpool.Pool
+}
+
+func NewPgAttachmentRepository(pool *pgxpool.Pool) *PgAttachmentRepository {
+	return &PgAttachmentRepository{pool: pool}
+}
+
+const attachmentColumns = "a.id, a.conversation_id, a.uploader_id, a.message_id, a.filename, a.content_type, a.size, " +
+	"a.width, a.height, a.has_thumbnail, a.created_at, a.deleted_at"
+
+func (pg *PgAttachmentRepository) Insert(ctx context.Context, attachment *DbAttachment) error {
+	const query = `INSERT INTO attachments (id, conversation_id, uploader_id, filename, content_type, size, width, height,
+				                           has_thumbnail)
+				   VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+				   RETURNING created_at`
+	return pg.pool.QueryRow(ctx, query, attachment.Id, attachment.ConversationId, attachment.UploaderId, attachment.Filename,
+		attachment.ContentType, attachment.Size, attachment.Width, attachment.Height, attachment.HasThumbnail).
+		Scan(&attachment.CreatedAt)
+}
+
+func (pg *PgAttachmentRepository) Get(ctx context.Context, id string) (*DbAttachment, error) {
+	const query = `SELECT ` + attachmentColumns + `
+				   FROM attachments a
+				   WHERE a.id = $1 AND a.deleted_at IS NULL`
+	rows, err := pg.pool.Query(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+
+	attachment, err := pgx.CollectOneRow(rows, pgx.RowToStructByPos[DbAttachment])
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrAttachmentNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &attachment, nil
+}
+
+func (pg *PgAttachmentRepository) SetThumbnail(ctx context.Context, id string) (bool, error) {
+	const query = `UPDATE attachments
+				   SET has_thumbnail = TRUE
+				   WHERE id = $1 AND deleted_at IS NULL`
+	tag, err := pg.pool.Exec(ctx, query, id)
+	return tag.RowsAffected() > 0, err
+}
+
+func (pg *PgAttachmentRepository) ListVisible(ctx context.Context, userId string, conversationId string, ids []string) ([]DbAttachment, error) {
+	const query = `SELECT ` + attachmentColumns + `
+				   FROM unnest($3::UUID[]) WITH ORDINALITY AS i(id, position)
+				   JOIN attachments a ON a.id = i.id
+				   WHERE a.conversation_id = $2 AND a.deleted_at IS NULL
+				     AND (a.message_id IS NOT NULL OR a.uploader_id = $1)
+				   ORDER BY i.position`
+	rows, err := pg.pool.Query(ctx, query, userId, conversationId, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[DbAttachment])
+}
+
+func (pg *PgAttachmentRepository) ListPurgeable(ctx context.Context, uploadedBefore time.Time, limit int) ([]string, error) {
+	const query = `SELECT a.id
+				   FROM attachments a
+				   WHERE a.deleted_at IS NOT NULL OR (a.message_id IS NULL AND a.created_at < $1)
+				   LIMIT $2`
+	rows, err := pg.pool.Query(ctx, query, uploadedBefore, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+func (pg *PgAttachmentRepository) Remove(ctx context.Context, ids []string, uploadedBefore time.Time) ([]string, error) {
+	// attachment could be sent after it was listed, such one is kept
+	const query = `DELETE FROM attachments a
+				   WHERE a.id = ANY($1::UUID[])
+				     AND (a.deleted_at IS NOT NULL OR (a.message_id IS NULL AND a.created_at < $2))
+				   RETURNING a.id`
+	rows, err := pg.pool.Query(ctx, query, ids, uploadedBefore)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
@@ -0,0 +1,321 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	ConversationDirect = "direct"
+	ConversationGroup  = "group"
+
+	MemberRoleOwner  = "owner"
+	MemberRoleMember = "member"
+)
+
+var (
+	ErrConversationNotFound = errors.New("Conversation not found")
+	ErrMembersLimit         = errors.New("Conversation has reached its members limit")
+)
+
+type DbConversation struct {
+	Id        string
+	Kind      string
+	Title     *string
+	CreatedBy string
+	CreatedAt time.Time
+}
+
+// DbMemberConversation is conversation as seen by one of its members, along with member's own settings
+type DbMemberConversation struct {
+	Id        string
+	Kind      string
+	Title     *string
+	CreatedBy string
+	CreatedAt time.Time
+	Muted     bool
+	Archived  bool
+}
+
+type DbMemberSettings struct {
+	Muted    bool
+	Archived bool
+}
+
+type DbConversationMember struct {
+	UserId   string
+	Role     string
+	JoinedAt time.Time
+}
+
+type ConversationRepository interface {
+	CreateDirect(ctx context.Context, creatorId string, peerId string) (*DbConversation, error)
+	CreateGroup(ctx context.Context, creatorId string, title string, memberIds []string) (*DbConversation, error)
+	GetById(ctx context.Context, id string) (*DbConversation, error)
+	ListByMember(ctx context.Context, userId string) ([]DbMemberConversation, error)
+	GetMembers(ctx context.Context, id string) ([]DbConversationMember, error)
+	GetMemberIds(ctx context.Context, id string) ([]string, error)
+	// GetContactIds returns ids of users sharing at least one conversation with given user
+	GetContactIds(ctx context.Context, userId string) ([]string, error)
+	IsMember(ctx context.Context, id string, userId string) (bool, error)
+	// AddMember fails with ErrMembersLimit if conversation already has maxMembers other members,
+	// adding existing member does nothing
+	AddMember(ctx context.Context, id string, userId string, maxMembers int) error
+	// RemoveMember passes ownership to the longest standing member once the last owner leaves
+	RemoveMember(ctx context.Context, id string, userId string) error
+	// UpdateSettings changes only settings which are not nil, returns resulting settings
+	UpdateSettings(ctx context.Context, id string, userId string, muted *bool, archived *bool) (*DbMemberSettings, error)
+}
+
+type PgConversationRepository struct {
+	pool *pgxpool.Pool
+}
+
+func NewPgConversationRepository(pool *pgxpool.Pool) *PgConversationRepository {
+	return &PgConversationRepository{pool: pool}
+}
+
+// CreateDirect returns already existing direct conversation between two users if there is one
+func (pg *PgConversationRepository) CreateDirect(ctx context.Context, creatorId string, peerId string) (*DbConversation, error) {
+	const insertQuery = `INSERT INTO conversations (kind, direct_key, created_by)
+						 VALUES ('direct', $1, $2)
+						 ON CONFLICT (direct_key) DO NOTHING
+						 RETURNING id, kind, title, created_by, created_at`
+	const selectQuery = `SELECT id, kind, title, created_by, created_at
+						 FROM conversations c
+						 WHERE c.direct_key = $1`
+
+	var conversation DbConversation
+	err := pgx.BeginFunc(ctx, pg.pool, func(tx pgx.Tx) error {
+		key := directKey(creatorId, peerId)
+		rows, err := tx.Query(ctx, insertQuery, key, creatorId)
+		if err != nil {
+			return err
+		}
+
+		conversation, err = pgx.CollectOneRow(rows, pgx.RowToStructByPos[DbConversation])
+		if errors.Is(err, pgx.ErrNoRows) {
+			if rows, err = tx.Query(ctx, selectQuery, key); err != nil {
+				return err
+			}
+			conversation, err = pgx.CollectOneRow(rows, pgx.RowToStructByPos[DbConversation])
+			return err
+		} else if err != nil {
+			return err
+		}
+
+		return insertMembers(ctx, tx, conversation.Id, MemberRoleMember, []string{creatorId, peerId})
+	})
+
+	if isForeignKeyViolation(err) {
+		return nil, ErrUserNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &conversation, nil
+}
+
+func (pg *PgConversationRepository) CreateGroup(ctx context.Context, creatorId string, title string, memberIds []string) (*DbConversation, error) {
+	const query = `INSERT INTO conversations (kind, title, created_by)
+				   VALUES ('group', $1, $2)
+				   RETURNING id, kind, title, created_by, created_at`
+
+	var conversation DbConversation
+	err := pgx.BeginFunc(ctx, pg.pool, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, query, title, creatorId)
+		if err != nil {
+			return err
+		}
+		if conversation, err = pgx.CollectOneRow(rows, pgx.RowToStructByPos[DbConversation]); err != nil {
+			return err
+		}
+
+		if err = insertMembers(ctx, tx, conversation.Id, MemberRoleOwner, []string{creatorId}); err != nil {
+			return err
+		}
+		return insertMembers(ctx, tx, conversation.Id, MemberRoleMember, memberIds)
+	})
+
+	if isForeignKeyViolation(err) {
+		return nil, ErrUserNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &conversation, nil
+}
+
+func (pg *PgConversationRepository) GetById(ctx context.Context, id string) (*DbConversation, error) {
+	const query = "SELECT id, kind, title, created_by, created_at FROM conversations c WHERE c.id = $1"
+	rows, err := pg.pool.Query(ctx, query, id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	conversation, err := pgx.CollectOneRow(rows, pgx.RowToStructByPos[DbConversation])
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrConversationNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &conversation, nil
+}
+
+func (pg *PgConversationRepository) ListByMember(ctx context.Context, userId string) ([]DbMemberConversation, error) {
+	const query = `SELECT c.id, c.kind, c.title, c.created_by, c.created_at, m.muted, m.archived
+				   FROM conversations c
+				   JOIN conversation_members m ON m.conversation_id = c.id
+				   WHERE m.user_id = $1
+				   ORDER BY c.created_at DESC`
+	rows, err := pg.pool.Query(ctx, query, userId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[DbMemberConversation])
+}
+
+func (pg *PgConversationRepository) GetMembers(ctx context.Context, id string) ([]DbConversationMember, error) {
+	const query = `SELECT user_id, role, joined_at
+				   FROM conversation_members m
+				   WHERE m.conversation_id = $1
+				   ORDER BY m.joined_at`
+	rows, err := pg.pool.Query(ctx, query, id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[DbConversationMember])
+}
+
+func (pg *PgConversationRepository) GetMemberIds(ctx context.Context, id string) ([]string, error) {
+	const query = "SELECT user_id FROM conversation_members m WHERE m.conversation_id = $1"
+	rows, err := pg.pool.Query(ctx, query, id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+func (pg *PgConversationRepository) GetContactIds(ctx context.Context, userId string) ([]string, error) {
+	const query = `SELECT DISTINCT peer.user_id
+				   FROM conversation_members self
+				   JOIN conversation_members peer ON peer.conversation_id = self.conversation_id
+				   WHERE self.user_id = $1 AND peer.user_id <> $1`
+	rows, err := pg.pool.Query(ctx, query, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+func (pg *PgConversationRepository) IsMember(ctx context.Context, id string, userId string) (bool, error) {
+	const query = "SELECT EXISTS(SELECT 1 FROM conversation_members WHERE conversation_id = $1 AND user_id = $2)"
+	var member bool
+	err := pg.pool.QueryRow(ctx, query, id, userId).Scan(&member)
+	return member, err
+}
+
+func (pg *PgConversationRepository) AddMember(ctx context.Context, id string, userId string, maxMembers int) error {
+	const countQuery = "SELECT count(*) FROM conversation_members m WHERE m.conversation_id = $1 AND m.user_id <> $2"
+	const query = `INSERT INTO conversation_members (conversation_id, user_id)
+				   VALUES ($1, $2)
+				   ON CONFLICT DO NOTHING`
+
+	err := pgx.BeginFunc(ctx, pg.pool, func(tx pgx.Tx) error {
+		if err := lockConversation(ctx, tx, id); err != nil {
+			return err
+		}
+		var count int
+		if err := tx.QueryRow(ctx, countQuery, id, userId).Scan(&count); err != nil {
+			return err
+		} else if count >= maxMembers {
+			return ErrMembersLimit
+		}
+		_, err := tx.Exec(ctx, query, id, userId)
+		return err
+	})
+	if isForeignKeyViolation(err) {
+		return ErrUserNotFound
+	}
+	return err
+}
+
+func (pg *PgConversationRepository) RemoveMember(ctx context.Context, id string, userId string) error {
+	const query = "DELETE FROM conversation_members WHERE conversation_id = $1 AND user_id = $2"
+	const transferQuery = `UPDATE conversation_members
+						   SET role = 'owner'
+						   WHERE conversation_id = $1
+						     AND user_id = (SELECT m.user_id
+						                    FROM conversation_members m
+						                    WHERE m.conversation_id = $1
+						                    ORDER BY m.joined_at, m.user_id
+						                    LIMIT 1)
+						     AND NOT EXISTS (SELECT 1 FROM conversation_members o WHERE o.conversation_id = $1 AND o.role = 'owner')`
+
+	return pgx.BeginFunc(ctx, pg.pool, func(tx pgx.Tx) error {
+		if err := lockConversation(ctx, tx, id); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, query, id, userId); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, transferQuery, id)
+		return err
+	})
+}
+
+// lockConversation serializes changes of conversation members, so member count and owners are checked consistently
+func lockConversation(ctx context.Context, tx pgx.Tx, id string) error {
+	const query = "SELECT c.id FROM conversations c WHERE c.id = $1 FOR UPDATE"
+	var locked string
+	err := tx.QueryRow(ctx, query, id).Scan(&locked)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrConversationNotFound
+	}
+	return err
+}
+
+func (pg *PgConversationRepository) UpdateSettings(ctx context.Context, id string, userId string, muted *bool, archived *bool) (*DbMemberSettings, error) {
+	const query = `UPDATE conversation_members
+				   SET muted = coalesce($3, muted), archived = coalesce($4, archived)
+				   WHERE conversation_id = $1 AND user_id = $2
+				   RETURNING muted, archived`
+	rows, err := pg.pool.Query(ctx, query, id, userId, muted, archived)
+	if err != nil {
+		return nil, err
+	}
+
+	settings, err := pgx.CollectOneRow(rows, pgx.RowToStructByPos[DbMemberSettings])
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrConversationNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+func insertMembers(ctx context.Context, tx pgx.Tx, id string, role string, userIds []string) error {
+	const query = `INSERT INTO conversation_members (conversation_id, user_id, role)
+				   SELECT $1, u, $2 FROM unnest($3::UUID[]) u
+				   ON CONFLICT DO NOTHING`
+	_, err := tx.Exec(ctx, query, id, role, userIds)
+	return err
+}
+
+// directKey is the same for both participants regardless of who started conversation
+func directKey(userA string, userB string) string {
+	ids := []string{userA, userB}
+	sort.Strings(ids)
+	return strings.Join(ids, ":")
+}
@@ -0,0 +1,71 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+type DbSentMessage struct {
+	MessageId string
+	SentAt    time.Time
+}
+
+type DeduplicationRepository interface {
+	Reserve(ctx context.Context, userId string, clientId string, msg DbSentMessage, notBefore time.Time) (*DbSentMessage, error)
+	Release(ctx context.Context, userId string, clientId string, messageId string) error
+	PurgeOlderThan(ctx context.Context, before time.Time) (int64, error)
+}
+
+type PgDeduplicationRepository struct {
+	pool *pgxpool.Pool
+}
+
+func NewPgDeduplicationRepository(pool *pgxpool.Pool) *PgDeduplicationRepository {
+	return &PgDeduplicationRepository{pool: pool}
+}
+
+// Reserve stores message under client id unless there already is reservation made after notBefore,
+// returns reservation which is in effect after the call
+func (pg *PgDeduplicationRepository) Reserve(ctx context.Context, userId string, clientId string, msg DbSentMessage, notBefore time.Time) (*DbSentMessage, error) {
+	const upsertQuery = `INSERT INTO message_deduplication (user_id, client_id, message_id, sent_at)
+						 VALUES ($1, $2, $3, $4)
+						 ON CONFLICT (user_id, client_id) DO UPDATE
+						 SET message_id = excluded.message_id, sent_at = excluded.sent_at
+						 WHERE message_deduplication.sent_at < $5
+						 RETURNING message_id, sent_at`
+	const selectQuery = `SELECT message_id, sent_at
+						 FROM message_deduplication d
+						 WHERE d.user_id = $1 AND d.client_id = $2`
+
+	rows, err := pg.pool.Query(ctx, upsertQuery, userId, clientId, msg.MessageId, msg.SentAt, notBefore)
+	if err != nil {
+		return nil, err
+	}
+
+	reserved, err := pgx.CollectOneRow(rows, pgx.RowToStructByPos[DbSentMessage])
+	if errors.Is(err, pgx.ErrNoRows) {
+		if rows, err = pg.pool.Query(ctx, selectQuery, userId, clientId); err != nil {
+			return nil, err
+		}
+		reserved, err = pgx.CollectOneRow(rows, pgx.RowToStructByPos[DbSentMessage])
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &reserved, nil
+}
+
+func (pg *PgDeduplicationRepository) Release(ctx context.Context, userId string, clientId string, messageId string) error {
+	const query = "DELETE FROM message_deduplication WHERE user_id = $1 AND client_id = $2 AND message_id = $3"
+	_, err := pg.pool.Exec(ctx, query, userId, clientId, messageId)
+	return err
+}
+
+func (pg *PgDeduplicationRepository) PurgeOlderThan(ctx context.Context, before time.Time) (int64, error) {
+	const query = "DELETE FROM message_deduplication WHERE sent_at < $1"
+	tag, err := pg.pool.Exec(ctx, query, before)
+	return tag.RowsAffected(), err
+}
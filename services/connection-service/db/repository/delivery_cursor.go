@@ -0,0 +1,42 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type DeliveryCursorRepository interface {
+	// Get returns seq of the last message delivered to device, zero if nothing has been delivered yet
+	Get(ctx context.Context, userId string, deviceId string) (int64, error)
+	// Advance moves cursor forward, it is never moved backwards
+	Advance(ctx context.Context, userId string, deviceId string, seq int64) error
+}
+
+type PgDeliveryCursorRepository struct {
+	pool *pgxpool.Pool
+}
+
+func NewPgDeliveryCursorRepository(pool *pgxpool.Pool) *PgDeliveryCursorRepository {
+	return &PgDeliveryCursorRepository{pool: pool}
+}
+
+func (pg *PgDeliveryCursorRepository) Get(ctx context.Context, userId string, deviceId string) (int64, error) {
+	const query = "SELECT last_seq FROM delivery_cursors c WHERE c.user_id = $1 AND c.device_id = $2"
+	var seq int64
+	err := pg.pool.QueryRow(ctx, query, userId, deviceId).Scan(&seq)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, nil
+	}
+	return seq, err
+}
+
+func (pg *PgDeliveryCursorRepository) Advance(ctx context.Context, userId string, deviceId string, seq int64) error {
+	const query = `INSERT INTO delivery_cursors (user_id, device_id, last_seq)
+				   VALUES ($1, $2, $3)
+				   ON CONFLICT (user_id, device_id) DO UPDATE
+				   SET last_seq = GREATEST(delivery_cursors.last_seq, excluded.last_seq), updated_at = now()`
+	_, err := pg.pool.Exec(ctx, query, userId, deviceId, seq)
+	return err
+}
@@ -0,0 +1,370 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+var ErrMessageNotFound = errors.New("Message not found")
+
+type DbMessage struct {
+	Id             string
+	Seq            int64
+	ConversationId string
+	SenderId       string
+	ClientId       *string
+	Content        []byte
+	SentAt         time.Time
+	EditedAt       *time.Time
+	DeletedAt      *time.Time
+	DeletedBy      *string
+	ParentId       *string
+	ReplyCount     int
+	LastReplyId    *string
+	LastReplyAt    *time.Time
+	AttachmentIds  []string
+}
+
+type MessageRepository interface {
+	// Insert inserts message, linking its attachments to it. Attachments should be uploaded by sender to the same
+	// conversation and not sent yet, otherwise ErrAttachmentNotFound is returned and message is not inserted
+	Insert(ctx context.Context, msg *DbMessage) error
+	// InsertReply inserts message into thread of its parent, updating reply metadata of parent, returns reply count
+	InsertReply(ctx context.Context, msg *DbMessage) (int, error)
+	// ListBefore returns messages older than cursor in reverse chronological order, nil cursor means the latest ones.
+	// Replies of thread are listed when parent id is set, otherwise only top level messages are listed.
+	// Messages hidden by user are skipped, as well as by other list methods
+	ListBefore(ctx context.Context, userId string, conversationId string, parentId *string, cursor *string, limit int) ([]DbMessage, error)
+	// ListAfter returns messages newer than cursor in chronological order
+	ListAfter(ctx context.Context, userId string, conversationId string, parentId *string, cursor string, limit int) ([]DbMessage, error)
+	// ListForMemberAfter returns messages of all conversations user is member of, which are newer than seq,
+	// thread replies are only listed if user is subscribed to thread
+	ListForMemberAfter(ctx context.Context, userId string, seq int64, limit int) ([]DbMessage, error)
+	// ListSeqsForMemberAfter returns seqs of messages ListForMemberAfter lists. It waits for messages which are
+	// being inserted, so no message with lower seq than the returned ones is committed after it returns
+	ListSeqsForMemberAfter(ctx context.Context, userId string, seq int64, limit int) ([]int64, error)
+	// GetLatestSeqForMember returns seq of the latest message ListForMemberAfter would list, zero if there is none.
+	// It waits for messages which are being inserted as ListSeqsForMemberAfter does
+	GetLatestSeqForMember(ctx context.Context, userId string) (int64, error)
+	GetSeqForMember(ctx context.Context, userId string, messageId string) (int64, error)
+	// Exists tells whether message is stored, deleted messages are stored as tombstones
+	Exists(ctx context.Context, messageId string) (bool, error)
+	Get(ctx context.Context, conversationId string, messageId string) (*DbMessage, error)
+	// Edit replaces content of message which is not deleted, keeping the previous content as revision
+	Edit(ctx context.Context, conversationId string, messageId string, content []byte, editedAt time.Time) error
+	// Delete turns message into tombstone, dropping its content, revisions and attachments. Thread metadata of
+	// parent of deleted reply is recomputed from replies which are left
+	Delete(ctx context.Context, conversationId string, messageId string, deletedBy string, deletedAt time.Time) error
+	// Hide deletes message only for given user
+	Hide(ctx context.Context, userId string, messageId string) error
+}
+
+type PgMessageRepository struct {
+	pool *pgxpool.Pool
+}
+
+func NewPgMessageRepository(pool *pgxpool.Pool) *PgMessageRepository {
+	return &PgMessageRepository{pool: pool}
+}
+
+const messageColumns = "m.id, m.seq, m.conversation_id, m.sender_id, m.client_id, m.content, m.sent_at, m.edited_at, " +
+	"m.deleted_at, m.deleted_by, m.parent_id, m.reply_count, m.last_reply_id, m.last_reply_at, m.attachment_ids"
+
+const notHidden = "NOT EXISTS (SELECT 1 FROM hidden_messages h WHERE h.message_id = m.id AND h.user_id = $1)"
+
+// forMember selects messages of all conversations user with id $1 is member of, thread replies are only
+// selected if user is subscribed to thread
+const forMember = `JOIN conversation_members cm ON cm.conversation_id = m.conversation_id
+				   WHERE cm.user_id = $1 AND ` + notHidden + `
+				     AND (m.parent_id IS NULL OR EXISTS (
+				         SELECT 1 FROM thread_subscriptions t
+				         WHERE t.message_id = m.parent_id AND t.user_id = $1 AND t.subscribed
+				     ))`
+
+// insertLockKey identifies advisory lock messages are inserted under in shared mode. Seqs are assigned on insert
+// rather than on commit, so taking the lock in exclusive mode is the way to wait for messages which already got
+// their seqs to be committed or rolled back
+const insertLockKey = 7_020_001
+
+func (pg *PgMessageRepository) Insert(ctx context.Context, msg *DbMessage) error {
+	const query = `INSERT INTO messages (id, conversation_id, sender_id, client_id, content, sent_at, attachment_ids)
+				   VALUES ($1, $2, $3, $4, $5, $6, COALESCE($7::UUID[], '{}'))
+				   RETURNING seq`
+	return pg.withAttachments(ctx, msg, func(q rowQuerier) error {
+		return q.QueryRow(ctx, query, msg.Id, msg.ConversationId, msg.SenderId, msg.ClientId, msg.Content, msg.SentAt,
+			msg.AttachmentIds).Scan(&msg.Seq)
+	})
+}
+
+func (pg *PgMessageRepository) InsertReply(ctx context.Context, msg *DbMessage) (int, error) {
+	const query = `WITH reply AS (
+				       INSERT INTO messages (id, conversation_id, sender_id, client_id, content, sent_at, parent_id,
+				                             attachment_ids)
+				       VALUES ($1, $2, $3, $4, $5, $6, $7, COALESCE($8::UUID[], '{}'))
+				       RETURNING id, seq, sent_at, parent_id
+				   ), parent AS (
+				       UPDATE messages p
+				       SET reply_count = p.reply_count + 1, last_reply_id = r.id, last_reply_at = r.sent_at
+				       FROM reply r
+				       WHERE p.id = r.parent_id
+				       RETURNING p.reply_count
+				   )
+				   SELECT r.seq, (SELECT reply_count FROM parent) FROM reply r`
+	var replyCount int
+	err := pg.withAttachments(ctx, msg, func(q rowQuerier) error {
+		return q.QueryRow(ctx, query, msg.Id, msg.ConversationId, msg.SenderId, msg.ClientId, msg.Content, msg.SentAt,
+			msg.ParentId, msg.AttachmentIds).Scan(&msg.Seq, &replyCount)
+	})
+	return replyCount, err
+}
+
+type rowQuerier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// withAttachments runs insert of message under shared insert lock and links its attachments to it within the same
+// transaction
+func (pg *PgMessageRepository) withAttachments(ctx context.Context, msg *DbMessage, insert func(q rowQuerier) error) error {
+	const lockQuery = "SELECT pg_advisory_xact_lock_shared($1)"
+	const linkQuery = `UPDATE attachments
+					   SET message_id = $1
+					   WHERE id = ANY($4::UUID[]) AND conversation_id = $2 AND uploader_id = $3
+					     AND message_id IS NULL AND deleted_at IS NULL`
+
+	return pgx.BeginFunc(ctx, pg.pool, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, lockQuery, insertLockKey); err != nil {
+			return err
+		}
+		if err := insert(tx); err != nil {
+			return err
+		} else if len(msg.AttachmentIds) == 0 {
+			return nil
+		}
+
+		tag, err := tx.Exec(ctx, linkQuery, msg.Id, msg.ConversationId, msg.SenderId, msg.AttachmentIds)
+		if err != nil {
+			return err
+		} else if tag.RowsAffected() != int64(len(msg.AttachmentIds)) {
+			return ErrAttachmentNotFound
+		}
+		return nil
+	})
+}
+
+func (pg *PgMessageRepository) ListBefore(ctx context.Context, userId string, conversationId string, parentId *string, cursor *string, limit int) ([]DbMessage, error) {
+	const latestQuery = `SELECT ` + messageColumns + `
+						 FROM messages m
+						 WHERE m.conversation_id = $2 AND m.parent_id IS NOT DISTINCT FROM $3::UUID AND ` + notHidden + `
+						 ORDER BY m.seq DESC
+						 LIMIT $4`
+	const beforeQuery = `SELECT ` + messageColumns + `
+						 FROM messages m
+						 WHERE m.conversation_id = $2 AND m.parent_id IS NOT DISTINCT FROM $3::UUID AND m.seq < $4
+						   AND ` + notHidden + `
+						 ORDER BY m.seq DESC
+						 LIMIT $5`
+
+	if cursor == nil {
+		return pg.list(ctx, latestQuery, userId, conversationId, parentId, limit)
+	}
+
+	seq, err := pg.cursorSeq(ctx, conversationId, *cursor)
+	if err != nil {
+		return nil, err
+	}
+	return pg.list(ctx, beforeQuery, userId, conversationId, parentId, seq, limit)
+}
+
+func (pg *PgMessageRepository) ListAfter(ctx context.Context, userId string, conversationId string, parentId *string, cursor string, limit int) ([]DbMessage, error) {
+	const query = `SELECT ` + messageColumns + `
+				   FROM messages m
+				   WHERE m.conversation_id = $2 AND m.parent_id IS NOT DISTINCT FROM $3::UUID AND m.seq > $4
+				     AND ` + notHidden + `
+				   ORDER BY m.seq
+				   LIMIT $5`
+
+	seq, err := pg.cursorSeq(ctx, conversationId, cursor)
+	if err != nil {
+		return nil, err
+	}
+	return pg.list(ctx, query, userId, conversationId, parentId, seq, limit)
+}
+
+func (pg *PgMessageRepository) ListForMemberAfter(ctx context.Context, userId string, seq int64, limit int) ([]DbMessage, error) {
+	const query = `SELECT ` + messageColumns + `
+				   FROM messages m
+				   ` + forMember + ` AND m.seq > $2
+				   ORDER BY m.seq
+				   LIMIT $3`
+	return pg.list(ctx, query, userId, seq, limit)
+}
+
+func (pg *PgMessageRepository) ListSeqsForMemberAfter(ctx context.Context, userId string, seq int64, limit int) ([]int64, error) {
+	const query = `SELECT m.seq
+				   FROM messages m
+				   ` + forMember + ` AND m.seq > $2
+				   ORDER BY m.seq
+				   LIMIT $3`
+
+	if err := pg.awaitInserts(ctx); err != nil {
+		return nil, err
+	}
+	rows, err := pg.pool.Query(ctx, query, userId, seq, limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[int64])
+}
+
+func (pg *PgMessageRepository) GetLatestSeqForMember(ctx context.Context, userId string) (int64, error) {
+	const query = `SELECT COALESCE(MAX(m.seq), 0)
+				   FROM messages m
+				   ` + forMember
+
+	if err := pg.awaitInserts(ctx); err != nil {
+		return 0, err
+	}
+	var seq int64
+	err := pg.pool.QueryRow(ctx, query, userId).Scan(&seq)
+	return seq, err
+}
+
+// awaitInserts waits for messages which already got their seqs to be committed or rolled back, lock is released
+// right away, so inserts are only held back while it waits
+func (pg *PgMessageRepository) awaitInserts(ctx context.Context) error {
+	const query = "SELECT pg_advisory_xact_lock($1)"
+	return pgx.BeginFunc(ctx, pg.pool, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, query, insertLockKey)
+		return err
+	})
+}
+
+func (pg *PgMessageRepository) GetSeqForMember(ctx context.Context, userId string, messageId string) (int64, error) {
+	const query = `SELECT m.seq
+				   FROM messages m
+				   JOIN conversation_members cm ON cm.conversation_id = m.conversation_id
+				   WHERE m.id = $1 AND cm.user_id = $2`
+	var seq int64
+	err := pg.pool.QueryRow(ctx, query, messageId, userId).Scan(&seq)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, ErrMessageNotFound
+	}
+	return seq, err
+}
+
+func (pg *PgMessageRepository) Exists(ctx context.Context, messageId string) (bool, error) {
+	const query = `SELECT EXISTS (SELECT 1 FROM messages m WHERE m.id = $1)`
+	var exists bool
+	err := pg.pool.QueryRow(ctx, query, messageId).Scan(&exists)
+	return exists, err
+}
+
+func (pg *PgMessageRepository) Get(ctx context.Context, conversationId string, messageId string) (*DbMessage, error) {
+	const query = `SELECT ` + messageColumns + `
+				   FROM messages m
+				   WHERE m.id = $1 AND m.conversation_id = $2`
+	rows, err := pg.pool.Query(ctx, query, messageId, conversationId)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := pgx.CollectOneRow(rows, pgx.RowToStructByPos[DbMessage])
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrMessageNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+func (pg *PgMessageRepository) Edit(ctx context.Context, conversationId string, messageId string, content []byte, editedAt time.Time) error {
+	const revisionQuery = `INSERT INTO message_revisions (message_id, content, replaced_at)
+						   SELECT m.id, m.content, $3
+						   FROM messages m
+						   WHERE m.id = $1 AND m.conversation_id = $2 AND m.deleted_at IS NULL
+						   FOR UPDATE`
+	const updateQuery = `UPDATE messages
+						 SET content = $3, edited_at = $4
+						 WHERE id = $1 AND conversation_id = $2 AND deleted_at IS NULL`
+
+	return pgx.BeginFunc(ctx, pg.pool, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, revisionQuery, messageId, conversationId, editedAt); err != nil {
+			return err
+		}
+
+		tag, err := tx.Exec(ctx, updateQuery, messageId, conversationId, content, editedAt)
+		if err != nil {
+			return err
+		} else if tag.RowsAffected() == 0 {
+			return ErrMessageNotFound
+		}
+		return nil
+	})
+}
+
+func (pg *PgMessageRepository) Delete(ctx context.Context, conversationId string, messageId string, deletedBy string, deletedAt time.Time) error {
+	const deleteQuery = `UPDATE messages
+						 SET content = 'null'::JSONB, attachment_ids = '{}', deleted_at = $3, deleted_by = $4
+						 WHERE id = $1 AND conversation_id = $2 AND deleted_at IS NULL`
+	const revisionsQuery = "DELETE FROM message_revisions WHERE message_id = $1"
+	// attachments are left for purge, which removes their blobs as well
+	const attachmentsQuery = "UPDATE attachments SET deleted_at = $2 WHERE message_id = $1 AND deleted_at IS NULL"
+	// thread of deleted reply only counts replies which are left
+	const threadQuery = `UPDATE messages p
+						 SET reply_count = (SELECT count(*) FROM messages r WHERE r.parent_id = p.id AND r.deleted_at IS NULL),
+						     (last_reply_id, last_reply_at) = (SELECT r.id, r.sent_at
+						                                       FROM messages r
+						                                       WHERE r.parent_id = p.id AND r.deleted_at IS NULL
+						                                       ORDER BY r.seq DESC
+						                                       LIMIT 1)
+						 FROM messages d
+						 WHERE d.id = $1 AND p.id = d.parent_id`
+
+	return pgx.BeginFunc(ctx, pg.pool, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, deleteQuery, messageId, conversationId, deletedAt, deletedBy)
+		if err != nil {
+			return err
+		} else if tag.RowsAffected() == 0 {
+			return ErrMessageNotFound
+		}
+
+		if _, err = tx.Exec(ctx, revisionsQuery, messageId); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(ctx, threadQuery, messageId); err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, attachmentsQuery, messageId, deletedAt)
+		return err
+	})
+}
+
+func (pg *PgMessageRepository) Hide(ctx context.Context, userId string, messageId string) error {
+	const query = `INSERT INTO hidden_messages (user_id, message_id)
+				   VALUES ($1, $2)
+				   ON CONFLICT DO NOTHING`
+	_, err := pg.pool.Exec(ctx, query, userId, messageId)
+	return err
+}
+
+func (pg *PgMessageRepository) list(ctx context.Context, query string, args ...any) ([]DbMessage, error) {
+	rows, err := pg.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[DbMessage])
+}
+
+func (pg *PgMessageRepository) cursorSeq(ctx context.Context, conversationId string, messageId string) (int64, error) {
+	const query = "SELECT seq FROM messages m WHERE m.id = $1 AND m.conversation_id = $2"
+	var seq int64
+	err := pg.pool.QueryRow(ctx, query, messageId, conversationId).Scan(&seq)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, ErrMessageNotFound
+	}
+	return seq, err
+}
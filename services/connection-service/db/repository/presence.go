@@ -0,0 +1,135 @@
+package repository
+
+import (
+	"context"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+// DbPresence aggregates presence of user over all instances, Sessions counts instances user is connected to
+type DbPresence struct {
+	UserId     string
+	Sessions   int
+	Away       bool
+	LastSeenAt *time.Time
+}
+
+// DbPresenceChange holds presence of user aggregated over all instances before and after one of them changed it
+type DbPresenceChange struct {
+	Before DbPresence
+	After  DbPresence
+}
+
+type PresenceRepository interface {
+	// Upsert and Remove lock presence of user until they are done, so changes made by several instances at once are
+	// applied one after another and each of them sees what the previous one left. Changed is called with presence
+	// aggregated over instances alive after aliveAfter before the lock is released, so changes are reported in order
+	// they are applied
+	Upsert(ctx context.Context, userId string, instanceId string, away bool, aliveAfter time.Time, changed func(change *DbPresenceChange)) error
+	// Remove deletes presence of user on instance, remembering when user was last seen
+	Remove(ctx context.Context, userId string, instanceId string, aliveAfter time.Time, changed func(change *DbPresenceChange)) error
+	Heartbeat(ctx context.Context, instanceId string) error
+	// PurgeStale removes presence reported by instances which stopped sending heartbeats, returns affected users
+	PurgeStale(ctx context.Context, aliveAfter time.Time) ([]string, error)
+	Get(ctx context.Context, userIds []string, aliveAfter time.Time) ([]DbPresence, error)
+}
+
+type PgPresenceRepository struct {
+	pool *pgxpool.Pool
+}
+
+func NewPgPresenceRepository(pool *pgxpool.Pool) *PgPresenceRepository {
+	return &PgPresenceRepository{pool: pool}
+}
+
+func (pg *PgPresenceRepository) Upsert(ctx context.Context, userId string, instanceId string, away bool, aliveAfter time.Time, changed func(change *DbPresenceChange)) error {
+	const query = `INSERT INTO presence_sessions (user_id, instance_id, away)
+				   VALUES ($1, $2, $3)
+				   ON CONFLICT (user_id, instance_id) DO UPDATE
+				   SET away = excluded.away, heartbeat_at = now()`
+	return pg.change(ctx, userId, aliveAfter, changed, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, query, userId, instanceId, away)
+		return err
+	})
+}
+
+func (pg *PgPresenceRepository) Remove(ctx context.Context, userId string, instanceId string, aliveAfter time.Time, changed func(change *DbPresenceChange)) error {
+	const query = `WITH removed AS (
+				       DELETE FROM presence_sessions s WHERE s.user_id = $1 AND s.instance_id = $2 RETURNING s.user_id
+				   )
+				   INSERT INTO user_last_seen (user_id, last_seen_at)
+				   SELECT user_id, now() FROM removed
+				   ON CONFLICT (user_id) DO UPDATE SET last_seen_at = excluded.last_seen_at`
+	return pg.change(ctx, userId, aliveAfter, changed, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, query, userId, instanceId)
+		return err
+	})
+}
+
+// change runs update of presence with user locked, reporting aggregated presence before and after it
+func (pg *PgPresenceRepository) change(ctx context.Context, userId string, aliveAfter time.Time, changed func(change *DbPresenceChange), update func(tx pgx.Tx) error) error {
+	const lockQuery = "SELECT 1 FROM users u WHERE u.id = $1 FOR NO KEY UPDATE"
+
+	return pgx.BeginFunc(ctx, pg.pool, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, lockQuery, userId); err != nil {
+			return err
+		}
+		var change DbPresenceChange
+		if err := getPresence(ctx, tx, userId, aliveAfter, &change.Before); err != nil {
+			return err
+		}
+		if err := update(tx); err != nil {
+			return err
+		}
+		if err := getPresence(ctx, tx, userId, aliveAfter, &change.After); err != nil {
+			return err
+		}
+		changed(&change)
+		return nil
+	})
+}
+
+func (pg *PgPresenceRepository) Heartbeat(ctx context.Context, instanceId string) error {
+	const query = "UPDATE presence_sessions SET heartbeat_at = now() WHERE instance_id = $1"
+	_, err := pg.pool.Exec(ctx, query, instanceId)
+	return err
+}
+
+func (pg *PgPresenceRepository) PurgeStale(ctx context.Context, aliveAfter time.Time) ([]string, error) {
+	const query = `WITH removed AS (
+				       DELETE FROM presence_sessions s WHERE s.heartbeat_at <= $1 RETURNING s.user_id, s.heartbeat_at
+				   )
+				   INSERT INTO user_last_seen (user_id, last_seen_at)
+				   SELECT user_id, max(heartbeat_at) FROM removed GROUP BY user_id
+				   ON CONFLICT (user_id) DO UPDATE
+				   SET last_seen_at = GREATEST(user_last_seen.last_seen_at, excluded.last_seen_at)
+				   RETURNING user_id`
+	rows, err := pg.pool.Query(ctx, query, aliveAfter)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+// presenceQuery aggregates presence of users over instances which are alive
+const presenceQuery = `SELECT u.id, count(s.user_id), coalesce(bool_and(s.away), false), ls.last_seen_at
+					   FROM unnest($1::UUID[]) AS u(id)
+					   LEFT JOIN presence_sessions s ON s.user_id = u.id AND s.heartbeat_at > $2
+					   LEFT JOIN user_last_seen ls ON ls.user_id = u.id
+					   GROUP BY u.id, ls.last_seen_at`
+
+func (pg *PgPresenceRepository) Get(ctx context.Context, userIds []string, aliveAfter time.Time) ([]DbPresence, error) {
+	rows, err := pg.pool.Query(ctx, presenceQuery, userIds, aliveAfter)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[DbPresence])
+}
+
+func getPresence(ctx context.Context, tx pgx.Tx, userId string, aliveAfter time.Time, presence *DbPresence) error {
+	return tx.QueryRow(ctx, presenceQuery, []string{userId}, aliveAfter).
+		Scan(&presence.UserId, &presence.Sessions, &presence.Away, &presence.LastSeenAt)
+}
@@ -0,0 +1,94 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var ErrReactionLimit = errors.New("Too many distinct reactions on message")
+
+// DbReactionCount counts users who reacted on message with emoji, Reacted tells whether requesting user is among them
+type DbReactionCount struct {
+	MessageId string
+	Emoji     string
+	Count     int
+	Reacted   bool
+}
+
+type ReactionRepository interface {
+	// Add returns false if user has already reacted with emoji, ErrReactionLimit if user has reached limit
+	// of distinct reactions on message
+	Add(ctx context.Context, messageId string, userId string, emoji string, limit int) (bool, error)
+	// Remove returns false if there was no such reaction
+	Remove(ctx context.Context, messageId string, userId string, emoji string) (bool, error)
+	// Count aggregates reactions on messages, in order emojis were first used on each message
+	Count(ctx context.Context, userId string, messageIds []string) ([]DbReactionCount, error)
+}
+
+type PgReactionRepository struct {
+	pool *pgxpool.Pool
+}
+
+func NewPgReactionRepository(pool *pgxpool.Pool) *PgReactionRepository {
+	return &PgReactionRepository{pool: pool}
+}
+
+func (pg *PgReactionRepository) Add(ctx context.Context, messageId string, userId string, emoji string, limit int) (bool, error) {
+	// message row is locked so concurrent reactions of user could not exceed the limit
+	const lockQuery = "SELECT 1 FROM messages WHERE id = $1 FOR UPDATE"
+	const countQuery = `SELECT count(*), bool_or(r.emoji = $3)
+						FROM message_reactions r
+						WHERE r.message_id = $1 AND r.user_id = $2`
+	const insertQuery = "INSERT INTO message_reactions (message_id, user_id, emoji) VALUES ($1, $2, $3)"
+
+	added := false
+	err := pgx.BeginFunc(ctx, pg.pool, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, lockQuery, messageId); err != nil {
+			return err
+		}
+
+		var count int
+		var exists *bool
+		if err := tx.QueryRow(ctx, countQuery, messageId, userId, emoji).Scan(&count, &exists); err != nil {
+			return err
+		}
+		if exists != nil && *exists {
+			return nil
+		} else if count >= limit {
+			return ErrReactionLimit
+		}
+
+		if _, err := tx.Exec(ctx, insertQuery, messageId, userId, emoji); err != nil {
+			return err
+		}
+		added = true
+		return nil
+	})
+
+	if isForeignKeyViolation(err) {
+		return false, ErrMessageNotFound
+	}
+	return added, err
+}
+
+func (pg *PgReactionRepository) Remove(ctx context.Context, messageId string, userId string, emoji string) (bool, error) {
+	const query = "DELETE FROM message_reactions WHERE message_id = $1 AND user_id = $2 AND emoji = $3"
+	tag, err := pg.pool.Exec(ctx, query, messageId, userId, emoji)
+	return tag.RowsAffected() > 0, err
+}
+
+func (pg *PgReactionRepository) Count(ctx context.Context, userId string, messageIds []string) ([]DbReactionCount, error) {
+	const query = `SELECT r.message_id, r.emoji, count(*), bool_or(r.user_id = $1)
+				   FROM message_reactions r
+				   WHERE r.message_id = ANY ($2::UUID[])
+				   GROUP BY r.message_id, r.emoji
+				   ORDER BY r.message_id, min(r.created_at)`
+	rows, err := pg.pool.Query(ctx, query, userId, messageIds)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[DbReactionCount])
+}
@@ -0,0 +1,66 @@
+package repository
+
+import (
+	"context"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+// DbReceiptCounts counts members of conversation other than author of message who got and read it, members who
+// joined after message was sent are not counted
+type DbReceiptCounts struct {
+	Recipients int
+	Delivered  int
+	Read       int
+}
+
+// ReceiptRepository keeps per member markers of the last delivered and read message in conversation,
+// every message with smaller seq is considered delivered or read as well
+type ReceiptRepository interface {
+	// AdvanceDelivered returns false if marker has already been at or beyond seq
+	AdvanceDelivered(ctx context.Context, conversationId string, userId string, seq int64) (bool, error)
+	// AdvanceRead moves delivered marker as well, read message is obviously delivered
+	AdvanceRead(ctx context.Context, conversationId string, userId string, seq int64) (bool, error)
+	Count(ctx context.Context, conversationId string, authorId string, seq int64, sentAt time.Time) (*DbReceiptCounts, error)
+}
+
+type PgReceiptRepository struct {
+	pool *pgxpool.Pool
+}
+
+func NewPgReceiptRepository(pool *pgxpool.Pool) *PgReceiptRepository {
+	return &PgReceiptRepository{pool: pool}
+}
+
+func (pg *PgReceiptRepository) AdvanceDelivered(ctx context.Context, conversationId string, userId string, seq int64) (bool, error) {
+	const query = `UPDATE conversation_members
+				   SET delivered_seq = $3
+				   WHERE conversation_id = $1 AND user_id = $2 AND delivered_seq < $3`
+	tag, err := pg.pool.Exec(ctx, query, conversationId, userId, seq)
+	return tag.RowsAffected() > 0, err
+}
+
+func (pg *PgReceiptRepository) AdvanceRead(ctx context.Context, conversationId string, userId string, seq int64) (bool, error) {
+	const query = `UPDATE conversation_members
+				   SET read_seq = $3, delivered_seq = GREATEST(delivered_seq, $3)
+				   WHERE conversation_id = $1 AND user_id = $2 AND read_seq < $3`
+	tag, err := pg.pool.Exec(ctx, query, conversationId, userId, seq)
+	return tag.RowsAffected() > 0, err
+}
+
+func (pg *PgReceiptRepository) Count(ctx context.Context, conversationId string, authorId string, seq int64, sentAt time.Time) (*DbReceiptCounts, error) {
+	const query = `SELECT count(*), count(*) FILTER (WHERE m.delivered_seq >= $3), count(*) FILTER (WHERE m.read_seq >= $3)
+				   FROM conversation_members m
+				   WHERE m.conversation_id = $1 AND m.user_id <> $2 AND m.joined_at <= $4`
+	rows, err := pg.pool.Query(ctx, query, conversationId, authorId, seq, sentAt)
+	if err != nil {
+		return nil, err
+	}
+
+	counts, err := pgx.CollectOneRow(rows, pgx.RowToStructByPos[DbReceiptCounts])
+	if err != nil {
+		return nil, err
+	}
+	return &counts, nil
+}
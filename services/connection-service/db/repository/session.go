@@ -0,0 +1,35 @@
+package repository
+
+import (
+	"context"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+type SessionRepository interface {
+	Revoke(ctx context.Context, sessionId string, userId string, expiresAt *time.Time) error
+	IsRevoked(ctx context.Context, sessionId string) (bool, error)
+}
+
+type PgSessionRepository struct {
+	pool *pgxpool.Pool
+}
+
+func NewPgSessionRepository(pool *pgxpool.Pool) *PgSessionRepository {
+	return &PgSessionRepository{pool: pool}
+}
+
+func (pg *PgSessionRepository) Revoke(ctx context.Context, sessionId string, userId string, expiresAt *time.Time) error {
+	const query = `INSERT INTO revoked_sessions (session_id, user_id, expires_at)
+				   VALUES ($1, $2, $3)
+				   ON CONFLICT (session_id) DO NOTHING`
+	_, err := pg.pool.Exec(ctx, query, sessionId, userId, expiresAt)
+	return err
+}
+
+func (pg *PgSessionRepository) IsRevoked(ctx context.Context, sessionId string) (bool, error) {
+	const query = "SELECT EXISTS(SELECT 1 FROM revoked_sessions WHERE session_id = $1)"
+	var revoked bool
+	err := pg.pool.QueryRow(ctx, query, sessionId).Scan(&revoked)
+	return revoked, err
+}
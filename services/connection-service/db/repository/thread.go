@@ -0,0 +1,53 @@
+package repository
+
+import (
+	"context"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type ThreadRepository interface {
+	SetSubscribed(ctx context.Context, messageId string, userId string, subscribed bool) error
+	// SubscribeIfAbsent subscribes user unless user has already chosen whether to follow thread
+	SubscribeIfAbsent(ctx context.Context, messageId string, userId string) error
+	// GetSubscriberIds returns subscribers of thread who are still members of its conversation
+	GetSubscriberIds(ctx context.Context, messageId string) ([]string, error)
+}
+
+type PgThreadRepository struct {
+	pool *pgxpool.Pool
+}
+
+func NewPgThreadRepository(pool *pgxpool.Pool) *PgThreadRepository {
+	return &PgThreadRepository{pool: pool}
+}
+
+func (pg *PgThreadRepository) SetSubscribed(ctx context.Context, messageId string, userId string, subscribed bool) error {
+	const query = `INSERT INTO thread_subscriptions (message_id, user_id, subscribed)
+				   VALUES ($1, $2, $3)
+				   ON CONFLICT (message_id, user_id) DO UPDATE SET subscribed = excluded.subscribed`
+	_, err := pg.pool.Exec(ctx, query, messageId, userId, subscribed)
+	return err
+}
+
+func (pg *PgThreadRepository) SubscribeIfAbsent(ctx context.Context, messageId string, userId string) error {
+	const query = `INSERT INTO thread_subscriptions (message_id, user_id, subscribed)
+				   VALUES ($1, $2, TRUE)
+				   ON CONFLICT DO NOTHING`
+	_, err := pg.pool.Exec(ctx, query, messageId, userId)
+	return err
+}
+
+func (pg *PgThreadRepository) GetSubscriberIds(ctx context.Context, messageId string) ([]string, error) {
+	const query = `SELECT t.user_id
+				   FROM thread_subscriptions t
+				   JOIN messages m ON m.id = t.message_id
+				   JOIN conversation_members cm ON cm.conversation_id = m.conversation_id AND cm.user_id = t.user_id
+				   WHERE t.message_id = $1 AND t.subscribed`
+	rows, err := pg.pool.Query(ctx, query, messageId)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
@@ -2,18 +2,27 @@ package repository
 
 import (
 	"context"
+	"errors"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+var (
+	ErrUserNotFound      = errors.New("User not found")
+	ErrUserAlreadyExists = errors.New("User already exists")
+)
+
 type DbUser struct {
-	Id       string
-	Username string
-	Password string
+	Id          string
+	Username    string
+	Password    string
+	DisplayName string
+	Roles       []string
 }
 
 type UserRepository interface {
-	GetByUserName(userName string) (DbUser, error)
+	GetByUserName(ctx context.Context, userName string) (*DbUser, error)
+	Create(ctx context.Context, userName string, passwordHash string) (*DbUser, error)
 }
 
 type PgUserRepository struct {
@@ -25,7 +34,9 @@ func NewPgUserRepository(pool *pgxpool.Pool) *PgUserRepository {
 }
 
 func (pg *PgUserRepository) GetByUserName(ctx context.Context, userName string) (*DbUser, error) {
-	const query = "SELECT id, username, password FROM users u WHERE u.username = $1"
+	const query = `SELECT id, username, password, COALESCE(display_name, username), roles
+				   FROM users u
+				   WHERE u.username = $1`
 	rows, err := pg.pool.Query(ctx, query, userName)
 
 	if err != nil {
@@ -33,5 +44,29 @@ func (pg *PgUserRepository) GetByUserName(ctx context.Context, userName string)
 	}
 
 	user, err := pgx.CollectOneRow(rows, pgx.RowToStructByPos[DbUser])
-	return &user, err
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrUserNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (pg *PgUserRepository) Create(ctx context.Context, userName string, passwordHash string) (*DbUser, error) {
+	const query = `INSERT INTO users (username, password)
+				   VALUES ($1, $2)
+				   RETURNING id, username, password, COALESCE(display_name, username), roles`
+	rows, err := pg.pool.Query(ctx, query, userName, passwordHash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := pgx.CollectOneRow(rows, pgx.RowToStructByPos[DbUser])
+	if isUniqueViolation(err) {
+		return nil, ErrUserAlreadyExists
+	} else if err != nil {
+		return nil, err
+	}
+	return &user, nil
 }
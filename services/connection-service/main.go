@@ -3,16 +3,26 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
-	websocket2 "github.com/gorilla/websocket"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"log"
 	"net/http"
+	"online-chat-go/attachments"
 	"online-chat-go/auth"
+	"online-chat-go/chat"
 	"online-chat-go/config"
+	"online-chat-go/db"
+	"online-chat-go/db/repository"
 	"online-chat-go/notifications"
 	redis "online-chat-go/notifications/redis_bus/clustered"
+	"online-chat-go/presence"
+	"online-chat-go/ratelimit"
 	"online-chat-go/websocket"
+	"os/signal"
 	"strings"
+	"syscall"
 )
 
 func main() {
@@ -20,40 +30,172 @@ func main() {
 	cfgJson, _ := json.MarshalIndent(cfg, "", "    ")
 	fmt.Println("started app with config:\n", string(cfgJson))
 
-	wss := websocket.NewWSServer()
-	authorizer := &auth.DummyAuthorizer{}
+	if err := db.RunMigrations(db.Migrations, db.MigrationsPath, cfg.Db.Url); err != nil {
+		log.Fatal("Unable to run migrations: ", err)
+	}
+	pool, err := pgxpool.New(context.Background(), cfg.Db.Url)
+	if err != nil {
+		log.Fatal("Unable to connect to database: ", err)
+	}
+	userRepository := repository.NewPgUserRepository(pool)
+	sessionRepository := repository.NewPgSessionRepository(pool)
+	apiKeyRepository := repository.NewPgApiKeyRepository(pool)
+	conversationRepository := repository.NewPgConversationRepository(pool)
+	deduplicationRepository := repository.NewPgDeduplicationRepository(pool)
+	messageRepository := repository.NewPgMessageRepository(pool)
+	deliveryCursorRepository := repository.NewPgDeliveryCursorRepository(pool)
+	presenceRepository := repository.NewPgPresenceRepository(pool)
+	receiptRepository := repository.NewPgReceiptRepository(pool)
+	reactionRepository := repository.NewPgReactionRepository(pool)
+	threadRepository := repository.NewPgThreadRepository(pool)
+	attachmentRepository := repository.NewPgAttachmentRepository(pool)
+
+	// background loops keep running while connections are drained, as closing connections still updates presence
+	appCtx, stopApp := context.WithCancel(context.Background())
+	wss := websocket.NewWSServer(&cfg.Ws)
 	notificationBus := redis.NewClusteredRedisNotificationBus(cfg.NotificationBus.Redis.Cluster)
+	revoker := auth.NewSessionRevoker(sessionRepository, notificationBus)
+	revoker.Start(appCtx)
+	deduplicator := chat.NewDeduplicator(deduplicationRepository, cfg.Chat.DedupWindow)
+	deduplicator.Start(appCtx)
+	conversations := chat.NewConversationService(conversationRepository, messageRepository, reactionRepository, threadRepository, deduplicator, notificationBus, &cfg.Chat)
+	typing := chat.NewTyping(conversations, cfg.Chat.Typing.Throttle, cfg.Chat.Typing.Timeout)
+	receipts := chat.NewReceipts(conversations, receiptRepository, messageRepository, notificationBus)
+	delivery := chat.NewDelivery(wss, messageRepository, deliveryCursorRepository, cfg.Chat.MaxReplay, cfg.Chat.MaxReplayBuffer)
+	delivery.SetOnDelivered(receipts.OnDelivered)
+	delivery.SetCoalesceKey(chat.TypeTyping, websocket.PayloadKey("user_id"))
+	delivery.SetCoalesceKey(chat.TypeReceipt, websocket.PayloadKey("user_id", "status"))
+	delivery.SetCoalesceKey(presence.TypePresence, websocket.PayloadKey("user_id"))
+	userPresence := presence.NewPresence(wss, presenceRepository, conversationRepository, notificationBus, cfg.Presence.Ttl)
+	wss.SetOnConnectionAdded(userPresence.OnConnectionAdded)
+	wss.SetOnConnectionRemoved(userPresence.OnConnectionRemoved)
+	userPresence.Start(appCtx)
+	blobStore, err := attachments.NewLocalStore(cfg.Attachments.Dir)
+	if err != nil {
+		log.Fatal("Unable to create attachments store: ", err)
+	}
+	conversationAttachments := attachments.NewAttachments(conversations, attachmentRepository, blobStore, &cfg.Attachments)
+	conversationAttachments.Start(appCtx)
+	rateLimitBuckets := ratelimit.NewRedisBuckets(&cfg.RateLimit.Redis)
+	limiter := ratelimit.NewLimiter(rateLimitBuckets, &cfg.RateLimit)
+	upgradeLimiter := ratelimit.NewUpgradeLimiter(&cfg.RateLimit)
+	upgradeLimiter.Start(appCtx)
+
+	authorizers, err := auth.NewAuthorizersFromConfig(&cfg.Auth, apiKeyRepository)
+	if err != nil {
+		log.Fatal("Unable to create authorizer: ", err)
+	}
+	authorizer := auth.NewRevocationAwareAuthorizer(authorizers.Chain, revoker)
+	tokenIssuer, err := auth.NewTokenIssuer(&cfg.Auth.Jwt)
+	if err != nil {
+		log.Fatal("Unable to create token issuer: ", err)
+	}
+
+	SetUpNotificationHandlers(wss, notificationBus, revoker, delivery)
 	notificationBus.Start()
 
-	SetUpNotificationHandlers(wss, notificationBus)
+	// expvar registers /debug/vars on default mux, so public routes use their own
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth/login", auth.NewLoginHandler(userRepository, tokenIssuer, authorizers.Cookie))
+	mux.HandleFunc("/auth/register", auth.NewRegisterHandler(userRepository, tokenIssuer, authorizers.Cookie))
+	mux.HandleFunc("/auth/logout", auth.NewLogoutHandler(authorizer, revoker, authorizers.Cookie))
+	mux.HandleFunc("/conversations", auth.NewAuthenticatedHandler(authorizer, chat.NewConversationsHandler(conversations)))
+	mux.HandleFunc("/conversations/members", auth.NewAuthenticatedHandler(authorizer, chat.NewMembersHandler(conversations)))
+	mux.HandleFunc("/conversations/messages", auth.NewAuthenticatedHandler(authorizer, chat.NewMessagesHandler(conversations)))
+	mux.HandleFunc("/conversations/threads", auth.NewAuthenticatedHandler(authorizer, chat.NewThreadHandler(conversations)))
+	mux.HandleFunc("/conversations/settings", auth.NewAuthenticatedHandler(authorizer, chat.NewSettingsHandler(conversations)))
+	mux.HandleFunc("/conversations/receipts", auth.NewAuthenticatedHandler(authorizer, chat.NewReceiptsHandler(receipts)))
+	mux.HandleFunc("/attachments", auth.NewAuthenticatedHandler(authorizer, attachments.NewAttachmentsHandler(conversationAttachments)))
+	mux.HandleFunc(attachments.DownloadPath, attachments.NewDownloadHandler(conversationAttachments))
+	mux.HandleFunc("/presence", auth.NewAuthenticatedHandler(authorizer, presence.NewPresenceHandler(userPresence)))
+	dispatcher := NewDispatcher(conversations, typing, receipts, conversationAttachments, userPresence, authorizer)
+	dispatcher.SetRateLimit(limiter.ForConnection)
+	mux.HandleFunc("/", upgradeLimiter.Wrap(websocket.NewWsHandler(wss, authorizer, &cfg.Ws, func(principal *auth.Principal, conn websocket.WSConnection) {
+		delivery.Start(principal, conn)
+		dispatcher.Serve(principal, conn)
+	})))
+	server := &http.Server{Addr: fmt.Sprintf(":%d", cfg.App.Port), Handler: mux}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal("Unable to bind server: ", err)
+		}
+	}()
+	var metricsServer *http.Server
+	if cfg.App.MetricsPort > 0 {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/debug/vars", expvar.Handler())
+		metricsServer = &http.Server{Addr: fmt.Sprintf(":%d", cfg.App.MetricsPort), Handler: metricsMux}
+		go func() {
+			if err := metricsServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatal("Unable to bind metrics server: ", err)
+			}
+		}()
+	}
 
-	http.HandleFunc("/", websocket.NewWsHandler(wss, authorizer, &cfg.Ws, MakeWsConnectionHandler(notificationBus)))
-	if err := http.ListenAndServe(fmt.Sprintf(":%d", cfg.App.Port), nil); err != nil {
-		log.Fatal("Unable to bind server: ", err)
+	signals, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stopSignals()
+	<-signals.Done()
+	log.Println("shutting down, draining connections for: ", cfg.App.DrainPeriod)
+	// every connection gets drain period and then timeout to flush its queue and send close frame
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.App.DrainPeriod+2*cfg.Ws.Timeout)
+	defer cancel()
+	// hijacked websocket connections are not tracked by http server, so it only stops accepting upgrades
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("Error shutting down http server: ", err)
+	}
+	wss.Shutdown(ctx, cfg.App.DrainPeriod)
+	if metricsServer != nil {
+		_ = metricsServer.Close()
 	}
+
+	// nothing is delivered via notification bus or stored to database once connections are closed
+	stopApp()
+	_ = rateLimitBuckets.Close()
+	notificationBus.Close()
+	pool.Close()
+	log.Println("shut down")
 }
 
-func SetUpNotificationHandlers(wss *websocket.WSServer, bus notifications.NotificationBus) {
-	bus.PatternSubscribe(context.Background(), "/to/user/*")
-	bus.SetMessageHandler(func(topic string, msg []byte) {
-		id, _ := strings.CutPrefix(topic, "/to/user/")
-		go wss.SendMessage(id, msg, websocket2.TextMessage)
+func SetUpNotificationHandlers(wss *websocket.WSServer, bus notifications.NotificationBus, revoker *auth.SessionRevoker, delivery *chat.Delivery) {
+	router := notifications.NewRouter()
+	router.Handle(notifications.UserTopicPrefix, func(topic string, msg []byte) {
+		id, _ := strings.CutPrefix(topic, notifications.UserTopicPrefix)
+		_ = delivery.Deliver(id, websocket.BusMessage(msg))
+	})
+	router.Handle(auth.RevokedSessionsTopic, revoker.HandleRevocation)
+	revoker.SetOnRevoked(func(session auth.RevokedSession) {
+		_ = wss.CloseSession(session.UserId, session.SessionId, websocket.CloseSessionRevoked, "session revoked")
 	})
+	bus.SetMessageHandler(router.Dispatch)
+
+	bus.PatternSubscribe(context.Background(), notifications.UserTopicPrefix+"*")
+	bus.Subscribe(context.Background(), auth.RevokedSessionsTopic)
 }
 
-func MakeWsConnectionHandler(notificationBus notifications.NotificationBus) func(string, websocket.WSConnection) {
-	return func(userId string, wsconn websocket.WSConnection) {
-		for {
-			select {
-			case <-wsconn.Done():
-				return
-
-			case msg := <-wsconn.ReadPump():
-				if err := notificationBus.Publish(context.Background(), "/to/user/1", msg.Data); err != nil {
-					log.Println("Error publishing message: ", err)
-				}
-				log.Println(fmt.Sprintf("new message from user: %s, connection id: %s, msg: %s", userId, wsconn.Id(), string(msg.Data)))
-			}
-		}
-	}
+func NewDispatcher(
+	conversations *chat.ConversationService,
+	typing *chat.Typing,
+	receipts *chat.Receipts,
+	conversationAttachments *attachments.Attachments,
+	userPresence *presence.Presence,
+	authorizer auth.TokenAuthorizer,
+) *websocket.Dispatcher {
+	dispatcher := websocket.NewDispatcher()
+	dispatcher.Register(websocket.TypeReauthenticate, websocket.NewReauthenticateHandler(authorizer))
+	dispatcher.Register(chat.TypeMessage, chat.NewSendMessageHandler(conversations))
+	dispatcher.Register(chat.TypeHistory, chat.NewHistoryRequestHandler(conversations))
+	dispatcher.Register(chat.TypeThread, chat.NewThreadRequestHandler(conversations))
+	dispatcher.Register(chat.TypeThreadSubscribe, chat.NewThreadSubscriptionHandler(conversations))
+	dispatcher.Register(chat.TypeThreadUnsubscribe, chat.NewThreadSubscriptionHandler(conversations))
+	dispatcher.Register(chat.TypeEdit, chat.NewEditHandler(conversations))
+	dispatcher.Register(chat.TypeDelete, chat.NewDeleteHandler(conversations))
+	dispatcher.Register(chat.TypeReactionAdd, chat.NewReactionHandler(conversations))
+	dispatcher.Register(chat.TypeReactionRemove, chat.NewReactionHandler(conversations))
+	dispatcher.Register(chat.TypeConversationSettings, chat.NewSettingsRequestHandler(conversations))
+	dispatcher.Register(chat.TypeTyping, chat.NewTypingHandler(typing))
+	dispatcher.Register(chat.TypeRead, chat.NewReadHandler(receipts))
+	dispatcher.Register(attachments.TypeAttachments, attachments.NewResolveHandler(conversationAttachments))
+	dispatcher.Register(presence.TypePresence, presence.NewSetStatusHandler(userPresence))
+	dispatcher.Register(presence.TypePresenceQuery, presence.NewQueryHandler(userPresence))
+	return dispatcher
 }
@@ -11,6 +11,7 @@ type NotificationBus interface {
 	Unsubscribe(ctx context.Context, topic string)
 	PatternSubscribe(ctx context.Context, pattern string)
 	PatternUnsubscribe(ctx context.Context, pattern string)
+	// SetMessageHandler sets handler called for messages one after another in order they arrive, so it should not block
 	SetMessageHandler(func(topic string, msg []byte))
 	Close()
 }
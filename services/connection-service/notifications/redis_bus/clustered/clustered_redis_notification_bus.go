@@ -2,6 +2,8 @@ package clustered
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	set "github.com/deckarep/golang-set/v2"
 	"log"
 	"online-chat-go/config"
@@ -25,10 +27,18 @@ func (cnb *ClusteredRedisNotificationBus) Start() {
 }
 
 func (cnb *ClusteredRedisNotificationBus) Publish(ctx context.Context, topic string, msg []byte) error {
+	var node string
+	var target *single.RedisNotificationBus
 	cnb.cluster.ForRandomEntry(func(nodeId string, bus *single.RedisNotificationBus) {
-		log.Println("published to node: ", nodeId)
-		go bus.Publish(ctx, topic, msg)
+		node, target = nodeId, bus
 	})
+	if target == nil {
+		return errors.New("No redis nodes available for publishing")
+	}
+
+	if err := target.Publish(ctx, topic, msg); err != nil {
+		return fmt.Errorf("could not publish to node %s: %w", node, err)
+	}
 	return nil
 }
 
@@ -35,8 +35,7 @@ func (reb *RedisNotificationBus) Start() {
 	go reb.runReader()
 }
 
-func (reb *RedisNotificationBus) Publish(ctx context.Context, topic string, msg []byte) error {
-	var err error
+func (reb *RedisNotificationBus) Publish(ctx context.Context, topic string, msg []byte) (err error) {
 	defer func() {
 		if p := recover(); p != nil {
 			switch perr := p.(type) {
@@ -48,8 +47,7 @@ func (reb *RedisNotificationBus) Publish(ctx context.Context, topic string, msg
 		}
 	}()
 
-	reb.redis.Publish(ctx, topic, msg)
-	return err
+	return reb.redis.Publish(ctx, topic, msg).Err()
 }
 
 func (reb *RedisNotificationBus) Subscribe(ctx context.Context, topic string) {
@@ -92,7 +90,7 @@ func (reb *RedisNotificationBus) runReader() {
 				return
 			}
 			if reb.msgHandler != nil {
-				go reb.msgHandler(msg.Channel, []byte(msg.Payload))
+				reb.msgHandler(msg.Channel, []byte(msg.Payload))
 			}
 		}
 	}
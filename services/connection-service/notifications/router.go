@@ -0,0 +1,46 @@
+package notifications
+
+import (
+	"log"
+	"strings"
+	"sync"
+)
+
+type route struct {
+	prefix  string
+	handler func(topic string, msg []byte)
+}
+
+// Router dispatches messages arriving from NotificationBus to handlers registered for topic prefix,
+// the longest matching prefix wins
+type Router struct {
+	routes []route
+	mut    *sync.RWMutex
+}
+
+func NewRouter() *Router {
+	return &Router{mut: &sync.RWMutex{}}
+}
+
+func (r *Router) Handle(prefix string, handler func(topic string, msg []byte)) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.routes = append(r.routes, route{prefix: prefix, handler: handler})
+}
+
+func (r *Router) Dispatch(topic string, msg []byte) {
+	r.mut.RLock()
+	var matched *route
+	for i := range r.routes {
+		if strings.HasPrefix(topic, r.routes[i].prefix) && (matched == nil || len(r.routes[i].prefix) > len(matched.prefix)) {
+			matched = &r.routes[i]
+		}
+	}
+	r.mut.RUnlock()
+
+	if matched == nil {
+		log.Printf("no handler for message arrived on topic: %s\n", topic)
+		return
+	}
+	matched.handler(topic, msg)
+}
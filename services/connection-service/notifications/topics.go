@@ -0,0 +1,7 @@
+package notifications
+
+const UserTopicPrefix = "/to/user/"
+
+func UserTopic(userId string) string {
+	return UserTopicPrefix + userId
+}
@@ -0,0 +1,104 @@
+package presence
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"online-chat-go/auth"
+	"online-chat-go/util"
+	"online-chat-go/websocket"
+	"time"
+)
+
+const (
+	// TypePresence is sent by client to change own status and by server to notify about status changes,
+	// TypePresenceSet confirms status change to client
+	TypePresence      = "presence"
+	TypePresenceSet   = "presence_set"
+	TypePresenceQuery = "presence_query"
+)
+
+type SetStatusPayload struct {
+	Status string `json:"status"`
+}
+
+// SetStatusResultPayload confirms status reported by connection, aggregated status is sent in presence frame
+// if it has changed
+type SetStatusResultPayload struct {
+	Status          string    `json:"status"`
+	ServerTimestamp time.Time `json:"server_timestamp"`
+}
+
+type QueryPayload struct {
+	UserIds []string `json:"user_ids"`
+}
+
+type QueryResultPayload struct {
+	Statuses []Status `json:"statuses"`
+}
+
+// NewSetStatusHandler lets client report that user is away or back online, reply is presence_set frame correlated with request
+func NewSetStatusHandler(presence *Presence) websocket.Handler {
+	return func(ctx context.Context, conn websocket.WSConnection, env *websocket.Envelope) error {
+		var payload SetStatusPayload
+		if err := env.DecodePayload(&payload); err != nil {
+			return err
+		}
+		if err := presence.SetStatus(conn, payload.Status); err != nil {
+			return ToProtocolError(err)
+		}
+		result := SetStatusResultPayload{Status: payload.Status, ServerTimestamp: time.Now().UTC()}
+		return websocket.Reply(conn, env, TypePresenceSet, result)
+	}
+}
+
+// NewQueryHandler answers presence query with presence_query frame correlated with it
+func NewQueryHandler(presence *Presence) websocket.Handler {
+	return func(ctx context.Context, conn websocket.WSConnection, env *websocket.Envelope) error {
+		var payload QueryPayload
+		if err := env.DecodePayload(&payload); err != nil {
+			return err
+		}
+
+		statuses, err := presence.Query(ctx, conn.Principal(), payload.UserIds)
+		if err != nil {
+			return ToProtocolError(err)
+		}
+		return websocket.Reply(conn, env, TypePresenceQuery, QueryResultPayload{Statuses: statuses})
+	}
+}
+
+// NewPresenceHandler serves GET on /presence, query parameters: user_id, could be repeated
+func NewPresenceHandler(presence *Presence) func(http.ResponseWriter, *http.Request, *auth.Principal) {
+	return func(writer http.ResponseWriter, request *http.Request, principal *auth.Principal) {
+		if !util.RequireMethod(writer, request, http.MethodGet) {
+			return
+		}
+
+		statuses, err := presence.Query(request.Context(), principal, request.URL.Query()["user_id"])
+		switch {
+		case err == nil:
+			util.WriteJson(writer, http.StatusOK, QueryResultPayload{Statuses: statuses})
+		case errors.Is(err, ErrInvalidQuery):
+			util.WriteError(writer, http.StatusBadRequest, err.Error())
+		case errors.Is(err, ErrNotContact):
+			util.WriteError(writer, http.StatusForbidden, err.Error())
+		default:
+			log.Println("Error handling request: ", err)
+			util.WriteError(writer, http.StatusInternalServerError, "Internal server error")
+		}
+	}
+}
+
+// ToProtocolError maps presence errors to error codes reported to websocket clients
+func ToProtocolError(err error) error {
+	switch {
+	case errors.Is(err, ErrInvalidStatus), errors.Is(err, ErrInvalidQuery):
+		return websocket.NewProtocolError(websocket.ErrCodeInvalid, err.Error())
+	case errors.Is(err, ErrNotContact):
+		return websocket.NewProtocolError(websocket.ErrCodeForbidden, err.Error())
+	default:
+		return err
+	}
+}
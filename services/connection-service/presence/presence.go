@@ -0,0 +1,285 @@
+package presence
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	"hash/fnv"
+	"log"
+	"online-chat-go/auth"
+	"online-chat-go/db/repository"
+	"online-chat-go/notifications"
+	"online-chat-go/websocket"
+	"sync"
+	"time"
+)
+
+const (
+	StatusOnline  = "online"
+	StatusAway    = "away"
+	StatusOffline = "offline"
+)
+
+const (
+	maxQueriedUsers = 100
+	userLocks       = 64
+)
+
+var (
+	ErrInvalidStatus = errors.New("Status should be either online or away")
+	ErrInvalidQuery  = errors.New("Between 1 and 100 valid user ids should be queried")
+	ErrNotContact    = errors.New("Presence is only visible to users sharing a conversation")
+)
+
+type Status struct {
+	UserId     string     `json:"user_id"`
+	Status     string     `json:"status"`
+	LastSeenAt *time.Time `json:"last_seen_at,omitempty"`
+}
+
+// Presence keeps status of users connected to this instance in shared store, so status of user connected to
+// several instances is aggregated over all of them: user is online if any instance reports so, away if all of
+// them report away, offline otherwise. Presence of instances which stopped sending heartbeats expires after ttl
+type Presence struct {
+	wss           *websocket.WSServer
+	store         repository.PresenceRepository
+	conversations repository.ConversationRepository
+	bus           notifications.NotificationBus
+	instanceId    string
+	ttl           time.Duration
+
+	// locks serialize updates of the same user on this instance, so connections are counted in order updates
+	// are stored, store serializes updates of user across instances
+	locks    [userLocks]sync.Mutex
+	awayMut  sync.Mutex
+	awayConn map[string]map[string]bool // user id -> ids of local connections which reported away
+}
+
+func NewPresence(
+	wss *websocket.WSServer,
+	store repository.PresenceRepository,
+	conversations repository.ConversationRepository,
+	bus notifications.NotificationBus,
+	ttl time.Duration,
+) *Presence {
+	return &Presence{
+		wss:           wss,
+		store:         store,
+		conversations: conversations,
+		bus:           bus,
+		instanceId:    uuid.NewString(),
+		ttl:           ttl,
+		awayConn:      make(map[string]map[string]bool),
+	}
+}
+
+// OnConnectionAdded should be set as WSServer hook, every new connection counts as online,
+// so it could bring back user whose other connections are away
+func (p *Presence) OnConnectionAdded(userId string, _ websocket.WSConnection) {
+	p.update(userId)
+}
+
+// OnConnectionRemoved should be set as WSServer hook, user could become offline or away once connection is closed
+func (p *Presence) OnConnectionRemoved(userId string, conn websocket.WSConnection) {
+	p.forgetAway(userId, conn.Id())
+	p.update(userId)
+}
+
+// SetStatus marks connection as away or back online, user is away on instance once all its connections are away
+func (p *Presence) SetStatus(conn websocket.WSConnection, status string) error {
+	userId := conn.Principal().Id
+	switch status {
+	case StatusAway:
+		p.awayMut.Lock()
+		conns, ok := p.awayConn[userId]
+		if !ok {
+			conns = make(map[string]bool)
+			p.awayConn[userId] = conns
+		}
+		conns[conn.Id()] = true
+		p.awayMut.Unlock()
+
+	case StatusOnline:
+		p.forgetAway(userId, conn.Id())
+
+	default:
+		return ErrInvalidStatus
+	}
+
+	p.update(userId)
+	return nil
+}
+
+func (p *Presence) forgetAway(userId string, connId string) {
+	p.awayMut.Lock()
+	defer p.awayMut.Unlock()
+
+	if conns, ok := p.awayConn[userId]; ok {
+		delete(conns, connId)
+		if len(conns) == 0 {
+			delete(p.awayConn, userId)
+		}
+	}
+}
+
+// update reconciles stored presence of user on this instance with its actual connections
+// and notifies contacts if aggregated status has changed
+func (p *Presence) update(userId string) {
+	lock := p.lock(userId)
+	lock.Lock()
+	defer lock.Unlock()
+
+	ctx := context.Background()
+	// presence is published before store releases user, so contacts get changes made by instances in order
+	changed := func(change *repository.DbPresenceChange) {
+		if after := toStatus(&change.After); after.Status != toStatus(&change.Before).Status {
+			p.publish(ctx, after)
+		}
+	}
+
+	var err error
+	if count := p.wss.ConnectionsCount(userId); count == 0 {
+		err = p.store.Remove(ctx, userId, p.instanceId, time.Now().Add(-p.ttl), changed)
+	} else {
+		p.awayMut.Lock()
+		away := len(p.awayConn[userId]) >= count
+		p.awayMut.Unlock()
+		err = p.store.Upsert(ctx, userId, p.instanceId, away, time.Now().Add(-p.ttl), changed)
+	}
+	if err != nil {
+		log.Printf("Error storing presence of user: %s, err: %s\n", userId, err)
+	}
+}
+
+// publish sends presence frame to personal topics of contacts of user and of user itself, so other devices see it too
+func (p *Presence) publish(ctx context.Context, status *Status) {
+	contactIds, err := p.conversations.GetContactIds(ctx, status.UserId)
+	if err != nil {
+		log.Printf("Error getting contacts of user: %s, err: %s\n", status.UserId, err)
+		return
+	}
+
+	env, err := websocket.NewEnvelope(TypePresence, status)
+	if err != nil {
+		log.Println("Error encoding presence: ", err)
+		return
+	}
+	msg, err := json.Marshal(env)
+	if err != nil {
+		log.Println("Error encoding presence: ", err)
+		return
+	}
+
+	for _, id := range append(contactIds, status.UserId) {
+		if err = p.bus.Publish(ctx, notifications.UserTopic(id), msg); err != nil {
+			log.Printf("Error publishing presence to user: %s, err: %s\n", id, err)
+		}
+	}
+}
+
+// Query returns presence of given users, only presence of self and of contacts could be queried
+func (p *Presence) Query(ctx context.Context, principal *auth.Principal, userIds []string) ([]Status, error) {
+	if len(userIds) == 0 || len(userIds) > maxQueriedUsers {
+		return nil, ErrInvalidQuery
+	}
+	for _, id := range userIds {
+		if _, err := uuid.Parse(id); err != nil {
+			return nil, ErrInvalidQuery
+		}
+	}
+
+	contactIds, err := p.conversations.GetContactIds(ctx, principal.Id)
+	if err != nil {
+		return nil, err
+	}
+	visible := map[string]bool{principal.Id: true}
+	for _, id := range contactIds {
+		visible[id] = true
+	}
+	for _, id := range userIds {
+		if !visible[id] {
+			return nil, ErrNotContact
+		}
+	}
+
+	presences, err := p.store.Get(ctx, userIds, time.Now().Add(-p.ttl))
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]Status, 0, len(presences))
+	for i := range presences {
+		statuses = append(statuses, *toStatus(&presences[i]))
+	}
+	return statuses, nil
+}
+
+// Start periodically refreshes presence of users connected to this instance and expires presence
+// of instances which stopped doing so, until context is cancelled
+func (p *Presence) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(p.ttl / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case <-ticker.C:
+				if err := p.store.Heartbeat(ctx, p.instanceId); err != nil {
+					log.Println("Error refreshing presence: ", err)
+				}
+				p.expire(ctx)
+			}
+		}
+	}()
+}
+
+func (p *Presence) expire(ctx context.Context) {
+	userIds, err := p.store.PurgeStale(ctx, time.Now().Add(-p.ttl))
+	if err != nil {
+		log.Println("Error expiring presence: ", err)
+		return
+	}
+
+	for _, userId := range userIds {
+		status, err := p.get(ctx, userId)
+		if err != nil {
+			log.Printf("Error getting presence of user: %s, err: %s\n", userId, err)
+		} else if status.Status == StatusOffline {
+			p.publish(ctx, status)
+		}
+	}
+}
+
+func (p *Presence) get(ctx context.Context, userId string) (*Status, error) {
+	presences, err := p.store.Get(ctx, []string{userId}, time.Now().Add(-p.ttl))
+	if err != nil {
+		return nil, err
+	} else if len(presences) == 0 {
+		return &Status{UserId: userId, Status: StatusOffline}, nil
+	}
+	return toStatus(&presences[0]), nil
+}
+
+func (p *Presence) lock(userId string) *sync.Mutex {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(userId))
+	return &p.locks[hash.Sum32()%userLocks]
+}
+
+func toStatus(presence *repository.DbPresence) *Status {
+	status := &Status{UserId: presence.UserId}
+	switch {
+	case presence.Sessions == 0:
+		status.Status = StatusOffline
+		status.LastSeenAt = presence.LastSeenAt
+	case presence.Away:
+		status.Status = StatusAway
+	default:
+		status.Status = StatusOnline
+	}
+	return status
+}
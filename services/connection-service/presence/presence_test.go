@@ -0,0 +1,207 @@
+package presence
+
+import (
+	"context"
+	"encoding/json"
+	"online-chat-go/auth"
+	"online-chat-go/config"
+	"online-chat-go/db/repository"
+	"online-chat-go/notifications"
+	"online-chat-go/websocket"
+	"sync"
+	"testing"
+	"time"
+)
+
+const presenceUserId = "user"
+
+// sharedStore keeps presence of instances in memory, changes are serialized as user lock of database does
+type sharedStore struct {
+	repository.PresenceRepository
+	mut       sync.Mutex
+	instances map[string]bool // instance id -> away
+}
+
+func (s *sharedStore) aggregate() repository.DbPresence {
+	presence := repository.DbPresence{UserId: presenceUserId, Sessions: len(s.instances), Away: len(s.instances) > 0}
+	for _, away := range s.instances {
+		presence.Away = presence.Away && away
+	}
+	return presence
+}
+
+func (s *sharedStore) change(changed func(change *repository.DbPresenceChange), update func()) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	change := &repository.DbPresenceChange{Before: s.aggregate()}
+	update()
+	change.After = s.aggregate()
+	changed(change)
+	return nil
+}
+
+func (s *sharedStore) Upsert(_ context.Context, _ string, instanceId string, away bool, _ time.Time, changed func(change *repository.DbPresenceChange)) error {
+	return s.change(changed, func() { s.instances[instanceId] = away })
+}
+
+func (s *sharedStore) Remove(_ context.Context, _ string, instanceId string, _ time.Time, changed func(change *repository.DbPresenceChange)) error {
+	return s.change(changed, func() { delete(s.instances, instanceId) })
+}
+
+// noContacts lets presence be published only to user itself
+type noContacts struct {
+	repository.ConversationRepository
+}
+
+func (noContacts) GetContactIds(_ context.Context, _ string) ([]string, error) {
+	return nil, nil
+}
+
+// publishedStatuses records statuses published to personal topic of user
+type publishedStatuses struct {
+	notifications.NotificationBus
+	mut      sync.Mutex
+	statuses []string
+}
+
+func (b *publishedStatuses) Publish(_ context.Context, topic string, msg []byte) error {
+	var env websocket.Envelope
+	var status Status
+	if err := json.Unmarshal(msg, &env); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(env.Payload, &status); err != nil {
+		return err
+	}
+	if topic == notifications.UserTopic(presenceUserId) {
+		b.mut.Lock()
+		b.statuses = append(b.statuses, status.Status)
+		b.mut.Unlock()
+	}
+	return nil
+}
+
+func (b *publishedStatuses) published() []string {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	statuses := b.statuses
+	b.statuses = nil
+	return statuses
+}
+
+type userConn struct {
+	websocket.WSConnection
+	id   string
+	done chan bool
+}
+
+func (c *userConn) Id() string {
+	return c.id
+}
+
+func (c *userConn) Done() <-chan bool {
+	return c.done
+}
+
+func (c *userConn) Principal() *auth.Principal {
+	return &auth.Principal{Id: presenceUserId}
+}
+
+// instance is presence of one instance of service sharing store and bus with the other ones
+type instance struct {
+	wss      *websocket.WSServer
+	presence *Presence
+	conn     *userConn
+}
+
+func newInstance(id string, store *sharedStore, bus *publishedStatuses) *instance {
+	wss := websocket.NewWSServer(&config.WsConfig{})
+	presence := NewPresence(wss, store, noContacts{}, bus, time.Minute)
+	wss.SetOnConnectionAdded(presence.OnConnectionAdded)
+	wss.SetOnConnectionRemoved(presence.OnConnectionRemoved)
+	return &instance{wss: wss, presence: presence, conn: &userConn{id: id, done: make(chan bool)}}
+}
+
+func (i *instance) connect(t *testing.T) {
+	if err := i.wss.AddConnection(presenceUserId, i.conn); err != nil {
+		t.Error(err)
+	}
+}
+
+func (i *instance) disconnect(t *testing.T) {
+	if err := i.wss.RemoveConnection(presenceUserId, i.conn); err != nil {
+		t.Error(err)
+	}
+}
+
+func expectPublished(t *testing.T, bus *publishedStatuses, expected ...string) {
+	t.Helper()
+	published := bus.published()
+	if len(published) != len(expected) {
+		t.Fatalf("published statuses are %v, expected %v", published, expected)
+	}
+	for i := range expected {
+		if published[i] != expected[i] {
+			t.Fatalf("published statuses are %v, expected %v", published, expected)
+		}
+	}
+}
+
+func TestPresenceIsAggregatedOverInstances(t *testing.T) {
+	store, bus := &sharedStore{instances: make(map[string]bool)}, &publishedStatuses{}
+	first, second := newInstance("first", store, bus), newInstance("second", store, bus)
+
+	first.connect(t)
+	expectPublished(t, bus, StatusOnline)
+	second.connect(t)
+	expectPublished(t, bus)
+
+	if err := first.presence.SetStatus(first.conn, StatusAway); err != nil {
+		t.Fatal(err)
+	}
+	expectPublished(t, bus)
+	if err := second.presence.SetStatus(second.conn, StatusAway); err != nil {
+		t.Fatal(err)
+	}
+	expectPublished(t, bus, StatusAway)
+
+	// the last connection which is not away brings user back online
+	second.disconnect(t)
+	expectPublished(t, bus)
+	second.connect(t)
+	expectPublished(t, bus, StatusOnline)
+
+	first.disconnect(t)
+	expectPublished(t, bus)
+	second.disconnect(t)
+	expectPublished(t, bus, StatusOffline)
+}
+
+func TestPresenceChangedOnInstancesAtOnce(t *testing.T) {
+	store, bus := &sharedStore{instances: make(map[string]bool)}, &publishedStatuses{}
+	first, second := newInstance("first", store, bus), newInstance("second", store, bus)
+
+	for i := 0; i < 100; i++ {
+		var wg sync.WaitGroup
+		for _, inst := range []*instance{first, second} {
+			wg.Add(1)
+			go func(inst *instance) {
+				defer wg.Done()
+				inst.connect(t)
+				inst.disconnect(t)
+			}(inst)
+		}
+		wg.Wait()
+	}
+
+	// user could go offline in between, but every published status is a change and the last one is offline
+	published := bus.published()
+	if len(published) == 0 || published[len(published)-1] != StatusOffline {
+		t.Fatalf("published statuses end with %v, expected offline", published)
+	}
+	for i := range published {
+		if expected := []string{StatusOnline, StatusOffline}[i%2]; published[i] != expected {
+			t.Fatalf("status %d published is %s, expected %s", i, published[i], expected)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"math"
+	"online-chat-go/config"
+	"time"
+)
+
+// tokenBucket holds up to burst tokens refilled at rate tokens per second, every frame takes one token
+type tokenBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+// take returns zero if token was taken, otherwise time after which there will be one
+func (b *tokenBucket) take(now time.Time, rate float64, burst float64) time.Duration {
+	if b.updatedAt.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.updatedAt).Seconds()*rate)
+	}
+	b.updatedAt = now
+
+	if b.tokens < 1 {
+		return time.Duration(math.Ceil((1-b.tokens)/rate*1000)) * time.Millisecond
+	}
+	b.tokens--
+	return 0
+}
+
+// refund returns token taken for frame which was rejected by other limit after all
+func (b *tokenBucket) refund(burst float64) {
+	b.tokens = math.Min(burst, b.tokens+1)
+}
+
+// Limit is token bucket kept in Redis under Key
+type Limit struct {
+	Key   string
+	Rate  float64
+	Burst float64
+}
+
+// takeScript takes token from every bucket only if all of them have one, otherwise it returns milliseconds after
+// which they will. Time of Redis is used, so clocks of instances do not matter
+var takeScript = redis.NewScript(`
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local tokens = {}
+local wait = 0
+for i, key in ipairs(KEYS) do
+	local rate = tonumber(ARGV[i * 2 - 1])
+	local burst = tonumber(ARGV[i * 2])
+	local bucket = redis.call('HMGET', key, 'tokens', 'ts')
+	local available = tonumber(bucket[1]) or burst
+	local updated = tonumber(bucket[2]) or now
+	available = math.min(burst, available + math.max(0, now - updated) * rate / 1000)
+	tokens[i] = available
+	if available < 1 then
+		wait = math.max(wait, math.ceil((1 - available) * 1000 / rate))
+	end
+end
+if wait > 0 then
+	return wait
+end
+for i, key in ipairs(KEYS) do
+	local rate = tonumber(ARGV[i * 2 - 1])
+	local burst = tonumber(ARGV[i * 2])
+	redis.call('HSET', key, 'tokens', tostring(tokens[i] - 1), 'ts', now)
+	redis.call('PEXPIRE', key, math.ceil(burst * 1000 / rate))
+end
+return 0
+`)
+
+// RedisBuckets keeps token buckets in Redis, so limits of user are shared by all instances it is connected to
+type RedisBuckets struct {
+	redis *redis.Client
+}
+
+func NewRedisBuckets(cfg *config.RedisInstanceConfig) *RedisBuckets {
+	return &RedisBuckets{redis: redis.NewClient(&redis.Options{Addr: fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)})}
+}
+
+// Take takes token from every bucket if all of them have one, otherwise returns time after which they will
+func (rb *RedisBuckets) Take(ctx context.Context, limits []Limit) (time.Duration, error) {
+	keys := make([]string, 0, len(limits))
+	args := make([]any, 0, 2*len(limits))
+	for _, limit := range limits {
+		keys = append(keys, limit.Key)
+		args = append(args, limit.Rate, limit.Burst)
+	}
+
+	wait, err := takeScript.Run(ctx, rb.redis, keys, args...).Int64()
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(wait) * time.Millisecond, nil
+}
+
+func (rb *RedisBuckets) Close() error {
+	return rb.redis.Close()
+}
@@ -0,0 +1,50 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucketTake(t *testing.T) {
+	start := time.Now()
+	at := func(offset time.Duration) time.Time { return start.Add(offset) }
+
+	// bucket of 2 tokens refilled at 2 tokens per second
+	tests := []struct {
+		name     string
+		takes    []time.Time
+		refunds  int
+		now      time.Time
+		expected time.Duration
+	}{
+		{name: "new bucket is full", now: at(0), expected: 0},
+		{name: "burst is taken at once", takes: []time.Time{at(0)}, now: at(0), expected: 0},
+		{name: "empty bucket tells when token is refilled", takes: []time.Time{at(0), at(0)}, now: at(0), expected: 500 * time.Millisecond},
+		{name: "partially refilled bucket tells remaining time", takes: []time.Time{at(0), at(0)}, now: at(200 * time.Millisecond), expected: 300 * time.Millisecond},
+		{name: "token is refilled over time", takes: []time.Time{at(0), at(0)}, now: at(500 * time.Millisecond), expected: 0},
+		{name: "refill is capped by burst", takes: []time.Time{at(0), at(0), at(time.Hour), at(time.Hour)}, now: at(time.Hour), expected: 500 * time.Millisecond},
+		{name: "refunded token could be taken again", takes: []time.Time{at(0), at(0)}, refunds: 1, now: at(0), expected: 0},
+		{name: "refund is capped by burst", takes: []time.Time{at(0)}, refunds: 3, now: at(0), expected: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var bucket tokenBucket
+			for _, now := range test.takes {
+				if wait := bucket.take(now, 2, 2); wait != 0 {
+					t.Fatalf("token was not taken, wait: %s", wait)
+				}
+			}
+			for i := 0; i < test.refunds; i++ {
+				bucket.refund(2)
+			}
+			if bucket.tokens > 2 {
+				t.Fatalf("bucket holds %f tokens, more than burst", bucket.tokens)
+			}
+
+			if wait := bucket.take(test.now, 2, 2); wait != test.expected {
+				t.Errorf("wait is %s, expected %s", wait, test.expected)
+			}
+		})
+	}
+}
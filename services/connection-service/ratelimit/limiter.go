@@ -0,0 +1,120 @@
+package ratelimit
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"online-chat-go/auth"
+	"online-chat-go/config"
+	"online-chat-go/websocket"
+	"time"
+)
+
+const (
+	keyPrefix = "rate-limit:"
+	// frames are let through if Redis does not answer in time, connection limit still applies to them
+	clusterTimeout = 500 * time.Millisecond
+)
+
+var (
+	rateLimitedMessages  = expvar.NewInt("ws_rate_limited_messages")
+	rateLimitDisconnects = expvar.NewInt("ws_rate_limit_disconnects")
+)
+
+// Limiter applies token bucket limits to frames received from connections. Connection limit is enforced locally,
+// limits of user and its message types are shared by all instances via Redis
+type Limiter struct {
+	cluster *RedisBuckets
+	config  *config.RateLimitConfig
+}
+
+func NewLimiter(cluster *RedisBuckets, cfg *config.RateLimitConfig) *Limiter {
+	return &Limiter{cluster: cluster, config: cfg}
+}
+
+// connectionLimiter is only used by goroutine serving connection, so it is not synchronized
+type connectionLimiter struct {
+	limiter     *Limiter
+	conn        websocket.WSConnection
+	bucket      tokenBucket
+	violations  int
+	windowStart time.Time
+}
+
+// ForConnection could be set as rate limit of dispatcher. Rejected frames are answered with rate limited error
+// telling when to retry, connection is closed once it is rejected max violations times within violation window
+func (l *Limiter) ForConnection(conn websocket.WSConnection) websocket.FrameLimiter {
+	return &connectionLimiter{limiter: l, conn: conn}
+}
+
+// Take applies connection limit, it is checked before frame is decoded
+func (cl *connectionLimiter) Take() error {
+	rate, multiplier := cl.limiter.config.Connection, cl.limiter.multiplier(cl.conn.Principal())
+	if wait := cl.bucket.take(time.Now(), rate.Rate*multiplier, float64(rate.Burst)*multiplier); wait > 0 {
+		return cl.reject(wait)
+	}
+	return nil
+}
+
+// Allow applies limits of user and message type, connection token is given back if they reject frame,
+// so frames rejected by cluster do not count against connection
+func (cl *connectionLimiter) Allow(ctx context.Context, env *websocket.Envelope) error {
+	principal := cl.conn.Principal()
+	multiplier := cl.limiter.multiplier(principal)
+	wait := cl.limiter.takeCluster(ctx, principal.Id, env.Type, multiplier)
+	if wait == 0 {
+		return nil
+	}
+
+	cl.bucket.refund(float64(cl.limiter.config.Connection.Burst) * multiplier)
+	return cl.reject(wait)
+}
+
+func (cl *connectionLimiter) reject(wait time.Duration) error {
+	rateLimitedMessages.Add(1)
+	if cl.violate(time.Now(), cl.limiter.config.ViolationWindow) == cl.limiter.config.MaxViolations {
+		rateLimitDisconnects.Add(1)
+		log.Printf("closing rate limited connection of user with id: %s, connection id: %s\n", cl.conn.Principal().Id, cl.conn.Id())
+		go func() { _ = cl.conn.CloseWithReason(websocket.CloseRateLimited, "rate limit exceeded") }()
+	}
+	return websocket.NewRateLimitedError(wait)
+}
+
+func (l *Limiter) takeCluster(ctx context.Context, userId string, msgType string, multiplier float64) time.Duration {
+	limits := []Limit{newLimit(keyPrefix+userId, l.config.User, multiplier)}
+	if rate, ok := l.config.Types[msgType]; ok {
+		limits = append(limits, newLimit(keyPrefix+userId+":"+msgType, rate, multiplier))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, clusterTimeout)
+	defer cancel()
+	wait, err := l.cluster.Take(ctx, limits)
+	if err != nil {
+		log.Printf("Error taking rate limit tokens of user: %s, err: %s\n", userId, err)
+		return 0
+	}
+	return wait
+}
+
+// multiplier is the largest multiplier of roles principal has, limits of users without such roles are not scaled
+func (l *Limiter) multiplier(principal *auth.Principal) float64 {
+	multiplier, found := 1.0, false
+	for _, role := range principal.Roles {
+		if m, ok := l.config.Roles[role]; ok && (!found || m > multiplier) {
+			multiplier, found = m, true
+		}
+	}
+	return multiplier
+}
+
+func (cl *connectionLimiter) violate(now time.Time, window time.Duration) int {
+	if now.Sub(cl.windowStart) > window {
+		cl.windowStart, cl.violations = now, 0
+	}
+	cl.violations++
+	return cl.violations
+}
+
+func newLimit(key string, rate config.RateConfig, multiplier float64) Limit {
+	return Limit{Key: key, Rate: rate.Rate * multiplier, Burst: float64(rate.Burst) * multiplier}
+}
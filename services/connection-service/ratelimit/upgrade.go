@@ -0,0 +1,101 @@
+package ratelimit
+
+import (
+	"context"
+	"expvar"
+	"math"
+	"net"
+	"net/http"
+	"online-chat-go/config"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var rejectedUpgrades = expvar.NewInt("ws_rate_limited_upgrades")
+
+// UpgradeLimiter limits websocket handshakes per client address, so reconnecting clients could not exhaust
+// instance. Handshakes over limit are answered with 429 and Retry-After before authorization takes place
+type UpgradeLimiter struct {
+	mut     sync.Mutex
+	buckets map[string]*tokenBucket
+	config  *config.RateLimitConfig
+}
+
+func NewUpgradeLimiter(cfg *config.RateLimitConfig) *UpgradeLimiter {
+	return &UpgradeLimiter{buckets: make(map[string]*tokenBucket), config: cfg}
+}
+
+// Wrap applies limit to handler, it should wrap websocket handler only
+func (ul *UpgradeLimiter) Wrap(handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if wait := ul.take(ul.clientIp(request), time.Now()); wait > 0 {
+			rejectedUpgrades.Add(1)
+			writer.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(wait.Seconds())), 10))
+			writer.WriteHeader(http.StatusTooManyRequests)
+			_, _ = writer.Write([]byte("Too many connection attempts"))
+			return
+		}
+		handler(writer, request)
+	}
+}
+
+// Start periodically forgets addresses whose buckets are full again until context is cancelled
+func (ul *UpgradeLimiter) Start(ctx context.Context) {
+	refill := time.Duration(float64(ul.config.Upgrade.Burst) / ul.config.Upgrade.Rate * float64(time.Second))
+	go func() {
+		ticker := time.NewTicker(refill)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case now := <-ticker.C:
+				ul.forget(now.Add(-refill))
+			}
+		}
+	}()
+}
+
+func (ul *UpgradeLimiter) take(ip string, now time.Time) time.Duration {
+	ul.mut.Lock()
+	defer ul.mut.Unlock()
+
+	bucket, ok := ul.buckets[ip]
+	if !ok {
+		bucket = &tokenBucket{}
+		ul.buckets[ip] = bucket
+	}
+	return bucket.take(now, ul.config.Upgrade.Rate, float64(ul.config.Upgrade.Burst))
+}
+
+func (ul *UpgradeLimiter) forget(updatedBefore time.Time) {
+	ul.mut.Lock()
+	defer ul.mut.Unlock()
+
+	for ip, bucket := range ul.buckets {
+		if bucket.updatedAt.Before(updatedBefore) {
+			delete(ul.buckets, ip)
+		}
+	}
+}
+
+func (ul *UpgradeLimiter) clientIp(request *http.Request) string {
+	if ul.config.ClientIpHeader != "" {
+		if values := request.Header.Values(ul.config.ClientIpHeader); len(values) > 0 {
+			addresses := strings.Split(values[len(values)-1], ",")
+			if ip := strings.TrimSpace(addresses[len(addresses)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,40 @@
+package util
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+func WriteJson(writer http.ResponseWriter, status int, body any) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	if err := json.NewEncoder(writer).Encode(body); err != nil {
+		log.Println("Error writing response: ", err)
+	}
+}
+
+func WriteError(writer http.ResponseWriter, status int, msg string) {
+	WriteJson(writer, status, ErrorResponse{Error: msg})
+}
+
+func RequireMethod(writer http.ResponseWriter, request *http.Request, method string) bool {
+	if request.Method == method {
+		return true
+	}
+
+	writer.Header().Set("Allow", method)
+	WriteError(writer, http.StatusMethodNotAllowed, "Method not allowed")
+	return false
+}
+
+// ReadJson decodes request body into target, rejecting bodies larger than limit
+func ReadJson(writer http.ResponseWriter, request *http.Request, limit int64, target any) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(writer, request.Body, limit))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(target)
+}
@@ -22,6 +22,24 @@ func RemoveSwapElem[T comparable](arr *[]T, elem T) error {
 	return &RemovalError{msg: "Element not found"}
 }
 
+// RemoveElem removes element keeping order of the rest, unlike RemoveSwapElem
+func RemoveElem[T comparable](arr *[]T, elem T) error {
+	derefArr := *arr
+	for i := 0; i < len(derefArr); i++ {
+		if derefArr[i] == elem {
+			copy(derefArr[i:], derefArr[i+1:])
+
+			var noop T
+			derefArr[len(derefArr)-1] = noop
+
+			*arr = derefArr[:len(derefArr)-1]
+			return nil
+		}
+	}
+
+	return &RemovalError{msg: "Element not found"}
+}
+
 func RemoveSwap[T any](arr *[]T, idx int) error {
 	derefArr := *arr
 	length := len(derefArr)
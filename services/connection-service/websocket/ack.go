@@ -0,0 +1,39 @@
+package websocket
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+const (
+	TypeAck  = "ack"
+	TypeNack = "nack"
+)
+
+type AckPayload struct {
+	MessageId       string    `json:"message_id"`
+	ServerTimestamp time.Time `json:"server_ts"`
+	Duplicate       bool      `json:"duplicate,omitempty"`
+}
+
+// ReplyAck confirms client message has been accepted under server assigned id
+func ReplyAck(conn WSConnection, request *Envelope, ack AckPayload) error {
+	return Reply(conn, request, TypeAck, ack)
+}
+
+// ReplyNack rejects client message, so client knows it is safe to retry it or should give up depending on error code
+func ReplyNack(conn WSConnection, request *Envelope, err error) error {
+	protocolErr := asProtocolError(conn, err)
+	return Reply(conn, request, TypeNack, protocolErr.payload())
+}
+
+// asProtocolError hides details of unexpected errors from client, logging them instead
+func asProtocolError(conn WSConnection, err error) *ProtocolError {
+	var protocolErr *ProtocolError
+	if !errors.As(err, &protocolErr) {
+		log.Printf("Error handling message from user: %s, connection id: %s, err: %s\n", conn.Principal().Id, conn.Id(), err)
+		protocolErr = NewProtocolError(ErrCodeInternal, "Internal server error")
+	}
+	return protocolErr
+}
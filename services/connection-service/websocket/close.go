@@ -0,0 +1,104 @@
+package websocket
+
+import (
+	"errors"
+	"expvar"
+	"github.com/gorilla/websocket"
+	"net"
+	"time"
+)
+
+// Disconnect causes tell which side ended connection and why, they key ws_disconnects metric
+const (
+	CauseClientClose    = "client_close"
+	CausePingTimeout    = "ping_timeout"
+	CauseReadLimit      = "read_limit"
+	CauseWriteError     = "write_error"
+	CauseConnectionLost = "connection_lost"
+	CauseServerClose    = "server_close"
+	CauseServerShutdown = "server_shutdown"
+)
+
+var disconnects = expvar.NewMap("ws_disconnects")
+
+// CloseStatus describes how connection was closed. Code and Reason are the ones of close frame sent by whichever
+// side closed connection first, abnormal closure code is used when connection was dropped without close frame
+type CloseStatus struct {
+	Code   int
+	Reason string
+	Cause  string
+}
+
+// closeWith records status of connection and closes it, unless it is being closed already. Server initiated
+// close sends close frame and waits until client echoes it or timeout passes, before closing underlying connection
+func (wsc *wsConnection) closeWith(status CloseStatus, sendFrame bool) error {
+	if !wsc.status.CompareAndSwap(nil, &status) {
+		return nil
+	}
+
+	if sendFrame {
+		deadline := time.Now().Add(wsc.config.Timeout)
+		err := wsc.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(status.Code, status.Reason), deadline)
+		if err == nil {
+			// reader stops once it receives close frame of client
+			timer := time.NewTimer(time.Until(deadline))
+			select {
+			case <-wsc.readerDone:
+			case <-timer.C:
+			}
+			timer.Stop()
+		}
+	}
+	return wsc.terminate()
+}
+
+func (wsc *wsConnection) terminate() error {
+	wsc.mut.Lock()
+	defer wsc.mut.Unlock()
+
+	select {
+	case <-wsc.done:
+		return nil
+
+	default:
+		close(wsc.done)
+		wsc.writes.release(wsc.id)
+		disconnects.Add(wsc.status.Load().Cause, 1)
+		return wsc.conn.Close()
+	}
+}
+
+// closing tells whether close frame is sent already or connection is dropped, nothing should be written then
+func (wsc *wsConnection) closing() bool {
+	return wsc.status.Load() != nil
+}
+
+// serverCloseStatus treats going away as shutdown of server, as it is the only case server sends it
+func serverCloseStatus(code int, reason string) CloseStatus {
+	if code == websocket.CloseGoingAway {
+		return CloseStatus{Code: code, Reason: reason, Cause: CauseServerShutdown}
+	}
+	return CloseStatus{Code: code, Reason: reason, Cause: CauseServerClose}
+}
+
+// readErrorStatus tells why reading from connection failed, read deadline is only exceeded when client
+// does not answer pings in time
+func readErrorStatus(err error) CloseStatus {
+	var closeErr *websocket.CloseError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &closeErr):
+		return CloseStatus{Code: closeErr.Code, Reason: closeErr.Text, Cause: CauseClientClose}
+	case errors.Is(err, websocket.ErrReadLimit):
+		// close frame is sent by websocket library in this case
+		return CloseStatus{Code: websocket.CloseMessageTooBig, Reason: "read limit exceeded", Cause: CauseReadLimit}
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return CloseStatus{Code: websocket.CloseAbnormalClosure, Reason: "ping timeout", Cause: CausePingTimeout}
+	default:
+		return CloseStatus{Code: websocket.CloseAbnormalClosure, Reason: err.Error(), Cause: CauseConnectionLost}
+	}
+}
+
+func writeErrorStatus(err error) CloseStatus {
+	return CloseStatus{Code: websocket.CloseAbnormalClosure, Reason: err.Error(), Cause: CauseWriteError}
+}
@@ -0,0 +1,46 @@
+package websocket
+
+import (
+	"fmt"
+	"github.com/gorilla/websocket"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestReadErrorStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected CloseStatus
+	}{
+		{
+			name:     "close frame of client",
+			err:      &websocket.CloseError{Code: websocket.CloseGoingAway, Text: "bye"},
+			expected: CloseStatus{Code: websocket.CloseGoingAway, Reason: "bye", Cause: CauseClientClose},
+		},
+		{
+			name:     "read limit",
+			err:      websocket.ErrReadLimit,
+			expected: CloseStatus{Code: websocket.CloseMessageTooBig, Reason: "read limit exceeded", Cause: CauseReadLimit},
+		},
+		{
+			name:     "missed pong",
+			err:      fmt.Errorf("read: %w", os.ErrDeadlineExceeded),
+			expected: CloseStatus{Code: websocket.CloseAbnormalClosure, Reason: "ping timeout", Cause: CausePingTimeout},
+		},
+		{
+			name:     "connection lost",
+			err:      io.ErrUnexpectedEOF,
+			expected: CloseStatus{Code: websocket.CloseAbnormalClosure, Reason: io.ErrUnexpectedEOF.Error(), Cause: CauseConnectionLost},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if status := readErrorStatus(test.err); status != test.expected {
+				t.Errorf("status is %+v, expected %+v", status, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+	"net/http"
+	"online-chat-go/auth"
+	"sync"
+	"time"
+)
+
+const (
+	SubprotocolJson    = "chat.v1.json"
+	SubprotocolMsgpack = "chat.v1.msgpack"
+)
+
+// Codec encodes envelopes into frames of subprotocol negotiated by connection. Payloads are kept as json
+// inside envelope regardless of codec, so handlers do not depend on it. Strict unmarshal rejects unknown envelope
+// fields, it is meant for client frames only, as frames of other instances may carry fields this one does not know yet
+type Codec interface {
+	Subprotocol() string
+	FrameType() int
+	Marshal(env *Envelope) ([]byte, error)
+	Unmarshal(data []byte, strict bool) (*Envelope, error)
+}
+
+var (
+	JsonCodec    Codec = jsonCodec{}
+	MsgpackCodec Codec = msgpackCodec{}
+)
+
+// CodecFor returns codec of negotiated subprotocol, json is used if client did not ask for any
+func CodecFor(subprotocol string) Codec {
+	if subprotocol == SubprotocolMsgpack {
+		return MsgpackCodec
+	}
+	return JsonCodec
+}
+
+// selectSubprotocol picks the first codec subprotocol offered by client, falling back to token marker,
+// so clients authorizing via Sec-WebSocket-Protocol keep working
+func selectSubprotocol(request *http.Request) string {
+	protocols := websocket.Subprotocols(request)
+	tokenOffered := false
+	for _, protocol := range protocols {
+		switch protocol {
+		case SubprotocolJson, SubprotocolMsgpack:
+			return protocol
+		case auth.TokenSubprotocol:
+			tokenOffered = true
+		}
+	}
+	if tokenOffered {
+		return auth.TokenSubprotocol
+	}
+	return ""
+}
+
+// BusMessage wraps envelope received from notification bus into frame, json envelopes are objects while msgpack
+// ones are maps, so frame type is told by the first byte
+func BusMessage(data []byte) WsMessage {
+	if len(data) > 0 && data[0] == '{' {
+		return WsMessage{Type: websocket.TextMessage, Data: data}
+	}
+	return WsMessage{Type: websocket.BinaryMessage, Data: data}
+}
+
+// Frame is envelope received from notification bus, it is encoded once for every codec used by receiving connections.
+// Origin is only meaningful within cluster, so it is taken out of envelope before encoding it for clients
+type Frame struct {
+	Envelope *Envelope
+	Origin   string
+
+	mut     sync.Mutex
+	encoded map[string]WsMessage
+}
+
+func NewFrame(msg WsMessage) (*Frame, error) {
+	codec := JsonCodec
+	if msg.Type == websocket.BinaryMessage {
+		codec = MsgpackCodec
+	}
+
+	env, err := codec.Unmarshal(msg.Data, false)
+	if err != nil {
+		return nil, err
+	}
+	frame := &Frame{Envelope: env, Origin: env.Origin, encoded: make(map[string]WsMessage)}
+	if env.Origin == "" {
+		frame.encoded[codec.Subprotocol()] = msg
+	}
+	env.Origin = ""
+	return frame, nil
+}
+
+func (f *Frame) EncodeFor(codec Codec) (WsMessage, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	if msg, ok := f.encoded[codec.Subprotocol()]; ok {
+		return msg, nil
+	}
+	msg, err := f.Envelope.Encode(codec)
+	if err == nil {
+		f.encoded[codec.Subprotocol()] = msg
+	}
+	return msg, err
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Subprotocol() string {
+	return SubprotocolJson
+}
+
+func (jsonCodec) FrameType() int {
+	return websocket.TextMessage
+}
+
+func (jsonCodec) Marshal(env *Envelope) ([]byte, error) {
+	return json.Marshal(env)
+}
+
+func (jsonCodec) Unmarshal(data []byte, strict bool) (*Envelope, error) {
+	var env Envelope
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if strict {
+		decoder.DisallowUnknownFields()
+	}
+	if err := decoder.Decode(&env); err != nil {
+		return nil, err
+	}
+	return &env, nil
+}
+
+// msgpackEnvelope mirrors Envelope, with payload being native msgpack value instead of embedded json
+type msgpackEnvelope struct {
+	Version         int        `msgpack:"v"`
+	Type            string     `msgpack:"type"`
+	Id              string     `msgpack:"id,omitempty"`
+	ConversationId  string     `msgpack:"conversation,omitempty"`
+	Payload         any        `msgpack:"payload,omitempty"`
+	ClientTimestamp *time.Time `msgpack:"client_ts,omitempty"`
+	CorrelationId   string     `msgpack:"correlation_id,omitempty"`
+	Origin          string     `msgpack:"origin,omitempty"`
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Subprotocol() string {
+	return SubprotocolMsgpack
+}
+
+func (msgpackCodec) FrameType() int {
+	return websocket.BinaryMessage
+}
+
+func (msgpackCodec) Marshal(env *Envelope) ([]byte, error) {
+	packed := msgpackEnvelope{
+		Version:         env.Version,
+		Type:            env.Type,
+		Id:              env.Id,
+		ConversationId:  env.ConversationId,
+		ClientTimestamp: env.ClientTimestamp,
+		CorrelationId:   env.CorrelationId,
+		Origin:          env.Origin,
+	}
+	if len(env.Payload) > 0 {
+		decoder := json.NewDecoder(bytes.NewReader(env.Payload))
+		decoder.UseNumber()
+		if err := decoder.Decode(&packed.Payload); err != nil {
+			return nil, err
+		}
+		packed.Payload = packNumbers(packed.Payload)
+	}
+	return msgpack.Marshal(&packed)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, strict bool) (*Envelope, error) {
+	var packed msgpackEnvelope
+	decoder := msgpack.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields(strict)
+	if err := decoder.Decode(&packed); err != nil {
+		return nil, err
+	}
+
+	env := &Envelope{
+		Version:         packed.Version,
+		Type:            packed.Type,
+		Id:              packed.Id,
+		ConversationId:  packed.ConversationId,
+		ClientTimestamp: packed.ClientTimestamp,
+		CorrelationId:   packed.CorrelationId,
+		Origin:          packed.Origin,
+	}
+	if packed.Payload != nil {
+		payload, err := json.Marshal(packed.Payload)
+		if err != nil {
+			return nil, err
+		}
+		env.Payload = payload
+	}
+	return env, nil
+}
+
+// packNumbers turns json numbers into integers where possible, so they are not packed as strings or floats
+func packNumbers(value any) any {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]any:
+		for key, item := range v {
+			v[key] = packNumbers(item)
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = packNumbers(item)
+		}
+	}
+	return value
+}
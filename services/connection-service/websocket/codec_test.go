@@ -0,0 +1,64 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/vmihailenco/msgpack/v5"
+	"testing"
+)
+
+func TestFrameStripsOrigin(t *testing.T) {
+	for _, busCodec := range []Codec{JsonCodec, MsgpackCodec} {
+		env := &Envelope{Version: ProtocolVersion, Type: "message", Id: "id", Origin: "connection-id"}
+		data, err := busCodec.Marshal(env)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		frame, err := NewFrame(WsMessage{Type: busCodec.FrameType(), Data: data})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.Origin != "connection-id" {
+			t.Errorf("origin of %s frame is %q, expected connection-id", busCodec.Subprotocol(), frame.Origin)
+		}
+
+		for _, codec := range []Codec{JsonCodec, MsgpackCodec} {
+			msg, err := frame.EncodeFor(codec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(msg.Data, []byte("connection-id")) {
+				t.Errorf("%s frame encoded for %s contains origin", busCodec.Subprotocol(), codec.Subprotocol())
+			}
+		}
+	}
+}
+
+func TestOnlyClientFramesRejectUnknownFields(t *testing.T) {
+	type futureEnvelope struct {
+		Version int    `json:"v" msgpack:"v"`
+		Type    string `json:"type" msgpack:"type"`
+		Future  string `json:"future" msgpack:"future"`
+	}
+	future := futureEnvelope{Version: ProtocolVersion, Type: "message", Future: "field"}
+
+	jsonData, err := json.Marshal(future)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgpackData, err := msgpack.Marshal(future)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for codec, data := range map[Codec][]byte{JsonCodec: jsonData, MsgpackCodec: msgpackData} {
+		msg := WsMessage{Type: codec.FrameType(), Data: data}
+		if _, err := NewFrame(msg); err != nil {
+			t.Errorf("%s bus frame with unknown field is rejected: %s", codec.Subprotocol(), err)
+		}
+		if _, err := DecodeEnvelope(codec, msg); err == nil {
+			t.Errorf("%s client frame with unknown field is accepted", codec.Subprotocol())
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package websocket
+
+import (
+	"bufio"
+	"errors"
+	"expvar"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+const deflateExtension = "permessage-deflate"
+
+// Compression metrics are published via expvar. Only data messages of connections which negotiated compression
+// are accounted, ratio is the number of bytes written to network, framing included, per byte of payload
+var (
+	compressionPayloadBytes = expvar.NewInt("ws_compression_payload_bytes")
+	compressionWireBytes    = expvar.NewInt("ws_compression_wire_bytes")
+	compressedMessages      = expvar.NewInt("ws_compressed_messages")
+	uncompressedMessages    = expvar.NewInt("ws_uncompressed_messages")
+)
+
+func init() {
+	expvar.Publish("ws_compression_ratio", expvar.Func(func() any {
+		payload := compressionPayloadBytes.Value()
+		if payload == 0 {
+			return 1.0
+		}
+		return float64(compressionWireBytes.Value()) / float64(payload)
+	}))
+}
+
+// offersCompression tells whether client offered permessage-deflate, upgrader accepts it whenever it is offered
+func offersCompression(request *http.Request) bool {
+	for _, header := range request.Header.Values("Sec-Websocket-Extensions") {
+		for _, extension := range strings.Split(header, ",") {
+			name, _, _ := strings.Cut(extension, ";")
+			if strings.TrimSpace(name) == deflateExtension {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// meteredResponseWriter hands out hijacked connection which could count bytes written to network
+type meteredResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w meteredResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Response does not support hijacking")
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &meteredConn{Conn: conn}, rw, nil
+}
+
+// meteredConn only counts bytes while data message is written, so handshake response and control frames
+// written between data messages are not accounted
+type meteredConn struct {
+	net.Conn
+	counting atomic.Bool
+}
+
+func (c *meteredConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if c.counting.Load() {
+		compressionWireBytes.Add(int64(n))
+	}
+	return n, err
+}
+
+// measure counts bytes written to network by write
+func (c *meteredConn) measure(write func() error) error {
+	c.counting.Store(true)
+	defer c.counting.Store(false)
+	return write()
+}
@@ -1,111 +1,312 @@
 package websocket
 
 import (
+	"errors"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"net/url"
+	"online-chat-go/auth"
 	"online-chat-go/config"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	CloseTokenExpired       = 4001
+	CloseSessionRevoked     = 4003
+	CloseSlowConsumer       = 4008
+	CloseTooManyConnections = 4009
+	CloseRateLimited        = 4029
+)
+
+var ErrConnectionClosed = errors.New("Connection is closed")
+
+// WsMessage Key identifies messages which supersede each other, such as typing state of user, so only the latest
+// of them has to be queued when connection falls behind. Messages without key are never coalesced.
+// Written is called by writer of connection once message is written to socket, it is not called for messages
+// which were dropped or could not be written
 type WsMessage struct {
-	Type int
-	Data []byte
+	Type    int
+	Data    []byte
+	Key     string
+	Written func()
+}
+
+type closeRequest struct {
+	code   int
+	reason string
 }
 
 type wsConnection struct {
 	id        string
-	writePump chan WsMessage
+	query     url.Values
+	principal atomic.Pointer[auth.Principal]
+	reauth    chan *auth.Principal
+	drain     chan closeRequest
+	writes    *writeQueue
 	readPump  chan WsMessage
 	mut       *sync.Mutex // to prevent multiple goroutines from closing done channel
 	done      chan bool
-	config    *config.WsConfig
-	conn      *websocket.Conn
+	// status is set by whichever side starts closing connection first
+	status     atomic.Pointer[CloseStatus]
+	readerDone chan struct{}
+	config     *config.WsConfig
+	codec      Codec
+	// compressed tells whether client negotiated permessage-deflate
+	compressed bool
+	conn       *websocket.Conn
 }
 
 type WSConnection interface {
 	Id() string
-	WritePump() chan<- WsMessage
+	// Write queues message without blocking, applying slow consumer policy if queue is full
+	Write(msg WsMessage) error
+	// WriteWait queues message once there is room for it, it is meant for producers which could wait for client
+	WriteWait(msg WsMessage) error
 	ReadPump() <-chan WsMessage
 	Done() <-chan bool
+	// CloseStatus tells how connection was closed, it is nil until Done is closed
+	CloseStatus() *CloseStatus
 	Close() error
+	CloseWithReason(code int, reason string) error
+	// Drain closes connection with given code and reason once queued messages are written
+	Drain(code int, reason string) error
+	Principal() *auth.Principal
+	Reauthenticate(principal *auth.Principal) error
+	Query() url.Values
+	// Codec encodes envelopes for subprotocol negotiated on handshake
+	Codec() Codec
 }
 
 func (wsc *wsConnection) Id() string {
 	return wsc.id
 }
 
-func (wsc *wsConnection) WritePump() chan<- WsMessage {
-	return wsc.writePump
+func (wsc *wsConnection) Write(msg WsMessage) error {
+	select {
+	case <-wsc.done:
+		return ErrConnectionClosed
+	default:
+	}
+
+	if err := wsc.writes.push(msg); err != nil {
+		slowConsumerDisconnects.Add(1)
+		// close frame could take long to get through, as connection is slow already
+		go func() { _ = wsc.CloseWithReason(CloseSlowConsumer, "slow consumer") }()
+		return ErrConnectionClosed
+	}
+	return nil
+}
+
+func (wsc *wsConnection) WriteWait(msg WsMessage) error {
+	for !wsc.writes.tryPush(msg) {
+		select {
+		case <-wsc.done:
+			return ErrConnectionClosed
+		case <-wsc.writes.drained:
+		}
+	}
+	return nil
 }
 
 func (wsc *wsConnection) ReadPump() <-chan WsMessage {
 	return wsc.readPump
 }
 
+// Close performs close handshake with normal closure code
 func (wsc *wsConnection) Close() error {
-	wsc.mut.Lock()
-	defer wsc.mut.Unlock()
+	return wsc.CloseWithReason(websocket.CloseNormalClosure, "")
+}
 
+// CloseWithReason sends close frame with given code and reason, underlying connection is closed once client
+// answers with close frame or timeout passes
+func (wsc *wsConnection) CloseWithReason(code int, reason string) error {
+	return wsc.closeWith(serverCloseStatus(code, reason), true)
+}
+
+func (wsc *wsConnection) Drain(code int, reason string) error {
 	select {
 	case <-wsc.done:
 		return nil
-
-	default:
-		close(wsc.done)
-		return wsc.conn.Close()
+	case wsc.drain <- closeRequest{code: code, reason: reason}:
 	}
+
+	<-wsc.done
+	return nil
 }
 
 func (wsc *wsConnection) Done() <-chan bool {
 	return wsc.done
 }
 
+func (wsc *wsConnection) CloseStatus() *CloseStatus {
+	select {
+	case <-wsc.done:
+		return wsc.status.Load()
+	default:
+		return nil
+	}
+}
+
+// Query returns query parameters of handshake request
+func (wsc *wsConnection) Query() url.Values {
+	return wsc.query
+}
+
+func (wsc *wsConnection) Codec() Codec {
+	return wsc.codec
+}
+
+func (wsc *wsConnection) Principal() *auth.Principal {
+	return wsc.principal.Load()
+}
+
+// Reauthenticate replaces credentials connection was opened with, prolonging its lifetime up to new expiry
+func (wsc *wsConnection) Reauthenticate(principal *auth.Principal) error {
+	if principal.Id != wsc.Principal().Id {
+		return errors.New("Could not reauthenticate connection as different user")
+	}
+
+	wsc.principal.Store(principal)
+	select {
+	case <-wsc.done:
+		return ErrConnectionClosed
+	case wsc.reauth <- principal:
+		return nil
+	}
+}
+
 func (wsc *wsConnection) runWriter() {
 	ticker := time.NewTicker(wsc.config.PingInterval)
 	defer ticker.Stop()
 
+	var expiry *time.Timer
+	var expired <-chan time.Time
+	resetExpiry := func(principal *auth.Principal) {
+		if expiry != nil {
+			expiry.Stop()
+		}
+		expiry, expired = nil, nil
+		if !principal.ExpiresAt.IsZero() {
+			expiry = time.NewTimer(time.Until(principal.ExpiresAt))
+			expired = expiry.C
+		}
+	}
+	resetExpiry(wsc.Principal())
+	defer func() {
+		if expiry != nil {
+			expiry.Stop()
+		}
+	}()
+
 	for {
 		select {
 		case <-wsc.done:
 			return
 
+		case <-expired:
+			_ = wsc.CloseWithReason(CloseTokenExpired, "token expired")
+			return
+
+		case principal := <-wsc.reauth:
+			resetExpiry(principal)
+
+		case request := <-wsc.drain:
+			if err := wsc.writeQueued(); err != nil {
+				return
+			}
+			_ = wsc.CloseWithReason(request.code, request.reason)
+			return
+
 		case <-ticker.C:
 			if err := wsc.write(websocket.PingMessage, []byte{}); err != nil {
 				return
 			}
 
-		case msg := <-wsc.writePump:
-			if err := wsc.write(msg.Type, msg.Data); err != nil {
+		case <-wsc.writes.ready:
+			if err := wsc.writeQueued(); err != nil {
 				return
 			}
 		}
 	}
 }
 
+func (wsc *wsConnection) writeQueued() error {
+	for _, msg := range wsc.writes.popAll() {
+		if err := wsc.write(msg.Type, msg.Data); err != nil {
+			return err
+		}
+		if msg.Written != nil {
+			msg.Written()
+		}
+	}
+	return nil
+}
+
 func (wsc *wsConnection) write(msgType int, msgData []byte) error {
+	if wsc.closing() {
+		return ErrConnectionClosed
+	}
+	if wsc.compressed {
+		wsc.toggleCompression(msgType, msgData)
+	}
+
 	_ = wsc.conn.SetWriteDeadline(time.Now().Add(wsc.config.Timeout))
-	err := wsc.conn.WriteMessage(msgType, msgData)
+	writeMessage := func() error { return wsc.conn.WriteMessage(msgType, msgData) }
+	var err error
+	if metered, ok := wsc.conn.UnderlyingConn().(*meteredConn); ok && isDataMessage(msgType) {
+		err = metered.measure(writeMessage)
+	} else {
+		err = writeMessage()
+	}
 	if err != nil {
-		_ = wsc.Close()
+		_ = wsc.closeWith(writeErrorStatus(err), false)
 	}
 
 	return err
 }
 
+// toggleCompression decides whether data message should be compressed and accounts it in metrics. Control frames
+// are never compressed, neither are small messages as deflate overhead could make them even larger
+func (wsc *wsConnection) toggleCompression(msgType int, msgData []byte) {
+	if !isDataMessage(msgType) {
+		return
+	}
+
+	compress := len(msgData) >= wsc.config.Compression.MinSize
+	wsc.conn.EnableWriteCompression(compress)
+	compressionPayloadBytes.Add(int64(len(msgData)))
+	if compress {
+		compressedMessages.Add(1)
+	} else {
+		uncompressedMessages.Add(1)
+	}
+}
+
+func isDataMessage(msgType int) bool {
+	return msgType == websocket.TextMessage || msgType == websocket.BinaryMessage
+}
+
+// runReader keeps reading until close frame is received or connection fails, so close handshake could complete.
+// Messages received after server sent close frame are discarded
 func (wsc *wsConnection) runReader() {
+	defer close(wsc.readerDone)
+
 	for {
+		msgType, msgData, err := wsc.conn.ReadMessage()
+		if err != nil {
+			_ = wsc.closeWith(readErrorStatus(err), false)
+			return
+		}
+		if wsc.closing() {
+			continue
+		}
+
 		select {
 		case <-wsc.done:
 			return
-
-		default:
-			if msgType, msgData, err := wsc.conn.ReadMessage(); err != nil {
-				_ = wsc.Close()
-				return
-			} else {
-				wsc.readPump <- WsMessage{Type: msgType, Data: msgData}
-			}
+		case wsc.readPump <- WsMessage{Type: msgType, Data: msgData}:
 		}
 	}
 }
@@ -119,26 +320,36 @@ func (wsc *wsConnection) setUp() {
 		return nil
 	}
 	wsc.conn.SetPongHandler(pongHandler)
+	if wsc.compressed {
+		_ = wsc.conn.SetCompressionLevel(wsc.config.Compression.Level)
+	}
 
 	go wsc.runWriter()
 	go wsc.runReader()
 }
 
-func NewWsConnection(conn *websocket.Conn, config *config.WsConfig) (WSConnection, error) {
+func NewWsConnection(conn *websocket.Conn, query url.Values, principal *auth.Principal, config *config.WsConfig, compressed bool) (WSConnection, error) {
 	id, err := uuid.NewUUID()
 	if err != nil {
 		return nil, err
 	}
 
 	wsc := &wsConnection{
-		id:        id.String(),
-		conn:      conn,
-		config:    config,
-		writePump: make(chan WsMessage, config.BufferSize),
-		readPump:  make(chan WsMessage, config.BufferSize),
-		mut:       &sync.Mutex{},
-		done:      make(chan bool),
+		id:         id.String(),
+		query:      query,
+		reauth:     make(chan *auth.Principal),
+		drain:      make(chan closeRequest),
+		conn:       conn,
+		config:     config,
+		codec:      CodecFor(conn.Subprotocol()),
+		compressed: compressed,
+		writes:     newWriteQueue(id.String(), int(config.BufferSize), config.SlowConsumer),
+		readPump:   make(chan WsMessage, config.BufferSize),
+		mut:        &sync.Mutex{},
+		done:       make(chan bool),
+		readerDone: make(chan struct{}),
 	}
+	wsc.principal.Store(principal)
 
 	wsc.setUp()
 	return wsc, nil
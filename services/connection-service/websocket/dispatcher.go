@@ -0,0 +1,109 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"online-chat-go/auth"
+)
+
+type Handler func(ctx context.Context, conn WSConnection, env *Envelope) error
+
+type originKey struct{}
+
+// WithOrigin stores id of connection request came from in context passed to handlers
+func WithOrigin(ctx context.Context, connId string) context.Context {
+	return context.WithValue(ctx, originKey{}, connId)
+}
+
+// Origin returns id of connection request came from, empty string if it did not come from websocket
+func Origin(ctx context.Context) string {
+	origin, _ := ctx.Value(originKey{}).(string)
+	return origin
+}
+
+// FrameLimiter limits frames received from single connection, frames it rejects are reported to client with its
+// error instead of being dispatched. Take is called before frame is decoded, so malformed frames are limited too,
+// Allow is called for decoded envelope and could be used for limits depending on its contents
+type FrameLimiter interface {
+	Take() error
+	Allow(ctx context.Context, env *Envelope) error
+}
+
+// RateLimit creates limiter of frames received from connection
+type RateLimit func(conn WSConnection) FrameLimiter
+
+// Dispatcher routes client frames to handlers registered for envelope type
+type Dispatcher struct {
+	handlers  map[string]Handler
+	rateLimit RateLimit
+}
+
+func NewDispatcher() *Dispatcher {
+	return &Dispatcher{handlers: make(map[string]Handler)}
+}
+
+// Register should be called before dispatcher starts serving connections
+func (d *Dispatcher) Register(msgType string, handler Handler) {
+	if _, ok := d.handlers[msgType]; ok {
+		panic(fmt.Sprintf("handler for message type %s is already registered", msgType))
+	}
+	d.handlers[msgType] = handler
+}
+
+// SetRateLimit should be called before dispatcher starts serving connections
+func (d *Dispatcher) SetRateLimit(rateLimit RateLimit) {
+	d.rateLimit = rateLimit
+}
+
+// Serve reads frames from connection until it is closed, could be passed to NewWsHandler as connection handler
+func (d *Dispatcher) Serve(_ *auth.Principal, conn WSConnection) {
+	ctx, cancel := context.WithCancel(WithOrigin(context.Background(), conn.Id()))
+	defer cancel()
+	var limit FrameLimiter
+	if d.rateLimit != nil {
+		limit = d.rateLimit(conn)
+	}
+
+	for {
+		select {
+		case <-conn.Done():
+			return
+
+		case msg := <-conn.ReadPump():
+			var env *Envelope
+			var err error
+			if limit != nil {
+				err = limit.Take()
+			}
+			if err == nil {
+				env, err = DecodeEnvelope(conn.Codec(), msg)
+			}
+			if err == nil && limit != nil {
+				err = limit.Allow(ctx, env)
+			}
+			if err == nil {
+				err = d.dispatch(ctx, conn, env)
+			}
+
+			if err != nil {
+				d.reportError(conn, env, err)
+			}
+		}
+	}
+}
+
+func (d *Dispatcher) dispatch(ctx context.Context, conn WSConnection, env *Envelope) error {
+	handler, ok := d.handlers[env.Type]
+	if !ok {
+		return NewProtocolError(ErrCodeUnknownType, fmt.Sprintf("Unknown message type: %s", env.Type))
+	}
+	return handler(ctx, conn, env)
+}
+
+func (d *Dispatcher) reportError(conn WSConnection, env *Envelope, err error) {
+	if err = ReplyError(conn, env, asProtocolError(conn, err)); err != nil && !errors.Is(err, ErrConnectionClosed) {
+		log.Println("Error replying to client: ", err)
+	}
+}
@@ -0,0 +1,166 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const ProtocolVersion = 1
+
+const (
+	maxTypeLength = 32
+	maxIdLength   = 64
+)
+
+const (
+	ErrCodeMalformed          = "malformed"
+	ErrCodeUnsupportedVersion = "unsupported_version"
+	ErrCodeUnknownType        = "unknown_type"
+	ErrCodeInvalid            = "invalid"
+	ErrCodeUnauthorized       = "unauthorized"
+	ErrCodeForbidden          = "forbidden"
+	ErrCodeNotFound           = "not_found"
+	ErrCodeRateLimited        = "rate_limited"
+	ErrCodeInProgress         = "in_progress"
+	ErrCodeInternal           = "internal"
+)
+
+const TypeError = "error"
+
+// Envelope wraps every frame exchanged with clients, Id is assigned by sender of the frame,
+// CorrelationId references Id of the frame this one responds to. Origin is set by server on frames caused
+// by client request and holds id of the connection request came from, such frames are not delivered back to it
+type Envelope struct {
+	Version         int             `json:"v"`
+	Type            string          `json:"type"`
+	Id              string          `json:"id,omitempty"`
+	ConversationId  string          `json:"conversation,omitempty"`
+	Payload         json.RawMessage `json:"payload,omitempty"`
+	ClientTimestamp *time.Time      `json:"client_ts,omitempty"`
+	CorrelationId   string          `json:"correlation_id,omitempty"`
+	Origin          string          `json:"origin,omitempty"`
+}
+
+// ErrorPayload RetryAfterMs tells client how long it should wait before retrying, it is only set for errors
+// which are worth retrying such as rate limited or in progress ones
+type ErrorPayload struct {
+	Code         string `json:"code"`
+	Message      string `json:"message"`
+	RetryAfterMs int64  `json:"retry_after_ms,omitempty"`
+}
+
+// ProtocolError is reported back to client as error frame, any other error returned by handler is hidden behind
+// generic internal error
+type ProtocolError struct {
+	Code       string
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (err *ProtocolError) Error() string {
+	return fmt.Sprintf("%s: %s", err.Code, err.Message)
+}
+
+func NewProtocolError(code string, message string) *ProtocolError {
+	return &ProtocolError{Code: code, Message: message}
+}
+
+// NewRateLimitedError tells client that frame was rejected as it exceeds rate limits and when it could be retried
+func NewRateLimitedError(retryAfter time.Duration) *ProtocolError {
+	return &ProtocolError{Code: ErrCodeRateLimited, Message: "Rate limit exceeded", RetryAfter: retryAfter}
+}
+
+func (err *ProtocolError) payload() ErrorPayload {
+	return ErrorPayload{Code: err.Code, Message: err.Message, RetryAfterMs: err.RetryAfter.Milliseconds()}
+}
+
+func NewEnvelope(msgType string, payload any) (*Envelope, error) {
+	env := &Envelope{Version: ProtocolVersion, Type: msgType}
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		env.Payload = data
+	}
+	return env, nil
+}
+
+// DecodeEnvelope parses and validates client frame encoded with negotiated codec, on failure envelope is still
+// returned if it was possible to decode it at all, so error could reference client's message id
+func DecodeEnvelope(codec Codec, msg WsMessage) (*Envelope, error) {
+	if msg.Type != codec.FrameType() {
+		return nil, NewProtocolError(ErrCodeMalformed, fmt.Sprintf("Frame type does not match subprotocol %s", codec.Subprotocol()))
+	}
+
+	env, err := codec.Unmarshal(msg.Data, true)
+	if err != nil {
+		return nil, NewProtocolError(ErrCodeMalformed, "Frame is not a valid envelope")
+	}
+
+	return env, env.validate()
+}
+
+func (env *Envelope) validate() error {
+	switch {
+	case env.Version != ProtocolVersion:
+		return NewProtocolError(ErrCodeUnsupportedVersion, fmt.Sprintf("Unsupported protocol version, expected %d", ProtocolVersion))
+	case env.Type == "" || len(env.Type) > maxTypeLength:
+		return NewProtocolError(ErrCodeInvalid, "Message type should be non empty and at most 32 characters long")
+	case len(env.Id) > maxIdLength:
+		return NewProtocolError(ErrCodeInvalid, "Message id should be at most 64 characters long")
+	case len(env.CorrelationId) > maxIdLength:
+		return NewProtocolError(ErrCodeInvalid, "Correlation id should be at most 64 characters long")
+	case env.Origin != "":
+		return NewProtocolError(ErrCodeInvalid, "Origin could only be set by server")
+	}
+	return nil
+}
+
+// DecodePayload unmarshals envelope payload into target, reporting failure as protocol error
+func (env *Envelope) DecodePayload(target any) error {
+	if len(env.Payload) == 0 {
+		return NewProtocolError(ErrCodeInvalid, "Payload is required")
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(env.Payload))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(target); err != nil {
+		return NewProtocolError(ErrCodeInvalid, fmt.Sprintf("Malformed payload for message type %s", env.Type))
+	}
+	return nil
+}
+
+func (env *Envelope) Encode(codec Codec) (WsMessage, error) {
+	data, err := codec.Marshal(env)
+	return WsMessage{Type: codec.FrameType(), Data: data}, err
+}
+
+// Send queues envelope encoded with codec of connection without blocking. Once queue of connection is full,
+// frame is dropped or coalesced according to slow consumer policy, or ErrSlowConsumer is returned
+func Send(conn WSConnection, env *Envelope) error {
+	msg, err := env.Encode(conn.Codec())
+	if err != nil {
+		return err
+	}
+	return conn.Write(msg)
+}
+
+// Reply sends envelope of given type correlated with request
+func Reply(conn WSConnection, request *Envelope, msgType string, payload any) error {
+	env, err := NewEnvelope(msgType, payload)
+	if err != nil {
+		return err
+	}
+	if request != nil {
+		env.CorrelationId = request.Id
+		env.ConversationId = request.ConversationId
+	}
+	return Send(conn, env)
+}
+
+func ReplyError(conn WSConnection, request *Envelope, protocolErr *ProtocolError) error {
+	return Reply(conn, request, TypeError, protocolErr.payload())
+}
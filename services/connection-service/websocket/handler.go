@@ -1,6 +1,7 @@
 package websocket
 
 import (
+	"errors"
 	"github.com/gorilla/websocket"
 	"log"
 	"net/http"
@@ -8,29 +9,59 @@ import (
 	"online-chat-go/config"
 )
 
+// websocketUpgrader accepts any origin, origin only matters for credentials browser sends on its own,
+// so it is checked by cookie authorizer
 var websocketUpgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
 	CheckOrigin:     func(r *http.Request) bool { return true },
 }
 
-func NewWsHandler(wss *WSServer, authorizer auth.Authorizer, config *config.WsConfig, connHandler func(string, WSConnection)) func(w http.ResponseWriter, r *http.Request) {
+func NewWsHandler(wss *WSServer, authorizer auth.Authorizer, config *config.WsConfig, connHandler func(*auth.Principal, WSConnection)) func(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocketUpgrader
+	upgrader.EnableCompression = config.Compression.Enabled
+
 	return func(writer http.ResponseWriter, request *http.Request) {
+		// refused upgrades are answered before handshake, so load balancer could retry them on another instance
+		if wss.Draining() {
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = writer.Write([]byte(ErrServerDraining.Error()))
+			return
+		}
+		if wss.Full() {
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = writer.Write([]byte(ErrServerFull.Error()))
+			return
+		}
+
 		principal, err := authorizer.Authorize(request)
 		if err != nil {
 			writer.WriteHeader(http.StatusUnauthorized)
 			_, _ = writer.Write([]byte(err.Error()))
 			return
 		}
+		if wss.UserFull(principal.Id) {
+			writer.WriteHeader(http.StatusTooManyRequests)
+			_, _ = writer.Write([]byte(ErrTooManyConnections.Error()))
+			return
+		}
 
-		conn, err := websocketUpgrader.Upgrade(writer, request, nil)
+		var responseHeader http.Header
+		if subprotocol := selectSubprotocol(request); subprotocol != "" {
+			responseHeader = http.Header{"Sec-Websocket-Protocol": []string{subprotocol}}
+		}
+		compressed := upgrader.EnableCompression && offersCompression(request)
+		if compressed {
+			writer = meteredResponseWriter{ResponseWriter: writer}
+		}
+		conn, err := upgrader.Upgrade(writer, request, responseHeader)
 		if err != nil {
 			log.Println(err)
 			return
 		}
 
 		userId := principal.Id
-		wsconn, err := NewWsConnection(conn, config)
+		wsconn, err := NewWsConnection(conn, request.URL.Query(), principal, config, compressed)
 		if err != nil {
 			log.Println(err)
 			return
@@ -38,11 +69,29 @@ func NewWsHandler(wss *WSServer, authorizer auth.Authorizer, config *config.WsCo
 		log.Printf("connected user via websocket with id: %s, connection id: %s\n", userId, wsconn.Id())
 
 		go func() {
-			_ = wss.AddConnection(userId, wsconn)
+			// limits could be reached by concurrent handshakes after they were checked
+			if err := wss.AddConnection(userId, wsconn); err != nil {
+				_ = wsconn.CloseWithReason(rejectionCloseCode(err), err.Error())
+				return
+			}
 			defer func() { _ = wss.RemoveConnection(userId, wsconn) }()
 
-			connHandler(userId, wsconn)
-			log.Printf("disconnected user connected via websocket with id: %s, connection id: %s\n", userId, wsconn.Id())
+			connHandler(principal, wsconn)
+			<-wsconn.Done()
+			status := wsconn.CloseStatus()
+			log.Printf("disconnected user connected via websocket with id: %s, connection id: %s, cause: %s, code: %d, reason: %s\n",
+				userId, wsconn.Id(), status.Cause, status.Code, status.Reason)
 		}()
 	}
 }
+
+func rejectionCloseCode(err error) int {
+	switch {
+	case errors.Is(err, ErrServerDraining):
+		return websocket.CloseGoingAway
+	case errors.Is(err, ErrServerFull):
+		return websocket.CloseTryAgainLater
+	default:
+		return CloseTooManyConnections
+	}
+}
@@ -0,0 +1,153 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"online-chat-go/config"
+	"sync"
+)
+
+var ErrSlowConsumer = errors.New("Connection does not keep up with its messages")
+
+var (
+	writeQueueDepth         = expvar.NewMap("ws_write_queue_depth")
+	droppedMessages         = expvar.NewInt("ws_dropped_messages")
+	coalescedMessages       = expvar.NewInt("ws_coalesced_messages")
+	slowConsumerDisconnects = expvar.NewInt("ws_slow_consumer_disconnects")
+)
+
+// writeQueue holds messages until writer of connection sends them, it never blocks producers.
+// Once queue is full, slow consumer policy decides what happens to incoming message
+type writeQueue struct {
+	mut      sync.Mutex
+	messages []WsMessage
+	capacity int
+	policy   string
+	ready    chan struct{}
+	drained  chan struct{}
+	depth    *expvar.Int
+}
+
+func newWriteQueue(connId string, capacity int, policy string) *writeQueue {
+	depth := new(expvar.Int)
+	writeQueueDepth.Set(connId, depth)
+	return &writeQueue{
+		capacity: capacity,
+		policy:   policy,
+		ready:    make(chan struct{}, 1),
+		drained:  make(chan struct{}, 1),
+		depth:    depth,
+	}
+}
+
+// push returns ErrSlowConsumer if connection should be closed according to policy. Only keyed messages are
+// ephemeral enough to be dropped or coalesced, anything else overflowing the queue disconnects client, so it
+// learns about the gap and catches up on reconnect instead of silently missing the message
+func (q *writeQueue) push(msg WsMessage) error {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	if msg.Key != "" && q.policy == config.SlowConsumerCoalesce {
+		for i := range q.messages {
+			if q.messages[i].Key == msg.Key {
+				q.messages[i] = msg
+				coalescedMessages.Add(1)
+				return nil
+			}
+		}
+	}
+
+	if len(q.messages) >= q.capacity {
+		if msg.Key == "" {
+			return ErrSlowConsumer
+		}
+
+		switch q.policy {
+		case config.SlowConsumerDropOldest:
+			oldest := q.oldestKeyed()
+			if oldest < 0 {
+				return ErrSlowConsumer
+			}
+			q.messages = append(q.messages[:oldest], q.messages[oldest+1:]...)
+			droppedMessages.Add(1)
+		case config.SlowConsumerDropNewest:
+			droppedMessages.Add(1)
+			return nil
+		default:
+			return ErrSlowConsumer
+		}
+	}
+
+	q.append(msg)
+	return nil
+}
+
+// oldestKeyed returns index of the oldest message which could be dropped, -1 if there is none
+func (q *writeQueue) oldestKeyed() int {
+	for i := range q.messages {
+		if q.messages[i].Key != "" {
+			return i
+		}
+	}
+	return -1
+}
+
+// tryPush queues message only if there is room for it, regardless of policy
+func (q *writeQueue) tryPush(msg WsMessage) bool {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	if len(q.messages) >= q.capacity {
+		return false
+	}
+	q.append(msg)
+	return true
+}
+
+func (q *writeQueue) append(msg WsMessage) {
+	q.messages = append(q.messages, msg)
+	q.depth.Set(int64(len(q.messages)))
+	notify(q.ready)
+}
+
+// popAll takes all queued messages in order they were pushed
+func (q *writeQueue) popAll() []WsMessage {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	messages := q.messages
+	q.messages = nil
+	q.depth.Set(0)
+	notify(q.drained)
+	return messages
+}
+
+func (q *writeQueue) release(connId string) {
+	writeQueueDepth.Delete(connId)
+}
+
+func notify(signal chan struct{}) {
+	select {
+	case signal <- struct{}{}:
+	default:
+	}
+}
+
+// PayloadKey builds coalescing key of envelopes from their type, conversation and given string fields of payload,
+// so envelopes of the same type about the same subject supersede each other
+func PayloadKey(fields ...string) func(env *Envelope) string {
+	return func(env *Envelope) string {
+		var payload map[string]any
+		if err := json.Unmarshal(env.Payload, &payload); err != nil {
+			return ""
+		}
+
+		key := env.Type + "/" + env.ConversationId
+		for _, field := range fields {
+			value, _ := payload[field].(string)
+			key += "/" + value
+		}
+		return key
+	}
+}
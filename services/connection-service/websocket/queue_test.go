@@ -0,0 +1,171 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"online-chat-go/config"
+	"testing"
+)
+
+// queued builds message whose data identifies it, empty key makes it a message which could not be dropped
+func queued(data string, key string) WsMessage {
+	return WsMessage{Data: []byte(data), Key: key}
+}
+
+func TestWriteQueuePush(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   string
+		queued   []WsMessage
+		pushed   WsMessage
+		err      error
+		expected []string
+	}{
+		{
+			name:     "queue with room accepts any message",
+			policy:   config.SlowConsumerDisconnect,
+			queued:   []WsMessage{queued("a", "")},
+			pushed:   queued("b", ""),
+			expected: []string{"a", "b"},
+		},
+		{
+			name:     "disconnect on full queue",
+			policy:   config.SlowConsumerDisconnect,
+			queued:   []WsMessage{queued("a", "typing"), queued("b", "presence")},
+			pushed:   queued("c", "typing"),
+			err:      ErrSlowConsumer,
+			expected: []string{"a", "b"},
+		},
+		{
+			name:     "drop oldest drops the oldest keyed message",
+			policy:   config.SlowConsumerDropOldest,
+			queued:   []WsMessage{queued("a", ""), queued("b", "typing")},
+			pushed:   queued("c", "presence"),
+			expected: []string{"a", "c"},
+		},
+		{
+			name:     "drop oldest disconnects if nothing could be dropped",
+			policy:   config.SlowConsumerDropOldest,
+			queued:   []WsMessage{queued("a", ""), queued("b", "")},
+			pushed:   queued("c", "typing"),
+			err:      ErrSlowConsumer,
+			expected: []string{"a", "b"},
+		},
+		{
+			name:     "drop oldest disconnects on message without key",
+			policy:   config.SlowConsumerDropOldest,
+			queued:   []WsMessage{queued("a", "typing"), queued("b", "typing")},
+			pushed:   queued("c", ""),
+			err:      ErrSlowConsumer,
+			expected: []string{"a", "b"},
+		},
+		{
+			name:     "drop newest drops keyed message",
+			policy:   config.SlowConsumerDropNewest,
+			queued:   []WsMessage{queued("a", ""), queued("b", "")},
+			pushed:   queued("c", "typing"),
+			expected: []string{"a", "b"},
+		},
+		{
+			name:     "drop newest disconnects on message without key",
+			policy:   config.SlowConsumerDropNewest,
+			queued:   []WsMessage{queued("a", "typing"), queued("b", "typing")},
+			pushed:   queued("c", ""),
+			err:      ErrSlowConsumer,
+			expected: []string{"a", "b"},
+		},
+		{
+			name:     "coalesce replaces message with the same key",
+			policy:   config.SlowConsumerCoalesce,
+			queued:   []WsMessage{queued("a", "typing"), queued("b", "presence")},
+			pushed:   queued("c", "typing"),
+			expected: []string{"c", "b"},
+		},
+		{
+			name:     "coalesce replaces message with the same key before queue is full",
+			policy:   config.SlowConsumerCoalesce,
+			queued:   []WsMessage{queued("a", "typing")},
+			pushed:   queued("b", "typing"),
+			expected: []string{"b"},
+		},
+		{
+			name:     "coalesce disconnects if there is no message with the same key",
+			policy:   config.SlowConsumerCoalesce,
+			queued:   []WsMessage{queued("a", "typing"), queued("b", "presence")},
+			pushed:   queued("c", "receipt"),
+			err:      ErrSlowConsumer,
+			expected: []string{"a", "b"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			queue := newWriteQueue(t.Name(), 2, test.policy)
+			defer queue.release(t.Name())
+			queue.messages = append(queue.messages, test.queued...)
+
+			if err := queue.push(test.pushed); !errors.Is(err, test.err) {
+				t.Fatalf("push returned err: %v, expected: %v", err, test.err)
+			}
+
+			messages := queue.popAll()
+			if len(messages) != len(test.expected) {
+				t.Fatalf("queue holds %d messages, expected %v", len(messages), test.expected)
+			}
+			for i, msg := range messages {
+				if string(msg.Data) != test.expected[i] {
+					t.Errorf("message %d is %s, expected %s", i, msg.Data, test.expected[i])
+				}
+			}
+		})
+	}
+}
+
+func TestPayloadKey(t *testing.T) {
+	envelope := func(msgType string, conversationId string, payload any) *Envelope {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &Envelope{Type: msgType, ConversationId: conversationId, Payload: data}
+	}
+
+	tests := []struct {
+		name     string
+		fields   []string
+		env      *Envelope
+		expected string
+	}{
+		{
+			name:     "type and conversation",
+			env:      envelope("typing", "conversation", map[string]any{"user_id": "user"}),
+			expected: "typing/conversation",
+		},
+		{
+			name:     "payload fields",
+			fields:   []string{"user_id", "device_id"},
+			env:      envelope("receipt", "conversation", map[string]any{"user_id": "user", "device_id": "device"}),
+			expected: "receipt/conversation/user/device",
+		},
+		{
+			name:     "missing and non string fields",
+			fields:   []string{"user_id", "seq"},
+			env:      envelope("presence", "", map[string]any{"seq": 1}),
+			expected: "presence///",
+		},
+		{
+			name:     "payload which is not an object",
+			fields:   []string{"user_id"},
+			env:      envelope("presence", "", []string{"user"}),
+			expected: "",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if key := PayloadKey(test.fields...)(test.env); key != test.expected {
+				t.Errorf("key is %q, expected %q", key, test.expected)
+			}
+		})
+	}
+}
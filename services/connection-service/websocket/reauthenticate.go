@@ -0,0 +1,46 @@
+package websocket
+
+import (
+	"context"
+	"log"
+	"online-chat-go/auth"
+	"time"
+)
+
+const (
+	TypeReauthenticate  = "reauthenticate"
+	TypeReauthenticated = "reauthenticated"
+)
+
+type ReauthenticatePayload struct {
+	Token string `json:"token"`
+}
+
+type ReauthenticatedPayload struct {
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// NewReauthenticateHandler lets clients refresh credentials of established connection before they expire
+func NewReauthenticateHandler(authorizer auth.TokenAuthorizer) Handler {
+	return func(_ context.Context, conn WSConnection, env *Envelope) error {
+		var payload ReauthenticatePayload
+		if err := env.DecodePayload(&payload); err != nil {
+			return err
+		}
+
+		principal, err := authorizer.AuthorizeToken(payload.Token)
+		if err != nil {
+			return NewProtocolError(ErrCodeUnauthorized, err.Error())
+		}
+		if err = conn.Reauthenticate(principal); err != nil {
+			return NewProtocolError(ErrCodeForbidden, err.Error())
+		}
+
+		log.Printf("reauthenticated user with id: %s, connection id: %s\n", principal.Id, conn.Id())
+		reply := ReauthenticatedPayload{}
+		if !principal.ExpiresAt.IsZero() {
+			reply.ExpiresAt = &principal.ExpiresAt
+		}
+		return Reply(conn, env, TypeReauthenticated, reply)
+	}
+}
@@ -4,18 +4,35 @@ import (
 	"errors"
 	"fmt"
 	"github.com/gorilla/websocket"
+	"online-chat-go/config"
 	"online-chat-go/util"
 	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	ErrServerDraining     = errors.New("Server is shutting down")
+	ErrServerFull         = errors.New("Server does not accept more connections")
+	ErrTooManyConnections = errors.New("User has too many open connections")
 )
 
 type WSServer struct {
 	connections        *util.SafeMap[string, *userWsConnections]
 	onUserConnected    func(id string)
 	onUserDisconnected func(id string)
+	onConnAdded        func(id string, conn WSConnection)
+	onConnRemoved      func(id string, conn WSConnection)
+	// drainMut makes draining flag and adding of connections atomic, so no connection is added once shutdown starts
+	drainMut sync.RWMutex
+	draining bool
+	active   sync.WaitGroup
+	count    atomic.Int64
+	config   *config.WsConfig
 }
 
-func NewWSServer() *WSServer {
-	return &WSServer{connections: util.NewSafeMap[string, *userWsConnections]()}
+func NewWSServer(config *config.WsConfig) *WSServer {
+	return &WSServer{connections: util.NewSafeMap[string, *userWsConnections](), config: config}
 }
 
 func (wss *WSServer) SetOnUserConnected(callback func(id string)) {
@@ -26,25 +43,96 @@ func (wss *WSServer) SetOnUserDisconnected(callback func(id string)) {
 	wss.onUserDisconnected = callback
 }
 
+// SetOnConnectionAdded sets callback called for every connection added, after user connected callback
+func (wss *WSServer) SetOnConnectionAdded(callback func(id string, conn WSConnection)) {
+	wss.onConnAdded = callback
+}
+
+// SetOnConnectionRemoved sets callback called for every connection removed, after user disconnected callback
+func (wss *WSServer) SetOnConnectionRemoved(callback func(id string, conn WSConnection)) {
+	wss.onConnRemoved = callback
+}
+
+// AddConnection fails with ErrServerDraining once Shutdown is called and with ErrServerFull once instance has max
+// connections. User with max connections gets ErrTooManyConnections under reject policy, under evict oldest policy
+// its oldest connection is closed instead
 func (wss *WSServer) AddConnection(id string, conn WSConnection) error {
+	created, evicted, err := wss.add(id, conn)
+	if err != nil {
+		return err
+	}
+
+	// hooks could take long, so they run once drain lock is released and do not hold back shutdown
+	if created && wss.onUserConnected != nil {
+		wss.onUserConnected(id)
+	}
+	if wss.onConnAdded != nil {
+		wss.onConnAdded(id, conn)
+	}
+	if evicted != nil {
+		go func() { _ = evicted.CloseWithReason(CloseTooManyConnections, "too many connections") }()
+	}
+	return nil
+}
+
+// add tells whether connection is the first one of user and which connection of user should be evicted if any
+func (wss *WSServer) add(id string, conn WSConnection) (bool, WSConnection, error) {
+	wss.drainMut.RLock()
+	defer wss.drainMut.RUnlock()
+	if wss.draining {
+		return false, nil, ErrServerDraining
+	}
+	if !wss.reserve() {
+		return false, nil, ErrServerFull
+	}
+
+	evict := wss.config.UserLimitPolicy == config.UserLimitEvictOldest
 	for {
 		userConns, created := wss.connections.ComputeIfAbsent(id, newSingleUserWsConnection)
-		err := userConns.AddConnection(conn)
+		evicted, err := userConns.AddConnection(conn, wss.config.MaxUserConnections, evict)
 
 		if err == nil {
-			if created && wss.onUserConnected != nil {
-				wss.onUserConnected(id)
-			}
-
-			return nil
+			wss.active.Add(1)
+			return created, evicted, nil
 		} else if _, ok := err.(*DestroyedUConnUsageError); ok {
 			runtime.Gosched() // We can't add connection to destroyed holder, so we need to retry later
 		} else {
-			return err
+			wss.count.Add(-1)
+			return false, nil, err
 		}
 	}
 }
 
+// reserve counts connection towards instance limit unless it is reached
+func (wss *WSServer) reserve() bool {
+	for {
+		count := wss.count.Load()
+		if wss.config.MaxConnections > 0 && count >= int64(wss.config.MaxConnections) {
+			return false
+		}
+		if wss.count.CompareAndSwap(count, count+1) {
+			return true
+		}
+	}
+}
+
+// Full tells whether instance has max connections, so upgrades could be refused before handshake
+func (wss *WSServer) Full() bool {
+	return wss.config.MaxConnections > 0 && wss.count.Load() >= int64(wss.config.MaxConnections)
+}
+
+// UserFull tells whether user has max open connections and the new one would be rejected rather than evict the oldest,
+// connections which are closed but not removed yet are not counted
+func (wss *WSServer) UserFull(id string) bool {
+	limit := wss.config.MaxUserConnections
+	if wss.config.UserLimitPolicy != config.UserLimitReject || limit <= 0 {
+		return false
+	}
+
+	userConns, ok := wss.connections.Get(id)
+	return ok && userConns.OpenLen() >= limit
+}
+
 func (wss *WSServer) RemoveConnection(id string, conn WSConnection) error {
 	userConns, ok := wss.connections.Get(id)
 	if !ok {
@@ -52,12 +140,19 @@ func (wss *WSServer) RemoveConnection(id string, conn WSConnection) error {
 	}
 
 	destroyed, err := userConns.RemoveConnection(conn)
+	if err == nil {
+		wss.count.Add(-1)
+		defer wss.active.Done()
+	}
 	if destroyed {
 		wss.connections.Delete(id)
 		if wss.onUserDisconnected != nil {
 			wss.onUserDisconnected(id)
 		}
 	}
+	if err == nil && wss.onConnRemoved != nil {
+		wss.onConnRemoved(id, conn)
+	}
 
 	return err
 }
@@ -71,19 +166,60 @@ func (wss *WSServer) SendBinaryMessage(id string, msg []byte) error {
 }
 
 func (wss *WSServer) SendMessage(id string, msgData []byte, msgType int) error {
+	return wss.ForUserConnections(id, func(conn WSConnection) {
+		_ = conn.Write(WsMessage{Type: msgType, Data: msgData})
+	})
+}
+
+// CloseSession closes all connections of user which were authorized within given session
+func (wss *WSServer) CloseSession(id string, sessionId string, code int, reason string) error {
+	return wss.ForUserConnections(id, func(conn WSConnection) {
+		if conn.Principal().SessionId == sessionId {
+			_ = conn.CloseWithReason(code, reason)
+		}
+	})
+}
+
+// ConnectionsCount returns number of connections user has opened to this instance
+func (wss *WSServer) ConnectionsCount(id string) int {
+	userConns, ok := wss.connections.Get(id)
+	if !ok {
+		return 0
+	}
+	return userConns.Len()
+}
+
+// Draining tells whether server is shutting down and does not accept connections anymore
+func (wss *WSServer) Draining() bool {
+	wss.drainMut.RLock()
+	defer wss.drainMut.RUnlock()
+	return wss.draining
+}
+
+// ForAllConnections runs block for every connection opened to this instance, each in its own goroutine
+func (wss *WSServer) ForAllConnections(block func(conn WSConnection)) {
+	wss.connections.ForEach(func(_ string, userConns *userWsConnections) {
+		_ = userConns.ForAllConnections(block)
+	})
+}
+
+// ForUserConnections runs block for every connection of user, each in its own goroutine
+func (wss *WSServer) ForUserConnections(id string, block func(conn WSConnection)) error {
+	userConns, ok := wss.connections.Get(id)
+	if !ok {
+		return errors.New(fmt.Sprintf("No connections for id: %s", id))
+	}
+
+	return userConns.ForAllConnections(block)
+}
+
+// ForEachUserConnection runs block for every connection of user in calling goroutine, so connection sees blocks
+// in order they are run by caller. Block should not block
+func (wss *WSServer) ForEachUserConnection(id string, block func(conn WSConnection)) error {
 	userConns, ok := wss.connections.Get(id)
 	if !ok {
 		return errors.New(fmt.Sprintf("No connections for id: %s", id))
 	}
 
-	return userConns.ForAllConnections(
-		func(conn WSConnection) {
-			select {
-			case <-conn.Done():
-				return
-			case conn.WritePump() <- WsMessage{Type: msgType, Data: msgData}:
-				return
-			}
-		},
-	)
+	return userConns.ForEachConnection(block)
 }
@@ -0,0 +1,44 @@
+package websocket
+
+import (
+	"online-chat-go/config"
+	"testing"
+)
+
+func TestUserFullSkipsClosedConnections(t *testing.T) {
+	wss := NewWSServer(&config.WsConfig{MaxUserConnections: 1, UserLimitPolicy: config.UserLimitReject})
+	conn := newOpenConn()
+	if err := wss.AddConnection("user", conn); err != nil {
+		t.Fatal(err)
+	}
+	if !wss.UserFull("user") {
+		t.Fatal("user with max open connections is not full")
+	}
+
+	// connection is closed, but its handler has not removed it yet
+	close(conn.done)
+	if wss.UserFull("user") {
+		t.Error("user whose connection is closed is full")
+	}
+}
+
+func TestAddConnectionRunsHooksWithoutDrainLock(t *testing.T) {
+	wss := NewWSServer(&config.WsConfig{})
+	locked := func() bool {
+		if wss.drainMut.TryLock() {
+			wss.drainMut.Unlock()
+			return false
+		}
+		return true
+	}
+
+	var userLocked, connLocked bool
+	wss.SetOnUserConnected(func(_ string) { userLocked = locked() })
+	wss.SetOnConnectionAdded(func(_ string, _ WSConnection) { connLocked = locked() })
+	if err := wss.AddConnection("user", newOpenConn()); err != nil {
+		t.Fatal(err)
+	}
+	if userLocked || connLocked {
+		t.Errorf("hooks run with drain lock held, user connected: %t, connection added: %t", userLocked, connLocked)
+	}
+}
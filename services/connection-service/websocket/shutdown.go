@@ -0,0 +1,63 @@
+package websocket
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"log"
+	"time"
+)
+
+const TypeGoingAway = "going_away"
+
+// GoingAwayPayload tells client that server is shutting down, so it should reconnect to another instance,
+// connection is closed by server at Deadline the latest
+type GoingAwayPayload struct {
+	Reason   string    `json:"reason"`
+	Deadline time.Time `json:"deadline"`
+}
+
+const goingAwayReason = "server is shutting down, reconnect elsewhere"
+
+// Shutdown stops accepting connections and asks connected clients to reconnect elsewhere. Connections which are
+// still open once drain period is over get their queued messages flushed and are closed with going away code.
+// It returns once all connection handlers are finished or context is done
+func (wss *WSServer) Shutdown(ctx context.Context, drainPeriod time.Duration) {
+	wss.drainMut.Lock()
+	wss.draining = true
+	wss.drainMut.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		wss.active.Wait()
+		close(finished)
+	}()
+
+	deadline := time.Now().Add(drainPeriod)
+	env, err := NewEnvelope(TypeGoingAway, GoingAwayPayload{Reason: goingAwayReason, Deadline: deadline.UTC()})
+	if err != nil {
+		log.Println("Error creating going away message: ", err)
+	} else {
+		wss.ForAllConnections(func(conn WSConnection) {
+			_ = Send(conn, env)
+		})
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-finished:
+		return
+	case <-ctx.Done():
+		return
+	case <-timer.C:
+	}
+
+	wss.ForAllConnections(func(conn WSConnection) {
+		_ = conn.Drain(websocket.CloseGoingAway, goingAwayReason)
+	})
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		log.Println("Error closing websocket connections: ", ctx.Err())
+	}
+}
@@ -16,6 +16,7 @@ func (err *DestroyedUConnUsageError) Error() string {
 // internal holder struct for all opened ws connections of particular user
 type userWsConnections struct {
 	connections *[]WSConnection
+	evicted     map[WSConnection]bool // evicted connections are closed asynchronously, so they are marked until removed
 	mut         *sync.RWMutex
 	destroyed   bool
 }
@@ -28,30 +29,61 @@ func newUserWsConnections(initialCapacity int) *userWsConnections {
 	s := make([]WSConnection, 0, initialCapacity)
 	return &userWsConnections{
 		connections: &s,
+		evicted:     make(map[WSConnection]bool),
 		mut:         &sync.RWMutex{},
 		destroyed:   false,
 	}
 }
 
-// AddConnection Does not perform contains check for speed, so same connection should not be added multiple times
-func (u *userWsConnections) AddConnection(conn WSConnection) error {
+// AddConnection Does not perform contains check for speed, so same connection should not be added multiple times.
+// Once user has limit open connections, ErrTooManyConnections is returned unless evict is set, then the oldest
+// open connection is returned so caller could close it. Zero limit means no limit
+func (u *userWsConnections) AddConnection(conn WSConnection, limit int, evict bool) (WSConnection, error) {
 	u.mut.Lock()
 	defer u.mut.Unlock()
 
 	if u.destroyed == true {
-		return &DestroyedUConnUsageError{"Tying to add connection to destroyed holder"}
+		return nil, &DestroyedUConnUsageError{"Tying to add connection to destroyed holder"}
+	}
+
+	// connections are kept in order they were added, closed ones stay until their handlers remove them
+	var evicted WSConnection
+	if limit > 0 {
+		open := u.open()
+		if len(open) >= limit && !evict {
+			return nil, ErrTooManyConnections
+		} else if len(open) >= limit {
+			evicted = open[0]
+			u.evicted[evicted] = true
+		}
 	}
 
 	us := append(*u.connections, conn)
 	u.connections = &us
-	return nil
+	return evicted, nil
+}
+
+func (u *userWsConnections) open() []WSConnection {
+	open := make([]WSConnection, 0, len(*u.connections))
+	for _, conn := range *u.connections {
+		if u.evicted[conn] {
+			continue
+		}
+		select {
+		case <-conn.Done():
+		default:
+			open = append(open, conn)
+		}
+	}
+	return open
 }
 
 func (u *userWsConnections) RemoveConnection(conn WSConnection) (bool, error) {
 	u.mut.Lock()
 	defer u.mut.Unlock()
 
-	err := util.RemoveSwapElem(u.connections, conn)
+	err := util.RemoveElem(u.connections, conn)
+	delete(u.evicted, conn)
 	if len(*u.connections) == 0 {
 		u.destroyed = true
 	}
@@ -60,6 +92,11 @@ func (u *userWsConnections) RemoveConnection(conn WSConnection) (bool, error) {
 }
 
 func (u *userWsConnections) ForAllConnections(block func(conn WSConnection)) error {
+	return u.ForEachConnection(func(conn WSConnection) { go block(conn) })
+}
+
+// ForEachConnection runs block for every connection one after another with connections locked, so it should not block
+func (u *userWsConnections) ForEachConnection(block func(conn WSConnection)) error {
 	u.mut.RLock()
 	defer u.mut.RUnlock()
 
@@ -68,7 +105,20 @@ func (u *userWsConnections) ForAllConnections(block func(conn WSConnection)) err
 	}
 
 	for _, connection := range *u.connections {
-		go block(connection)
+		block(connection)
 	}
 	return nil
 }
+
+// OpenLen counts connections which are neither closed nor evicted, only they count towards limit of user
+func (u *userWsConnections) OpenLen() int {
+	u.mut.RLock()
+	defer u.mut.RUnlock()
+	return len(u.open())
+}
+
+func (u *userWsConnections) Len() int {
+	u.mut.RLock()
+	defer u.mut.RUnlock()
+	return len(*u.connections)
+}
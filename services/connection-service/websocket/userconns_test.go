@@ -0,0 +1,61 @@
+package websocket
+
+import (
+	"errors"
+	"testing"
+)
+
+// openConn is connection which stays open, only its identity and Done are used by holder
+type openConn struct {
+	WSConnection
+	done chan bool
+}
+
+func newOpenConn() *openConn {
+	return &openConn{done: make(chan bool)}
+}
+
+func (c *openConn) Done() <-chan bool {
+	return c.done
+}
+
+func TestAddConnectionEvictsEveryConnectionOnce(t *testing.T) {
+	holder := newSingleUserWsConnection()
+	first, second := newOpenConn(), newOpenConn()
+	for _, conn := range []WSConnection{first, second} {
+		if evicted, err := holder.AddConnection(conn, 2, true); err != nil || evicted != nil {
+			t.Fatalf("connection is added with evicted: %v, err: %v", evicted, err)
+		}
+	}
+
+	// evicted connections are not closed yet, so they must not be picked again
+	for _, expected := range []WSConnection{first, second} {
+		evicted, err := holder.AddConnection(newOpenConn(), 2, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if evicted != expected {
+			t.Fatalf("evicted connection is %v, expected %v", evicted, expected)
+		}
+	}
+	if open := len(holder.open()); open != 2 {
+		t.Errorf("user has %d open connections, expected 2", open)
+	}
+
+	if _, err := holder.RemoveConnection(first); err != nil {
+		t.Fatal(err)
+	}
+	if holder.evicted[first] {
+		t.Error("removed connection is still marked as evicted")
+	}
+}
+
+func TestAddConnectionRejectsOverLimit(t *testing.T) {
+	holder := newSingleUserWsConnection()
+	if _, err := holder.AddConnection(newOpenConn(), 1, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := holder.AddConnection(newOpenConn(), 1, false); !errors.Is(err, ErrTooManyConnections) {
+		t.Errorf("connection over limit is added with err: %v, expected ErrTooManyConnections", err)
+	}
+}